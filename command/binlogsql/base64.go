@@ -0,0 +1,395 @@
+package binlogsql
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pingcap/tidb/pkg/parser/charset"
+)
+
+const (
+	FormatSQL          = "sql"
+	FormatBinlogBase64 = "binlog-base64"
+
+	// mysqlbinlog 输出 BINLOG 语句时每行 base64 的长度
+	base64LineLength = 76
+)
+
+// base64Encoder 把选中的原始事件输出为 mysqlbinlog 格式的 BINLOG '...' 语句,
+// 输出可以直接通过 mysql 客户端重放, 保留浮点数/排序规则等原始数据
+type base64Encoder struct {
+	fde         []byte            // 当前 binlog 文件的 FORMAT_DESCRIPTION_EVENT
+	headerDone  bool              // 是否已输出头部
+	tableMaps   map[uint64][]byte // 等待和行事件一起输出的 TABLE_MAP_EVENT
+	gtid        string            // 当前事务的 GTID, 匿名事务为空
+	vars        []string          // 等待和下一条语句一起输出的 INTVAR/RAND/USER_VAR
+	trxBegin    string            // 当前事务的 BEGIN 语句
+	trxSelected bool              // 当前事务是否已有事件被选中输出
+}
+
+func newBase64Encoder() *base64Encoder {
+	return &base64Encoder{tableMaps: make(map[uint64][]byte)}
+}
+
+func encodeBinlogStatement(raws ...[]byte) string {
+	var sb strings.Builder
+	sb.WriteString("BINLOG '\n")
+	for _, raw := range raws {
+		encoded := base64.StdEncoding.EncodeToString(raw)
+		for len(encoded) > base64LineLength {
+			sb.WriteString(encoded[:base64LineLength])
+			sb.WriteString("\n")
+			encoded = encoded[base64LineLength:]
+		}
+		sb.WriteString(encoded)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("'/*!*/;\n")
+	return sb.String()
+}
+
+// header 返回 mysqlbinlog 输出的会话设置和 FORMAT_DESCRIPTION_EVENT
+func (b *base64Encoder) header() string {
+	if b.headerDone || b.fde == nil {
+		return ""
+	}
+	b.headerDone = true
+	return "/*!50530 SET @@SESSION.PSEUDO_SLAVE_MODE=1*/;\n" +
+		"/*!50003 SET @OLD_COMPLETION_TYPE=@@COMPLETION_TYPE,COMPLETION_TYPE=0*/;\n" +
+		"DELIMITER /*!*/;\n" +
+		encodeBinlogStatement(b.fde)
+}
+
+// Footer 返回结束语句, 只有输出过头部时才需要
+func (b *base64Encoder) Footer() string {
+	if !b.headerDone {
+		return ""
+	}
+	return "SET @@SESSION.GTID_NEXT= 'AUTOMATIC' /* added by dbkit */ /*!*/;\n" +
+		"DELIMITER ;\n" +
+		"# End of log file\n" +
+		"/*!50003 SET COMPLETION_TYPE=@OLD_COMPLETION_TYPE*/;\n" +
+		"/*!50530 SET @@SESSION.PSEUDO_SLAVE_MODE=0*/;\n"
+}
+
+// beginTrx 在事务第一个被选中的事件前输出 GTID_NEXT 和 BEGIN, 重放时保留原事务的 GTID
+func (b *base64Encoder) beginTrx() string {
+	if b.trxSelected {
+		return ""
+	}
+	b.trxSelected = true
+	out := ""
+	if b.gtid != "" {
+		out += fmt.Sprintf("SET @@SESSION.GTID_NEXT= '%s'/*!*/;\n", b.gtid)
+	}
+	if b.trxBegin != "" {
+		out += b.trxBegin + "\n/*!*/;\n"
+	}
+	return out
+}
+
+// endTrx 结束当前事务, 输出过 GTID_NEXT 时返回恢复 AUTOMATIC 的语句
+func (b *base64Encoder) endTrx() string {
+	out := ""
+	if b.trxSelected && b.gtid != "" {
+		out = "SET @@SESSION.GTID_NEXT= 'AUTOMATIC'/*!*/;\n"
+	}
+	b.gtid = ""
+	b.vars = nil
+	b.trxBegin = ""
+	b.trxSelected = false
+	b.tableMaps = make(map[uint64][]byte)
+	return out
+}
+
+// Encode 处理一个事件, selected 表示事件通过了库表/GTID/时间过滤, 返回需要输出的内容.
+// XA 分支的输出和 sql 格式一样由 xa 缓存, XA COMMIT 时作为普通事务输出, XA ROLLBACK 时丢弃
+func (b *base64Encoder) Encode(ev *replication.BinlogEvent, fileName string, selected bool, xa *xaTracker) string {
+	body := b.encode(ev, fileName, selected)
+	if body != "" && xa.Buffer(body) {
+		body = ""
+	}
+	xaOut, _ := xa.Handle(ev, fileName)
+	var sb strings.Builder
+	for _, s := range xaOut {
+		sb.WriteString(s)
+		if !strings.HasSuffix(s, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	sb.WriteString(body)
+	if sb.Len() == 0 {
+		return ""
+	}
+	return b.header() + sb.String()
+}
+
+func (b *base64Encoder) encode(ev *replication.BinlogEvent, fileName string, selected bool) string {
+	if _, _, ok := xaPrepare(ev); ok {
+		// XA_PREPARE 结束 XA 分支, 重放时作为普通事务提交
+		out := ""
+		if b.trxSelected {
+			out = fmt.Sprintf("# at %s:%d\nCOMMIT/*!*/;\n", fileName, ev.Header.LogPos)
+		}
+		return out + b.endTrx()
+	}
+
+	if stmt, ok := statementVar(ev); ok {
+		// 语句格式下后一条语句用到的变量, BINLOG 语句只能包含 FDE 和行事件, 按 mysqlbinlog 的方式输出为 SET 语句
+		b.vars = append(b.vars, stmt)
+		return ""
+	}
+
+	switch e := ev.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		// 每个文件开头都有 FDE, 只有第一个需要输出, 后续文件格式一致
+		if b.fde == nil {
+			b.fde = ev.RawData
+		}
+		return ""
+
+	case *replication.GTIDEvent:
+		out := b.endTrx()
+		if e.GNO > 0 {
+			// GTID_MODE=OFF 时是 ANONYMOUS_GTID_EVENT, GNO 为 0
+			b.gtid = fmt.Sprintf("%s:%d", FormatGTID(e.SID), e.GNO)
+		}
+		return out
+
+	case *replication.TableMapEvent:
+		b.tableMaps[e.TableID] = ev.RawData
+		return ""
+
+	case *replication.QueryEvent:
+		query := strings.TrimSpace(string(e.Query))
+		if strings.ToUpper(query) == "BEGIN" {
+			b.trxBegin = "BEGIN"
+			return ""
+		}
+		switch op, _ := parseXAQuery(query); op {
+		case XAStart:
+			// XA 分支重放为 BEGIN 开始的普通事务
+			b.trxBegin = "BEGIN"
+			return ""
+		case XAEnd:
+			return ""
+		case XACommit, XARollback:
+			// 分支的内容由 xaTracker 输出
+			return b.endTrx()
+		}
+		if strings.ToUpper(query) == "COMMIT" {
+			// 非事务引擎的事务以 COMMIT 语句结束
+			out := ""
+			if b.trxSelected {
+				out = fmt.Sprintf("# at %s:%d\nCOMMIT\n/*!*/;\n", fileName, ev.Header.LogPos)
+			}
+			return out + b.endTrx()
+		}
+		vars := b.vars
+		b.vars = nil
+		if !selected {
+			return ""
+		}
+		out := b.beginTrx()
+		if len(e.Schema) > 0 {
+			out += fmt.Sprintf("use `%s`/*!*/;\n", e.Schema)
+		}
+		out += fmt.Sprintf("# at %s:%d\nSET TIMESTAMP=%d/*!*/;\n", fileName, ev.Header.LogPos, ev.Header.Timestamp)
+		out += strings.Join(vars, "") + query + "\n/*!*/;\n"
+		if binlog.IsDDL(query) {
+			// DDL 隐式提交
+			out += b.endTrx()
+		}
+		return out
+
+	case *replication.RowsEvent:
+		if !selected {
+			return ""
+		}
+		tableMap, ok := b.tableMaps[e.TableID]
+		if !ok {
+			return fmt.Sprintf("# WARNING: %s:%d table map event of %s.%s not found, rows event skipped\n", fileName, ev.Header.LogPos, e.Table.Schema, e.Table.Table)
+		}
+		out := b.beginTrx()
+		return out + fmt.Sprintf("# at %s:%d\n", fileName, ev.Header.LogPos) + encodeBinlogStatement(tableMap, ev.RawData)
+
+	case *replication.XIDEvent:
+		out := ""
+		if b.trxSelected {
+			out = fmt.Sprintf("# at %s:%d\nCOMMIT/*!*/;\n", fileName, ev.Header.LogPos)
+		}
+		return out + b.endTrx()
+	}
+	return ""
+}
+
+// statementVar 把 INTVAR/RAND/USER_VAR 事件转换为 mysqlbinlog 输出的 SET 语句
+func statementVar(ev *replication.BinlogEvent) (string, bool) {
+	switch ev.Header.EventType {
+	case replication.INTVAR_EVENT:
+		e, ok := ev.Event.(*replication.IntVarEvent)
+		if !ok {
+			return "", false
+		}
+		name := "INSERT_ID"
+		if e.Type == replication.LAST_INSERT_ID {
+			name = "LAST_INSERT_ID"
+		}
+		return fmt.Sprintf("SET %s=%d/*!*/;\n", name, e.Value), true
+	case replication.RAND_EVENT:
+		e, ok := ev.Event.(*replication.GenericEvent)
+		if !ok || len(e.Data) < 16 {
+			return "", false
+		}
+		return fmt.Sprintf("SET @@RAND_SEED1=%d, @@RAND_SEED2=%d/*!*/;\n", binary.LittleEndian.Uint64(e.Data), binary.LittleEndian.Uint64(e.Data[8:])), true
+	case replication.USER_VAR_EVENT:
+		e, ok := ev.Event.(*replication.GenericEvent)
+		if !ok {
+			return "", false
+		}
+		name, value, ok := decodeUserVar(e.Data)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("SET @`%s`:=%s/*!*/;\n", strings.ReplaceAll(name, "`", "``"), value), true
+	}
+	return "", false
+}
+
+// USER_VAR_EVENT 中值的类型
+const (
+	userVarString  = 0
+	userVarReal    = 1
+	userVarInt     = 2
+	userVarDecimal = 4
+
+	userVarUnsignedFlag = 0x01
+)
+
+// decodeUserVar 解析 USER_VAR_EVENT, 返回变量名和 SQL 形式的值.
+// 事件体: name_length(4) name is_null(1) [type(1) charset(4) value_length(4) value flags(1, 可选)]
+func decodeUserVar(data []byte) (name string, value string, ok bool) {
+	if len(data) < 5 {
+		return "", "", false
+	}
+	nameLen := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 5+nameLen {
+		return "", "", false
+	}
+	name = string(data[4 : 4+nameLen])
+	data = data[4+nameLen:]
+	if data[0] != 0 {
+		return name, "NULL", true
+	}
+	if len(data) < 10 {
+		return "", "", false
+	}
+	typ := data[1]
+	collationID := int(binary.LittleEndian.Uint32(data[2:]))
+	valueLen := int(binary.LittleEndian.Uint32(data[6:]))
+	if len(data) < 10+valueLen {
+		return "", "", false
+	}
+	val := data[10 : 10+valueLen]
+	var flags byte
+	if len(data) > 10+valueLen {
+		flags = data[10+valueLen]
+	}
+
+	switch typ {
+	case userVarString:
+		collation, err := charset.GetCollationByID(collationID)
+		if err != nil {
+			return name, fmt.Sprintf("_binary 0x%x", val), true
+		}
+		return name, fmt.Sprintf("_%s 0x%x COLLATE `%s`", collation.CharsetName, val, collation.Name), true
+	case userVarReal:
+		if len(val) < 8 {
+			return "", "", false
+		}
+		return name, strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(val)), 'g', -1, 64), true
+	case userVarInt:
+		if len(val) < 8 {
+			return "", "", false
+		}
+		if flags&userVarUnsignedFlag != 0 {
+			return name, strconv.FormatUint(binary.LittleEndian.Uint64(val), 10), true
+		}
+		return name, strconv.FormatInt(int64(binary.LittleEndian.Uint64(val)), 10), true
+	case userVarDecimal:
+		if len(val) < 2 {
+			return "", "", false
+		}
+		d, ok := decodeBinaryDecimal(val[2:], int(val[0]), int(val[1]))
+		return name, d, ok
+	}
+	return "", "", false
+}
+
+// decimal 每组 9 位十进制数, 不足 9 位的组按位数占用的字节数
+var decimalDigitBytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// decodeBinaryDecimal 解析 MySQL 的二进制 DECIMAL(precision, scale)
+func decodeBinaryDecimal(data []byte, precision, scale int) (string, bool) {
+	intg := precision - scale
+	intg0, intg0x := intg/9, intg%9
+	frac0, frac0x := scale/9, scale%9
+	size := intg0*4 + decimalDigitBytes[intg0x] + frac0*4 + decimalDigitBytes[frac0x]
+	if precision <= 0 || scale < 0 || intg < 0 || len(data) < size {
+		return "", false
+	}
+	buf := append([]byte(nil), data[:size]...)
+	// 最高位是符号位, 负数的所有位取反
+	negative := buf[0]&0x80 == 0
+	buf[0] ^= 0x80
+	if negative {
+		for i := range buf {
+			buf[i] = ^buf[i]
+		}
+	}
+	readGroup := func(n int) uint64 {
+		var v uint64
+		for _, c := range buf[:n] {
+			v = v<<8 | uint64(c)
+		}
+		buf = buf[n:]
+		return v
+	}
+
+	var sb strings.Builder
+	if negative {
+		sb.WriteString("-")
+	}
+	intPart := ""
+	if n := decimalDigitBytes[intg0x]; n > 0 {
+		intPart = strconv.FormatUint(readGroup(n), 10)
+	}
+	for i := 0; i < intg0; i++ {
+		group := readGroup(4)
+		if intPart == "" || intPart == "0" {
+			intPart = strconv.FormatUint(group, 10)
+		} else {
+			intPart += fmt.Sprintf("%09d", group)
+		}
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+	sb.WriteString(intPart)
+	if scale > 0 {
+		sb.WriteString(".")
+		for i := 0; i < frac0; i++ {
+			sb.WriteString(fmt.Sprintf("%09d", readGroup(4)))
+		}
+		if n := decimalDigitBytes[frac0x]; n > 0 {
+			sb.WriteString(fmt.Sprintf("%0*d", frac0x, readGroup(n)))
+		}
+	}
+	return sb.String(), true
+}
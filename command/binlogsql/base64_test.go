@@ -0,0 +1,95 @@
+package binlogsql
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// 选中的事务前后设置 GTID_NEXT, 语句前输出 INSERT_ID 等变量
+func TestBase64GTIDAndVars(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	events := []*replication.BinlogEvent{
+		{Header: &replication.EventHeader{EventType: replication.GTID_EVENT, LogPos: 100}, Event: &replication.GTIDEvent{SID: sid, GNO: 7}},
+		queryEvent("BEGIN", 200),
+		{Header: &replication.EventHeader{EventType: replication.INTVAR_EVENT, LogPos: 230}, Event: &replication.IntVarEvent{Type: replication.INSERT_ID, Value: 5}},
+		queryEvent("INSERT INTO t (name) VALUES ('a')", 300),
+		{Header: &replication.EventHeader{EventType: replication.XID_EVENT, LogPos: 330}, Event: &replication.XIDEvent{}},
+	}
+	b := newBase64Encoder()
+	xa := newXATracker()
+	var sb strings.Builder
+	for _, ev := range events {
+		sb.WriteString(b.Encode(ev, "mysql-bin.000001", true, xa))
+	}
+	out := sb.String()
+
+	expect := []string{
+		"SET @@SESSION.GTID_NEXT= '3e11fa47-71ca-11e1-9e33-c80aa9429562:7'/*!*/;",
+		"BEGIN",
+		"SET INSERT_ID=5/*!*/;",
+		"INSERT INTO t (name) VALUES ('a')",
+		"COMMIT/*!*/;",
+		"SET @@SESSION.GTID_NEXT= 'AUTOMATIC'/*!*/;",
+	}
+	last := -1
+	for _, s := range expect {
+		i := strings.Index(out, s)
+		if i <= last {
+			t.Fatalf("%q not found in order in output:\n%s", s, out)
+		}
+		last = i
+	}
+}
+
+func TestDecodeUserVar(t *testing.T) {
+	userVar := func(name string, typ byte, collation uint32, val []byte, flags ...byte) []byte {
+		data := binary.LittleEndian.AppendUint32(nil, uint32(len(name)))
+		data = append(data, name...)
+		data = append(data, 0, typ)
+		data = binary.LittleEndian.AppendUint32(data, collation)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(val)))
+		return append(append(data, val...), flags...)
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		value string
+	}{
+		{"string", userVar("a", userVarString, 255, []byte("abc")), "_utf8mb4 0x616263 COLLATE `utf8mb4_0900_ai_ci`"},
+		{"int", userVar("a", userVarInt, 63, binary.LittleEndian.AppendUint64(nil, uint64(1<<64-3)), 0), "-3"},
+		{"unsigned", userVar("a", userVarInt, 63, binary.LittleEndian.AppendUint64(nil, uint64(1<<64-3)), userVarUnsignedFlag), "18446744073709551613"},
+		{"decimal", userVar("a", userVarDecimal, 63, []byte{10, 2, 0x80, 0x00, 0x04, 0xd2, 0x38}), "1234.56"},
+		{"null", append(binary.LittleEndian.AppendUint32(nil, 1), 'a', 1), "NULL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, value, ok := decodeUserVar(tt.data)
+			if !ok || name != "a" || value != tt.value {
+				t.Errorf("decodeUserVar = %q, %q, %v, expect a, %q", name, value, ok, tt.value)
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryDecimal(t *testing.T) {
+	tests := []struct {
+		data             []byte
+		precision, scale int
+		expect           string
+	}{
+		{[]byte{0x80, 0x00, 0x04, 0xd2, 0x38}, 10, 2, "1234.56"},
+		{[]byte{0x7f, 0xff, 0xfb, 0x2d, 0xc7}, 10, 2, "-1234.56"},
+		{[]byte{0x80, 0x00, 0x00, 0x00, 0x00}, 10, 2, "0.00"},
+		// DECIMAL(20,0): 前 2 位占 1 字节, 后 18 位是两组 9 位
+		{[]byte{0x81, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05}, 20, 0, "1000000000000000005"},
+	}
+	for _, tt := range tests {
+		got, ok := decodeBinaryDecimal(tt.data, tt.precision, tt.scale)
+		if !ok || got != tt.expect {
+			t.Errorf("decodeBinaryDecimal(%x, %d, %d) = %q, %v, expect %q", tt.data, tt.precision, tt.scale, got, ok, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package binlogsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"example.com/m/v2/model"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ReportFormatTable capacity 模式的文本表格
+	ReportFormatTable = "table"
+
+	capacityOtherTable = "(other)" // DDL、事务控制等不属于某个表的事件
+)
+
+// CapacityFile 是一个 binlog 文件的大小和覆盖的时间段, 结束时间为下一个文件的开始时间
+type CapacityFile struct {
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	StartTime    string  `json:"start_time"`
+	EndTime      string  `json:"end_time"`
+	BytesPerHour float64 `json:"bytes_per_hour"`
+}
+
+// CapacityTable 是一个表在扫描的 binlog 中占用的字节数
+type CapacityTable struct {
+	Table  string  `json:"table"`
+	Bytes  int64   `json:"bytes"`
+	Events int64   `json:"events"`
+	Share  float64 `json:"share"` // 百分比
+}
+
+// CapacityReport binlog 增长速度和保留容量报告
+type CapacityReport struct {
+	Files                      []CapacityFile  `json:"files"`
+	TotalBytes                 int64           `json:"total_bytes"`
+	WindowStart                string          `json:"window_start"`
+	WindowEnd                  string          `json:"window_end"`
+	RetentionCoveredSeconds    int64           `json:"retention_covered_seconds"`
+	ConfiguredRetentionSeconds int64           `json:"configured_retention_seconds,omitempty"`
+	BytesPerHour               float64         `json:"bytes_per_hour"`
+	BytesPerDay                float64         `json:"bytes_per_day"`
+	TargetRetentionSeconds     int64           `json:"target_retention_seconds,omitempty"`
+	ProjectedBytes             int64           `json:"projected_bytes,omitempty"`
+	Tables                     []CapacityTable `json:"tables,omitempty"`
+}
+
+// parseRetention 解析保留时间, 支持 d 后缀的天数以及 Go 的时间格式, 例如 7d, 72h
+func parseRetention(retention string) (time.Duration, error) {
+	if strings.HasSuffix(retention, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(retention, "d"), 64)
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid retention: %s, should be like 7d or 72h", retention)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(retention)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention: %s, should be like 7d or 72h", retention)
+	}
+	return d, nil
+}
+
+// getBinlogExpireSeconds 返回主库配置的 binlog 保留时间, 8.0 使用 binlog_expire_logs_seconds, 5.7 使用 expire_logs_days
+func getBinlogExpireSeconds(db *sql.DB) (int64, error) {
+	rows, err := db.Query("SHOW VARIABLES WHERE Variable_name IN ('binlog_expire_logs_seconds', 'expire_logs_days')")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var seconds, days int64
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return 0, err
+		}
+		n, _ := strconv.ParseFloat(value, 64)
+		if name == "binlog_expire_logs_seconds" {
+			seconds = int64(n)
+		} else {
+			days = int64(n)
+		}
+	}
+	if seconds > 0 {
+		return seconds, rows.Err()
+	}
+	return days * 86400, rows.Err()
+}
+
+// capacityFiles 获取 binlog 文件的大小和开始时间, 在线时使用 SHOW BINARY LOGS 和复制协议, 离线时读取 --binlogDir 中的文件.
+// 返回的结束时间是最后一个文件的结束时间: 在线为当前时间, 离线为最后一个文件的修改时间
+func capacityFiles(ctx context.Context, db *sql.DB, cfg replication.BinlogSyncerConfig, options *model.DaemonOptions) ([]binlogFileSize, []time.Time, time.Time, error) {
+	var files []binlogFileSize
+	var starts []time.Time
+	end := time.Now()
+	binlogDir := options.BinlogSql.BinlogDir
+
+	if db != nil {
+		all, err := showBinaryLogs(db)
+		if err != nil {
+			return nil, nil, end, err
+		}
+		for _, f := range all {
+			if (options.BinlogSql.StartFile != "" && compareBinlogName(f.Name, options.BinlogSql.StartFile) < 0) || (options.BinlogSql.StopFile != "" && compareBinlogName(f.Name, options.BinlogSql.StopFile) > 0) {
+				continue
+			}
+			t, err := onlineFirstEventTime(ctx, cfg, f.Name)
+			if err != nil {
+				return nil, nil, end, fmt.Errorf("read first event of %s failed: %v", f.Name, err)
+			}
+			files = append(files, f)
+			starts = append(starts, t)
+		}
+		return files, starts, end, nil
+	}
+
+	names, err := GetFileNameByDir(binlogDir)
+	if err != nil {
+		return nil, nil, end, err
+	}
+	for _, name := range selectBinlogFiles(names, options.BinlogSql.StartFile, options.BinlogSql.StopFile) {
+		info, err := os.Stat(filepath.Join(binlogDir, name))
+		if err != nil {
+			return nil, nil, end, err
+		}
+		t, err := localFirstEventTime(binlogDir, name)
+		if err != nil {
+			return nil, nil, end, fmt.Errorf("read first event of %s failed: %v", name, err)
+		}
+		files = append(files, binlogFileSize{Name: name, Size: info.Size()})
+		starts = append(starts, t)
+		end = info.ModTime()
+	}
+	return files, starts, end, nil
+}
+
+// tableVolume 是一个文件中每个表的事件字节数
+type tableVolume struct {
+	tables map[string]*CapacityTable
+	err    error
+}
+
+// scanTableVolume 统计文件中每个表的行事件和 TABLE_MAP 事件的字节数, 其余事件计入 (other)
+func scanTableVolume(binlogDir, fileName string) *tableVolume {
+	result := &tableVolume{tables: make(map[string]*CapacityTable)}
+	add := func(table string, size uint32) {
+		t, ok := result.tables[table]
+		if !ok {
+			t = &CapacityTable{Table: table}
+			result.tables[table] = t
+		}
+		t.Bytes += int64(size)
+		t.Events++
+	}
+	parser := replication.NewBinlogParser()
+	result.err = parser.ParseFile(filepath.Join(binlogDir, fileName), 0, func(ev *replication.BinlogEvent) error {
+		switch e := ev.Event.(type) {
+		case *replication.RowsEvent:
+			add(strings.ToLower(string(e.Table.Schema)+"."+string(e.Table.Table)), ev.Header.EventSize)
+		case *replication.TableMapEvent:
+			add(strings.ToLower(string(e.Schema)+"."+string(e.Table)), ev.Header.EventSize)
+		default:
+			add(capacityOtherTable, ev.Header.EventSize)
+		}
+		return nil
+	})
+	return result
+}
+
+// GetCapacityReport 统计 binlog 的增长速度、各表占比、当前保留覆盖的时间, 以及按目标保留时间预计占用的磁盘空间
+func GetCapacityReport(ctx context.Context, db *sql.DB, cfg replication.BinlogSyncerConfig, options *model.DaemonOptions, out *outputWriter) error {
+	reportFormat := options.BinlogSql.ReportFormat
+	if reportFormat == "" {
+		reportFormat = ReportFormatTable
+	}
+	if reportFormat != ReportFormatTable && reportFormat != ReportFormatJSON {
+		return fmt.Errorf("unsupported report format of capacity mode: %s, should be table or json", reportFormat)
+	}
+	var target time.Duration
+	if options.BinlogSql.Retention != "" {
+		var err error
+		if target, err = parseRetention(options.BinlogSql.Retention); err != nil {
+			return err
+		}
+	}
+
+	files, starts, end, err := capacityFiles(ctx, db, cfg, options)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no binlog file found")
+	}
+
+	report := &CapacityReport{
+		WindowStart: formatReportTime(starts[0]),
+		WindowEnd:   formatReportTime(end),
+	}
+	for i, f := range files {
+		fileEnd := end
+		if i+1 < len(files) {
+			fileEnd = starts[i+1]
+		}
+		cf := CapacityFile{Name: f.Name, Size: f.Size, StartTime: formatReportTime(starts[i]), EndTime: formatReportTime(fileEnd)}
+		if hours := fileEnd.Sub(starts[i]).Hours(); hours > 0 {
+			cf.BytesPerHour = float64(f.Size) / hours
+		}
+		report.Files = append(report.Files, cf)
+		report.TotalBytes += f.Size
+	}
+	covered := end.Sub(starts[0])
+	report.RetentionCoveredSeconds = int64(covered.Seconds())
+	if covered > 0 {
+		report.BytesPerHour = float64(report.TotalBytes) / covered.Hours()
+		report.BytesPerDay = report.BytesPerHour * 24
+	}
+
+	if db != nil {
+		if report.ConfiguredRetentionSeconds, err = getBinlogExpireSeconds(db); err != nil {
+			log.Warn().Err(err).Msg("get binlog expire seconds failed")
+		}
+	}
+	if target == 0 {
+		target = time.Duration(report.ConfiguredRetentionSeconds) * time.Second
+	}
+	if target > 0 {
+		report.TargetRetentionSeconds = int64(target.Seconds())
+		report.ProjectedBytes = int64(report.BytesPerHour * target.Hours())
+	}
+
+	// 各表占比需要解析文件内容, 只在能读取本地 binlog 文件时统计
+	if options.BinlogSql.BinlogDir != "" {
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.Name
+		}
+		merged := make(map[string]*CapacityTable)
+		var scanned int64
+		_ = parallelFiles(names, options.BinlogSql.Workers, func(fileName string) *tableVolume {
+			return scanTableVolume(options.BinlogSql.BinlogDir, fileName)
+		}, func(fileName string, result *tableVolume) error {
+			if result.err != nil {
+				log.Error().Err(result.err).Msgf("scan binlog file %s failed", fileName)
+			}
+			for table, t := range result.tables {
+				scanned += t.Bytes
+				if m, ok := merged[table]; ok {
+					m.Bytes += t.Bytes
+					m.Events += t.Events
+				} else {
+					merged[table] = t
+				}
+			}
+			return nil
+		})
+		for _, t := range merged {
+			if scanned > 0 {
+				t.Share = float64(t.Bytes) * 100 / float64(scanned)
+			}
+			report.Tables = append(report.Tables, *t)
+		}
+		sort.Slice(report.Tables, func(i, j int) bool {
+			if report.Tables[i].Bytes != report.Tables[j].Bytes {
+				return report.Tables[i].Bytes > report.Tables[j].Bytes
+			}
+			return report.Tables[i].Table < report.Tables[j].Table
+		})
+	} else {
+		log.Info().Msg("per-table share needs local binlog files, give the binlog directory by --binlogDir")
+	}
+
+	if reportFormat == ReportFormatJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		return out.WriteString(string(data) + "\n")
+	}
+	return out.WriteString(report.table())
+}
+
+// formatBytes 按 1024 进制输出容易阅读的大小
+func formatBytes(n float64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.2f%s", n, units[i])
+}
+
+func (r *CapacityReport) table() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "binlog files:\t%d\n", len(r.Files))
+	fmt.Fprintf(w, "total size:\t%s\n", formatBytes(float64(r.TotalBytes)))
+	fmt.Fprintf(w, "window:\t%s ~ %s\n", r.WindowStart, r.WindowEnd)
+	fmt.Fprintf(w, "retention covered:\t%s\n", time.Duration(r.RetentionCoveredSeconds)*time.Second)
+	if r.ConfiguredRetentionSeconds > 0 {
+		fmt.Fprintf(w, "configured retention:\t%s\n", time.Duration(r.ConfiguredRetentionSeconds)*time.Second)
+	}
+	fmt.Fprintf(w, "growth:\t%s/hour, %s/day\n", formatBytes(r.BytesPerHour), formatBytes(r.BytesPerDay))
+	if r.TargetRetentionSeconds > 0 {
+		fmt.Fprintf(w, "projected size:\t%s for retention %s\n", formatBytes(float64(r.ProjectedBytes)), time.Duration(r.TargetRetentionSeconds)*time.Second)
+	}
+	w.Flush()
+
+	fmt.Fprintln(&buf)
+	w = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tSTART\tEND\tPER HOUR")
+	for _, f := range r.Files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Name, formatBytes(float64(f.Size)), f.StartTime, f.EndTime, formatBytes(f.BytesPerHour))
+	}
+	w.Flush()
+
+	if len(r.Tables) > 0 {
+		fmt.Fprintln(&buf)
+		w = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tSIZE\tEVENTS\tSHARE")
+		for _, t := range r.Tables {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.2f%%\n", t.Table, formatBytes(float64(t.Bytes)), t.Events, t.Share)
+		}
+		w.Flush()
+	}
+	return buf.String()
+}
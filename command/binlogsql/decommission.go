@@ -0,0 +1,497 @@
+package binlogsql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ReportFormatCSV  = "csv"
+	ReportFormatJSON = "json"
+
+	reportTimeLayout = "2006-01-02 15:04:05"
+)
+
+// TableWriteStat 一个表在扫描范围内的写入情况, 用于下线前确认表是否还有写入
+type TableWriteStat struct {
+	Table      string    `json:"table"`
+	LastInsert time.Time `json:"last_insert"`
+	LastUpdate time.Time `json:"last_update"`
+	LastDelete time.Time `json:"last_delete"`
+	LastDDL    time.Time `json:"last_ddl"`
+	LastDDLSQL string    `json:"last_ddl_sql"`
+	LastFile   string    `json:"last_file"` // 最后一次写入或 DDL 所在的 binlog 文件
+	Inserts    int64     `json:"inserts"`   // 写入行数
+	Updates    int64     `json:"updates"`
+	Deletes    int64     `json:"deletes"`
+	Statements int64     `json:"statements"` // 语句格式(STATEMENT/MIXED)的 DML 条数, 影响的行数未知
+	ZeroWrite  bool      `json:"zero_write"`
+}
+
+func (s *TableWriteStat) writes() int64 {
+	return s.Inserts + s.Updates + s.Deletes + s.Statements
+}
+
+// merge 合并另一个文件的统计, 时间取较晚的一个
+func (s *TableWriteStat) merge(o *TableWriteStat) {
+	s.Inserts += o.Inserts
+	s.Updates += o.Updates
+	s.Deletes += o.Deletes
+	s.Statements += o.Statements
+	latest := func(a *time.Time, b time.Time) {
+		if b.After(*a) {
+			*a = b
+		}
+	}
+	latest(&s.LastInsert, o.LastInsert)
+	latest(&s.LastUpdate, o.LastUpdate)
+	latest(&s.LastDelete, o.LastDelete)
+	if !o.LastDDL.IsZero() && !o.LastDDL.Before(s.LastDDL) {
+		s.LastDDL = o.LastDDL
+		s.LastDDLSQL = o.LastDDLSQL
+	}
+	if compareBinlogName(o.LastFile, s.LastFile) > 0 {
+		s.LastFile = o.LastFile
+	}
+}
+
+type DecommissionReport struct {
+	Files       []string          `json:"files"`
+	WindowStart time.Time         `json:"window_start"` // 扫描到的第一个事件时间
+	WindowEnd   time.Time         `json:"window_end"`   // 扫描到的最后一个事件时间
+	Tables      []*TableWriteStat `json:"tables"`
+}
+
+// fileWriteStat 单个 binlog 文件的扫描结果, 各文件独立扫描后再合并
+type fileWriteStat struct {
+	name      string
+	startTime time.Time
+	endTime   time.Time
+	tables    map[string]*TableWriteStat
+	err       error
+}
+
+// tableMatcher 匹配 --tables 指定的 db.table 列表, 支持 * ? 通配符
+type tableMatcher struct {
+	patterns []string
+}
+
+func newTableMatcher(options *model.DaemonOptions) *tableMatcher {
+	m := &tableMatcher{}
+	for _, p := range strings.Split(options.BinlogSql.Tables, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			if !strings.Contains(p, ".") {
+				p = "*." + p
+			}
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	if len(m.patterns) == 0 {
+		// 未指定 --tables 时使用 --db/--table
+		db, table := strings.ToLower(options.BinlogSql.DBName), strings.ToLower(options.BinlogSql.TableName)
+		if db == "" {
+			db = "*"
+		}
+		if table == "" {
+			table = "*"
+		}
+		m.patterns = append(m.patterns, db+"."+table)
+	}
+	return m
+}
+
+// exactTables 返回不含通配符的表, 即使没有数据库连接也能报告这些表没有写入
+func (m *tableMatcher) exactTables() []string {
+	var tables []string
+	for _, p := range m.patterns {
+		if !strings.ContainsAny(p, "*?[") {
+			tables = append(tables, p)
+		}
+	}
+	return tables
+}
+
+func (m *tableMatcher) Match(dbTable string) bool {
+	for _, p := range m.patterns {
+		if ok, _ := path.Match(p, dbTable); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ddlTables 返回 DDL 语句涉及的所有表, 格式为小写的 db.table
+func ddlTables(p *parser.Parser, defaultDB, query string) []string {
+	stmts, _, err := p.Parse(query, "", "")
+	if err != nil {
+		return nil
+	}
+	var tables []string
+	for _, stmt := range stmts {
+		var names []*ast.TableName
+		switch s := stmt.(type) {
+		case *ast.CreateTableStmt:
+			names = append(names, s.Table)
+		case *ast.AlterTableStmt:
+			names = append(names, s.Table)
+		case *ast.DropTableStmt:
+			names = append(names, s.Tables...)
+		case *ast.TruncateTableStmt:
+			names = append(names, s.Table)
+		case *ast.CreateIndexStmt:
+			names = append(names, s.Table)
+		case *ast.DropIndexStmt:
+			names = append(names, s.Table)
+		case *ast.RenameTableStmt:
+			for _, t := range s.TableToTables {
+				names = append(names, t.OldTable, t.NewTable)
+			}
+		}
+		for _, name := range names {
+			if name != nil {
+				tables = append(tables, tableKey(defaultDB, name))
+			}
+		}
+	}
+	return tables
+}
+
+// tableNameCollector 收集语法树中的所有表名
+type tableNameCollector struct {
+	names []*ast.TableName
+}
+
+func (c *tableNameCollector) Enter(n ast.Node) (ast.Node, bool) {
+	if name, ok := n.(*ast.TableName); ok {
+		c.names = append(c.names, name)
+	}
+	return n, false
+}
+
+func (c *tableNameCollector) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+// dmlTables 返回语句格式的 DML 写入的表和类型(insert, update, delete), 格式为小写的 db.table.
+// 多表 UPDATE 无法区分写入的表, 按 JOIN 中的所有表统计; 语句无法解析时按 binlog.ParseDML 取第一个表
+func dmlTables(p *parser.Parser, defaultDB, query string) ([]string, binlog.ChangeType) {
+	stmts, _, err := p.Parse(query, "", "")
+	if err != nil || len(stmts) == 0 {
+		db, table, ok := binlog.ParseDML(query)
+		if !ok {
+			return nil, ""
+		}
+		if db == "" {
+			db = defaultDB
+		}
+		changeType := binlog.Insert
+		switch strings.ToUpper(strings.Fields(query)[0]) {
+		case "UPDATE":
+			changeType = binlog.Update
+		case "DELETE":
+			changeType = binlog.Delete
+		}
+		return []string{strings.ToLower(db + "." + table)}, changeType
+	}
+	var tables []string
+	var changeType binlog.ChangeType
+	for _, stmt := range stmts {
+		collector := &tableNameCollector{}
+		switch s := stmt.(type) {
+		case *ast.InsertStmt:
+			changeType = binlog.Insert
+			if s.Table != nil {
+				s.Table.Accept(collector)
+			}
+		case *ast.UpdateStmt:
+			changeType = binlog.Update
+			if s.TableRefs != nil {
+				s.TableRefs.Accept(collector)
+			}
+		case *ast.DeleteStmt:
+			changeType = binlog.Delete
+			if s.IsMultiTable && s.Tables != nil {
+				s.Tables.Accept(collector)
+			} else if s.TableRefs != nil {
+				s.TableRefs.Accept(collector)
+			}
+		}
+		for _, name := range collector.names {
+			tables = append(tables, tableKey(defaultDB, name))
+		}
+	}
+	return tables, changeType
+}
+
+// scanTableWrites 扫描单个 binlog 文件, 每个文件使用独立的解析器, 表映射只在文件内有效
+func scanTableWrites(binlogDir, fileName string, matcher *tableMatcher, options *model.DaemonOptions) *fileWriteStat {
+	result := &fileWriteStat{name: fileName, tables: make(map[string]*TableWriteStat)}
+	stat := func(dbTable string) *TableWriteStat {
+		s, ok := result.tables[dbTable]
+		if !ok {
+			s = &TableWriteStat{Table: dbTable}
+			result.tables[dbTable] = s
+		}
+		s.LastFile = fileName
+		return s
+	}
+
+	ddlParser := parser.New()
+	binlogParser := replication.NewBinlogParser()
+	binlogParser.SetVerifyChecksum(true)
+	result.err = binlogParser.ParseFile(filepath.Join(binlogDir, fileName), 0, func(ev *replication.BinlogEvent) error {
+		if ev.Header.Timestamp == 0 {
+			return nil
+		}
+		eventTime := time.Unix(int64(ev.Header.Timestamp), 0)
+		if !inTimeRange(options, eventTime) {
+			return nil
+		}
+		if result.startTime.IsZero() {
+			result.startTime = eventTime
+		}
+		result.endTime = eventTime
+
+		switch e := ev.Event.(type) {
+		case *replication.RowsEvent:
+			dbTable := strings.ToLower(string(e.Table.Schema) + "." + string(e.Table.Table))
+			if !matcher.Match(dbTable) {
+				return nil
+			}
+			s := stat(dbTable)
+			switch ev.Header.EventType {
+			case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+				s.Inserts += int64(len(e.Rows))
+				s.LastInsert = eventTime
+			case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+				// 更新事件每行有前后两个镜像
+				s.Updates += int64(len(e.Rows) / 2)
+				s.LastUpdate = eventTime
+			case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+				s.Deletes += int64(len(e.Rows))
+				s.LastDelete = eventTime
+			}
+
+		case *replication.QueryEvent:
+			query := string(e.Query)
+			if !binlog.IsDDL(query) {
+				// 语句格式的 DML 同样是写入, 否则只用语句写入的表会被误判为没有写入
+				tables, changeType := dmlTables(ddlParser, string(e.Schema), query)
+				for _, dbTable := range tables {
+					if !matcher.Match(dbTable) {
+						continue
+					}
+					s := stat(dbTable)
+					s.Statements++
+					switch changeType {
+					case binlog.Insert:
+						s.LastInsert = eventTime
+					case binlog.Update:
+						s.LastUpdate = eventTime
+					case binlog.Delete:
+						s.LastDelete = eventTime
+					}
+				}
+				return nil
+			}
+			for _, dbTable := range ddlTables(ddlParser, string(e.Schema), query) {
+				if !matcher.Match(dbTable) {
+					continue
+				}
+				s := stat(dbTable)
+				s.LastDDL = eventTime
+				s.LastDDLSQL = query
+			}
+		}
+		return nil
+	})
+	return result
+}
+
+// listMatchedTables 从 information_schema 获取匹配的表, 没有写入的表也要出现在报告中
+func listMatchedTables(db *sql.DB, matcher *tableMatcher) ([]string, error) {
+	if db == nil {
+		return nil, nil
+	}
+	rows, err := db.Query("SELECT TABLE_SCHEMA, TABLE_NAME FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_TYPE = 'BASE TABLE' " +
+		"AND TABLE_SCHEMA NOT IN ('mysql','information_schema','performance_schema','sys')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return nil, err
+		}
+		dbTable := strings.ToLower(schema + "." + table)
+		if matcher.Match(dbTable) {
+			tables = append(tables, dbTable)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// GetDecommissionReport 扫描保留的 binlog 文件, 输出每个表最后一次写入/DDL 的时间和写入行数, 用于表下线检查
+func GetDecommissionReport(db *sql.DB, options *model.DaemonOptions, out *outputWriter) error {
+	reportFormat := options.BinlogSql.ReportFormat
+	if reportFormat == "" {
+		reportFormat = ReportFormatCSV
+	}
+	if reportFormat != ReportFormatCSV && reportFormat != ReportFormatJSON {
+		return fmt.Errorf("unsupported report format: %s", reportFormat)
+	}
+
+	binlogDir := options.BinlogSql.BinlogDir
+	var err error
+	if binlogDir == "" {
+		binlogDir, err = getBinlogDirectory(db)
+		if err != nil {
+			fmt.Printf("please give the binglog directory by --binlogDir\n")
+			return err
+		}
+	}
+	binlogFiles, err := getBinlogFiles(db, options.BinlogSql.BinlogDir)
+	if err != nil {
+		return err
+	}
+	binlogFiles = selectBinlogFiles(binlogFiles, options.BinlogSql.StartFile, options.BinlogSql.StopFile)
+
+	matcher := newTableMatcher(options)
+	report := &DecommissionReport{Files: binlogFiles}
+	merged := make(map[string]*TableWriteStat)
+	scan := func(fileName string) *fileWriteStat {
+		return scanTableWrites(binlogDir, fileName, matcher, options)
+	}
+	_ = parallelFiles(binlogFiles, options.BinlogSql.Workers, scan, func(_ string, result *fileWriteStat) error {
+		if result.err != nil {
+			// 单个文件损坏时仍然输出其余文件的统计, 已读到的事件保留
+			log.Error().Err(result.err).Msgf("scan binlog file %s failed", result.name)
+		}
+		if !result.startTime.IsZero() && (report.WindowStart.IsZero() || result.startTime.Before(report.WindowStart)) {
+			report.WindowStart = result.startTime
+		}
+		if result.endTime.After(report.WindowEnd) {
+			report.WindowEnd = result.endTime
+		}
+		for dbTable, s := range result.tables {
+			if m, ok := merged[dbTable]; ok {
+				m.merge(s)
+			} else {
+				merged[dbTable] = s
+			}
+		}
+		return nil
+	})
+
+	tables, err := listMatchedTables(db, matcher)
+	if err != nil {
+		log.Warn().Err(err).Msg("list tables from information_schema failed, only tables found in binlog are reported")
+	}
+	for _, dbTable := range append(tables, matcher.exactTables()...) {
+		if _, ok := merged[dbTable]; !ok {
+			merged[dbTable] = &TableWriteStat{Table: dbTable}
+		}
+	}
+	for _, s := range merged {
+		s.ZeroWrite = s.writes() == 0
+		report.Tables = append(report.Tables, s)
+	}
+	// 没有写入的表排在前面, 其余按最后写入时间排序
+	sort.Slice(report.Tables, func(i, j int) bool {
+		a, b := report.Tables[i], report.Tables[j]
+		if a.ZeroWrite != b.ZeroWrite {
+			return a.ZeroWrite
+		}
+		if la, lb := a.lastWrite(), b.lastWrite(); !la.Equal(lb) {
+			return la.Before(lb)
+		}
+		return a.Table < b.Table
+	})
+
+	var content string
+	if reportFormat == ReportFormatJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		content = string(data) + "\n"
+	} else {
+		content, err = report.csv()
+		if err != nil {
+			return err
+		}
+	}
+	return out.WriteString(content)
+}
+
+func (s *TableWriteStat) lastWrite() time.Time {
+	last := s.LastInsert
+	for _, t := range []time.Time{s.LastUpdate, s.LastDelete} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+func formatReportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(reportTimeLayout)
+}
+
+// MarshalJSON 时间按报告格式输出, 没有写入时为空字符串
+func (s *TableWriteStat) MarshalJSON() ([]byte, error) {
+	type alias TableWriteStat
+	return json.Marshal(&struct {
+		*alias
+		LastInsert string `json:"last_insert"`
+		LastUpdate string `json:"last_update"`
+		LastDelete string `json:"last_delete"`
+		LastDDL    string `json:"last_ddl"`
+	}{
+		alias:      (*alias)(s),
+		LastInsert: formatReportTime(s.LastInsert),
+		LastUpdate: formatReportTime(s.LastUpdate),
+		LastDelete: formatReportTime(s.LastDelete),
+		LastDDL:    formatReportTime(s.LastDDL),
+	})
+}
+
+func (r *DecommissionReport) csv() (string, error) {
+	formatTime := formatReportTime
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	records := [][]string{{"table", "last_insert", "last_update", "last_delete", "last_ddl", "last_ddl_sql", "last_file", "inserts", "updates", "deletes", "statements", "zero_write"}}
+	for _, s := range r.Tables {
+		records = append(records, []string{
+			s.Table, formatTime(s.LastInsert), formatTime(s.LastUpdate), formatTime(s.LastDelete),
+			formatTime(s.LastDDL), s.LastDDLSQL, s.LastFile,
+			strconv.FormatInt(s.Inserts, 10), strconv.FormatInt(s.Updates, 10), strconv.FormatInt(s.Deletes, 10),
+			strconv.FormatInt(s.Statements, 10), strconv.FormatBool(s.ZeroWrite),
+		})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,168 @@
+package binlogsql
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/v2/model"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// MySQL 5.7 FORMAT_DESCRIPTION_EVENT 中各事件类型的 post header 长度
+var testPostHeaderLengths = []byte{56, 13, 0, 8, 0, 18, 0, 4, 4, 4, 4, 18, 0, 0, 95, 0, 4, 26, 8, 0, 0, 0, 8, 8, 8, 2, 0, 0, 0, 10, 10, 10, 42, 42, 0, 18, 52, 0}
+
+// testBinlogWriter 生成不带校验和的 binlog 文件, 表只有一个 INT 字段
+type testBinlogWriter struct {
+	data []byte
+}
+
+func newTestBinlogWriter(timestamp uint32) *testBinlogWriter {
+	w := &testBinlogWriter{data: append([]byte(nil), binlogMagic...)}
+	body := binary.LittleEndian.AppendUint16(nil, 4)
+	version := make([]byte, 50)
+	copy(version, "5.7.44-log")
+	body = append(body, version...)
+	body = binary.LittleEndian.AppendUint32(body, timestamp)
+	body = append(body, replication.EventHeaderSize)
+	body = append(body, testPostHeaderLengths...)
+	// 校验算法 OFF, 后面 4 字节是 FDE 的校验和位置
+	body = append(body, byte(replication.BINLOG_CHECKSUM_ALG_OFF), 0, 0, 0, 0)
+	w.event(replication.FORMAT_DESCRIPTION_EVENT, timestamp, body)
+	return w
+}
+
+func (w *testBinlogWriter) event(eventType replication.EventType, timestamp uint32, body []byte) {
+	size := replication.EventHeaderSize + len(body)
+	header := binary.LittleEndian.AppendUint32(nil, timestamp)
+	header = append(header, byte(eventType))
+	header = binary.LittleEndian.AppendUint32(header, 1)
+	header = binary.LittleEndian.AppendUint32(header, uint32(size))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(w.data)+size))
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	w.data = append(append(w.data, header...), body...)
+}
+
+func (w *testBinlogWriter) query(timestamp uint32, schema, query string) {
+	body := binary.LittleEndian.AppendUint32(nil, 1)
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = append(body, byte(len(schema)))
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = append(append(body, schema...), 0)
+	w.event(replication.QUERY_EVENT, timestamp, append(body, query...))
+}
+
+func (w *testBinlogWriter) tableMap(timestamp uint32, tableID uint64, schema, table string) {
+	body := binary.LittleEndian.AppendUint64(nil, tableID)[:6]
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = append(body, byte(len(schema)))
+	body = append(append(body, schema...), 0)
+	body = append(body, byte(len(table)))
+	body = append(append(body, table...), 0)
+	// 1 个字段, 类型 LONG, 没有元数据, NULL 位图
+	body = append(body, 1, mysql.MYSQL_TYPE_LONG, 0, 0)
+	w.event(replication.TABLE_MAP_EVENT, timestamp, body)
+}
+
+func (w *testBinlogWriter) rows(eventType replication.EventType, timestamp uint32, tableID uint64, values ...int32) {
+	body := binary.LittleEndian.AppendUint64(nil, tableID)[:6]
+	body = binary.LittleEndian.AppendUint16(body, replication.RowsEventStmtEndFlag)
+	body = binary.LittleEndian.AppendUint16(body, 2)
+	body = append(body, 1, 0x01)
+	if eventType == replication.UPDATE_ROWS_EVENTv2 {
+		body = append(body, 0x01)
+	}
+	for _, v := range values {
+		body = append(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, uint32(v))
+	}
+	w.event(eventType, timestamp, body)
+}
+
+func (w *testBinlogWriter) xid(timestamp uint32) {
+	w.event(replication.XID_EVENT, timestamp, binary.LittleEndian.AppendUint64(nil, 1))
+}
+
+func (w *testBinlogWriter) write(t *testing.T, dir, fileName string) {
+	if err := os.WriteFile(filepath.Join(dir, fileName), w.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanTableWrites(t *testing.T) {
+	base := uint32(time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local).Unix())
+	w := newTestBinlogWriter(base)
+	// 行格式: t1 插入两行, 更新一行
+	w.query(base+10, "db", "BEGIN")
+	w.tableMap(base+10, 100, "db", "t1")
+	w.rows(replication.WRITE_ROWS_EVENTv2, base+10, 100, 1, 2)
+	w.tableMap(base+20, 100, "db", "t1")
+	w.rows(replication.UPDATE_ROWS_EVENTv2, base+20, 100, 1, 3)
+	w.xid(base + 20)
+	// 语句格式: 默认库的 t2 和指定库的 t3
+	w.query(base+30, "db", "BEGIN")
+	w.query(base+30, "db", "UPDATE t2 SET id = id + 1")
+	w.query(base+40, "db", "INSERT INTO `other`.`t3` VALUES (1)")
+	w.query(base+40, "db", "COMMIT")
+	w.query(base+50, "db", "ALTER TABLE t1 ADD COLUMN c INT")
+	// 不匹配的表不统计
+	w.query(base+60, "db", "DELETE FROM skip_t4")
+
+	dir := t.TempDir()
+	w.write(t, dir, "mysql-bin.000001")
+	options := &model.DaemonOptions{BinlogSql: &model.BinlogSql{Tables: "db.t*,other.t3"}}
+	result := scanTableWrites(dir, "mysql-bin.000001", newTableMatcher(options), options)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	at := func(offset uint32) time.Time { return time.Unix(int64(base+offset), 0) }
+	tests := []struct {
+		table                           string
+		inserts, updates, statements    int64
+		lastInsert, lastUpdate, lastDDL time.Time
+	}{
+		{table: "db.t1", inserts: 2, updates: 1, lastInsert: at(10), lastUpdate: at(20), lastDDL: at(50)},
+		{table: "db.t2", statements: 1, lastUpdate: at(30)},
+		{table: "other.t3", statements: 1, lastInsert: at(40)},
+	}
+	if len(result.tables) != len(tests) {
+		t.Errorf("tables %v, expect %d tables", result.tables, len(tests))
+	}
+	for _, tt := range tests {
+		s, ok := result.tables[tt.table]
+		if !ok {
+			t.Errorf("%s not found", tt.table)
+			continue
+		}
+		if s.Inserts != tt.inserts || s.Updates != tt.updates || s.Statements != tt.statements {
+			t.Errorf("%s counts inserts=%d updates=%d statements=%d, expect %d %d %d", tt.table, s.Inserts, s.Updates, s.Statements, tt.inserts, tt.updates, tt.statements)
+		}
+		if !s.LastInsert.Equal(tt.lastInsert) || !s.LastUpdate.Equal(tt.lastUpdate) || !s.LastDDL.Equal(tt.lastDDL) {
+			t.Errorf("%s last insert %s update %s ddl %s", tt.table, s.LastInsert, s.LastUpdate, s.LastDDL)
+		}
+		if s.writes() == 0 {
+			t.Errorf("%s has no writes", tt.table)
+		}
+	}
+	if !result.startTime.Equal(at(0)) || !result.endTime.Equal(at(60)) {
+		t.Errorf("scan window %s - %s", result.startTime, result.endTime)
+	}
+}
+
+// 合并时最后的文件按序号比较
+func TestTableWriteStatMerge(t *testing.T) {
+	now := time.Now()
+	s := &TableWriteStat{Table: "db.t", Inserts: 1, LastInsert: now, LastFile: "mysql-bin.1000000"}
+	s.merge(&TableWriteStat{Table: "db.t", Statements: 2, LastInsert: now.Add(-time.Hour), LastUpdate: now, LastFile: "mysql-bin.999999"})
+	if s.LastFile != "mysql-bin.1000000" {
+		t.Errorf("last file is %s", s.LastFile)
+	}
+	if s.writes() != 3 || !s.LastInsert.Equal(now) || !s.LastUpdate.Equal(now) {
+		t.Errorf("merged stat %+v", s)
+	}
+}
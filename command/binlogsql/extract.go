@@ -0,0 +1,481 @@
+package binlogsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+// binlog 文件头的 magic number
+var binlogMagic = []byte{0xfe, 'b', 'i', 'n'}
+
+const (
+	logEventBinlogInUseFlag = 0x01 // FDE header flags: binlog 文件未正常关闭
+	rotateEventType         = byte(replication.ROTATE_EVENT)
+)
+
+// extractItem 是当前事务中缓存的一个原始事件
+type extractItem struct {
+	raw      []byte
+	rows     *replication.RowsEvent // 行事件
+	tableID  uint64                 // TABLE_MAP_EVENT 的表 id
+	isMap    bool
+	isQuery  bool // 只有选中时才写出的语句(DDL, DML, XA COMMIT/ROLLBACK)
+	isVar    bool // INTVAR/RAND/USER_VAR 事件, 跟随后面的语句是否选中
+	selected bool
+}
+
+// binlogExtractor 把选中的事件写到新的 binlog 文件中, 每个源 binlog 文件对应一个同名输出文件.
+// 事件的位点和校验和会按新文件重写, 事务只有包含被选中的行事件或 DDL 时才写出, 且保持 GTID/BEGIN/XID 边界完整
+type binlogExtractor struct {
+	options *model.DaemonOptions
+	state   *parseState
+	dir     string
+
+	file     *os.File
+	fileName string
+	pos      uint32
+
+	startTime time.Time // --startTime, 开始时间早于它的事务不写出
+
+	fde      *replication.FormatDescriptionEvent
+	fdeRaw   []byte
+	serverID uint32
+	checksum bool
+
+	trx         []extractItem
+	trxSelected bool
+	inTrx       bool            // 在 BEGIN/XA START 之后, 语句不会结束事务
+	trxGTID     string          // 当前事务的 GTID, 用于 --stopGtid
+	written     int             // 写出的事务数
+	xaSelected  map[string]bool // 已写出的 XA PREPARE 分支, 对应的 XA COMMIT/ROLLBACK 也要写出
+}
+
+func newBinlogExtractor(options *model.DaemonOptions, state *parseState) (*binlogExtractor, error) {
+	dir := options.BinlogSql.OutputDir
+	if dir == "" {
+		return nil, fmt.Errorf("mode extract must give the output directory by --outputDir")
+	}
+	if options.BinlogSql.BinlogDir != "" {
+		src, _ := filepath.Abs(options.BinlogSql.BinlogDir)
+		dst, _ := filepath.Abs(dir)
+		if src == dst {
+			return nil, fmt.Errorf("output directory can not be the binlog directory: %s", dir)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create output directory %s failed: %v", dir, err)
+	}
+	x := &binlogExtractor{options: options, state: state, dir: dir, xaSelected: make(map[string]bool)}
+	if options.BinlogSql.StartTime != "" {
+		x.startTime = parseTime(options.BinlogSql.StartTime)
+	}
+	return x, nil
+}
+
+// HandleEvent 处理一个 binlog 事件, fileName 是事件所在的源 binlog 文件名
+func (x *binlogExtractor) HandleEvent(ev *replication.BinlogEvent, fileName string) error {
+	switch e := ev.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		if fileName == x.fileName {
+			return nil
+		}
+		// 旧文件按旧的校验设置写 Rotate 后关闭
+		if err := x.rotateTo(fileName); err != nil {
+			return err
+		}
+		x.fde = e
+		x.fdeRaw = append([]byte(nil), ev.RawData...)
+		x.serverID = ev.Header.ServerID
+		x.checksum = e.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32
+		return x.openFile(fileName)
+
+	case *replication.PreviousGTIDsEvent:
+		// 紧跟在 FDE 后面, 原样保留
+		if x.file != nil && x.pos == uint32(len(binlogMagic))+uint32(len(x.fdeRaw)) {
+			return x.writeEvent(ev.RawData)
+		}
+		return nil
+
+	case *replication.RotateEvent:
+		// 输出文件的 Rotate 事件在切换文件时重新生成
+		return nil
+
+	case *replication.GTIDEvent:
+		x.state.trackGTID(e)
+		x.resetTrx()
+		x.trx = append(x.trx, extractItem{raw: ev.RawData})
+		return nil
+
+	case *replication.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+		switch {
+		case query == "BEGIN":
+			x.trx = append(x.trx, extractItem{raw: ev.RawData})
+			x.inTrx = true
+			return nil
+		case query == "COMMIT" || query == "ROLLBACK":
+			x.trx = append(x.trx, extractItem{raw: ev.RawData})
+			return x.finishTrx()
+		}
+		switch op, xid := parseXAQuery(query); op {
+		case XAStart, XAEnd:
+			x.trx = append(x.trx, extractItem{raw: ev.RawData})
+			x.inTrx = true
+			return nil
+		case XACommit, XARollback:
+			// 单独的事务, 只有对应的 PREPARE 分支写出时才写出
+			selected := x.xaSelected[xid]
+			delete(x.xaSelected, xid)
+			x.appendQuery(ev.RawData, selected)
+			return x.finishTrx()
+		}
+		if binlog.IsDDL(query) {
+			// DDL 隐式提交, 自成一个事务
+			x.appendQuery(ev.RawData, eventSelected(x.options, ev, x.state))
+			return x.finishTrx()
+		}
+		if _, _, ok := binlog.ParseDML(query); ok {
+			// 语句格式的 DML 按表过滤
+			x.appendQuery(ev.RawData, eventSelected(x.options, ev, x.state))
+		} else {
+			// SAVEPOINT 等语句随所在事务一起写出
+			x.trx = append(x.trx, extractItem{raw: ev.RawData})
+		}
+		if x.inTrx {
+			return nil
+		}
+		// 不在 BEGIN 之后的语句自成一个事务
+		return x.finishTrx()
+
+	case *replication.TableMapEvent:
+		x.trx = append(x.trx, extractItem{raw: ev.RawData, isMap: true, tableID: e.TableID})
+		return nil
+
+	case *replication.RowsEvent:
+		selected := eventSelected(x.options, ev, x.state)
+		x.trx = append(x.trx, extractItem{raw: ev.RawData, rows: e, tableID: e.TableID, selected: selected})
+		x.trxSelected = x.trxSelected || selected
+		return nil
+
+	case *replication.XIDEvent:
+		x.trx = append(x.trx, extractItem{raw: ev.RawData})
+		return x.finishTrx()
+	}
+
+	// XA_PREPARE 结束 XA 分支
+	if xid, onePhase, ok := xaPrepare(ev); ok {
+		x.trx = append(x.trx, extractItem{raw: ev.RawData})
+		if x.trxSelected && !onePhase && !x.trxBeforeStart() {
+			x.xaSelected[xid] = true
+		}
+		return x.finishTrx()
+	}
+
+	switch ev.Header.EventType {
+	case replication.INTVAR_EVENT, replication.RAND_EVENT, replication.USER_VAR_EVENT:
+		// 语句格式下后一条语句用到的 LAST_INSERT_ID, RAND 种子和用户变量
+		x.trx = append(x.trx, extractItem{raw: ev.RawData, isQuery: true, isVar: true})
+		return nil
+	}
+
+	// 其他事件(心跳, ROWS_QUERY 等)不写入
+	return nil
+}
+
+// appendQuery 缓存只有选中时才写出的语句, 紧挨在前面的 INTVAR/RAND/USER_VAR 事件跟随该语句
+func (x *binlogExtractor) appendQuery(raw []byte, selected bool) {
+	for i := len(x.trx) - 1; i >= 0 && x.trx[i].isVar; i-- {
+		x.trx[i].selected = selected
+	}
+	x.trx = append(x.trx, extractItem{raw: raw, isQuery: true, selected: selected})
+	x.trxSelected = x.trxSelected || selected
+}
+
+// trxBeforeStart 判断当前事务是否在 --startTime 之前开始, 事务按第一个事件(GTID/BEGIN)的时间整体取舍
+func (x *binlogExtractor) trxBeforeStart() bool {
+	if x.startTime.IsZero() || len(x.trx) == 0 {
+		return false
+	}
+	timestamp := binary.LittleEndian.Uint32(x.trx[0].raw)
+	return time.Unix(int64(timestamp), 0).Before(x.startTime)
+}
+
+func (x *binlogExtractor) resetTrx() {
+	x.trx = x.trx[:0]
+	x.trxSelected = false
+	x.inTrx = false
+}
+
+// finishTrx 事务结束时, 如果有选中的事件则写出 GTID/BEGIN, 选中表的 TABLE_MAP, 选中的行事件和结束事件
+func (x *binlogExtractor) finishTrx() error {
+	defer x.resetTrx()
+	if !x.trxSelected || x.trxBeforeStart() {
+		return nil
+	}
+	if x.file == nil {
+		return fmt.Errorf("no format description event before transaction")
+	}
+
+	selectedTables := make(map[uint64]bool)
+	for _, item := range x.trx {
+		if item.rows != nil && item.selected {
+			selectedTables[item.tableID] = true
+		}
+	}
+
+	// 丢弃的行事件如果带有语句结束标志, 需要把标志转移到前一个保留的行事件上, 否则 TABLE_MAP 不会被释放
+	var kept [][]byte
+	lastKeptRows := -1
+	for _, item := range x.trx {
+		switch {
+		case item.isMap:
+			if selectedTables[item.tableID] {
+				kept = append(kept, item.raw)
+			}
+		case item.rows != nil:
+			if item.selected {
+				kept = append(kept, item.raw)
+				if item.rows.Flags&replication.RowsEventStmtEndFlag > 0 {
+					lastKeptRows = -1
+				} else {
+					lastKeptRows = len(kept) - 1
+				}
+			} else if item.rows.Flags&replication.RowsEventStmtEndFlag > 0 && lastKeptRows >= 0 {
+				kept[lastKeptRows] = x.setStmtEndFlag(kept[lastKeptRows])
+				lastKeptRows = -1
+			}
+		default:
+			// GTID, BEGIN, SAVEPOINT, XID/COMMIT 以及选中的语句
+			if !item.isQuery || item.selected {
+				kept = append(kept, item.raw)
+			}
+		}
+	}
+	if lastKeptRows >= 0 {
+		kept[lastKeptRows] = x.setStmtEndFlag(kept[lastKeptRows])
+	}
+
+	for _, raw := range kept {
+		if err := x.writeEvent(raw); err != nil {
+			return err
+		}
+	}
+	x.written++
+	return nil
+}
+
+// setStmtEndFlag 设置行事件 post header 中的 STMT_END_F 标志
+func (x *binlogExtractor) setStmtEndFlag(raw []byte) []byte {
+	out := append([]byte(nil), raw...)
+	tableIDSize := 6
+	if x.fde != nil && int(out[4])-1 < len(x.fde.EventTypeHeaderLengths) && x.fde.EventTypeHeaderLengths[out[4]-1] == 6 {
+		tableIDSize = 4
+	}
+	offset := replication.EventHeaderSize + tableIDSize
+	flags := binary.LittleEndian.Uint16(out[offset:])
+	binary.LittleEndian.PutUint16(out[offset:], flags|replication.RowsEventStmtEndFlag)
+	return out
+}
+
+// rotateTo 以指向下一个文件的 Rotate 事件结束当前输出文件
+func (x *binlogExtractor) rotateTo(nextFile string) error {
+	if x.file == nil {
+		return nil
+	}
+	if err := x.writeEvent(x.rotateEvent(nextFile)); err != nil {
+		return err
+	}
+	return x.closeFile()
+}
+
+// openFile 创建新的输出文件并写入文件头和 FDE, 不会覆盖已存在的文件
+func (x *binlogExtractor) openFile(fileName string) error {
+	path := filepath.Join(x.dir, fileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create binlog file %s failed: %v", path, err)
+	}
+	x.file = file
+	x.fileName = fileName
+	x.pos = 0
+	if _, err := file.Write(binlogMagic); err != nil {
+		return err
+	}
+	x.pos = uint32(len(binlogMagic))
+
+	// 新文件是完整写出的, 去掉 FDE 中的 in use 标志
+	fde := append([]byte(nil), x.fdeRaw...)
+	flags := binary.LittleEndian.Uint16(fde[17:])
+	binary.LittleEndian.PutUint16(fde[17:], flags&^logEventBinlogInUseFlag)
+	log.Info().Msgf("extract binlog events to %s", path)
+	return x.writeEvent(fde)
+}
+
+// rotateEvent 生成指向 nextFile 的 ROTATE_EVENT
+func (x *binlogExtractor) rotateEvent(nextFile string) []byte {
+	size := replication.EventHeaderSize + 8 + len(nextFile)
+	if x.checksum {
+		size += replication.BinlogChecksumLength
+	}
+	raw := make([]byte, size)
+	raw[4] = rotateEventType
+	binary.LittleEndian.PutUint32(raw[5:], x.serverID)
+	binary.LittleEndian.PutUint32(raw[9:], uint32(size))
+	binary.LittleEndian.PutUint64(raw[replication.EventHeaderSize:], 4)
+	copy(raw[replication.EventHeaderSize+8:], nextFile)
+	return raw
+}
+
+// writeEvent 按新文件重写事件的 log_pos 和校验和后写入
+func (x *binlogExtractor) writeEvent(raw []byte) error {
+	out := append([]byte(nil), raw...)
+	binary.LittleEndian.PutUint32(out[13:], x.pos+uint32(len(out)))
+	if x.checksum {
+		n := len(out) - replication.BinlogChecksumLength
+		binary.LittleEndian.PutUint32(out[n:], crc32.ChecksumIEEE(out[:n]))
+	}
+	if _, err := x.file.Write(out); err != nil {
+		return fmt.Errorf("write binlog file %s failed: %v", x.fileName, err)
+	}
+	x.pos += uint32(len(out))
+	return nil
+}
+
+func (x *binlogExtractor) closeFile() error {
+	if x.file == nil {
+		return nil
+	}
+	err := x.file.Close()
+	x.file = nil
+	return err
+}
+
+// Close 关闭最后一个输出文件, 未结束的事务不会写出
+func (x *binlogExtractor) Close() error {
+	if len(x.trx) > 0 {
+		log.Warn().Msgf("unterminated transaction with %d events is not extracted", len(x.trx))
+	}
+	log.Info().Msgf("extract %d transactions to %s", x.written, x.dir)
+	return x.closeFile()
+}
+
+// extractEvent 处理一个事件并检查 --stopFile/--stopPose, --stopTime, --stopGtid 以及主库位置的结束条件, 返回 true 表示已经结束
+func (x *binlogExtractor) extractEvent(rng *streamRange, ev *replication.BinlogEvent, fileName string) (bool, error) {
+	if rng.Before(ev, fileName) {
+		log.Info().Msgf("reach the stop position or time at %s:%d, stop extracting.", fileName, ev.Header.LogPos)
+		return true, nil
+	}
+	if e, ok := ev.Event.(*replication.GTIDEvent); ok {
+		if next, err := e.GTIDNext(); err == nil {
+			x.trxGTID = next.String()
+		}
+	}
+	if err := x.HandleEvent(ev, fileName); err != nil {
+		return true, err
+	}
+	committedGTID := ""
+	if isTrxEnd(ev) {
+		committedGTID, x.trxGTID = x.trxGTID, ""
+	}
+	if rng.After(ev, fileName, committedGTID) {
+		log.Info().Msgf("reach the stop gtid or master position at %s:%d, stop extracting.", fileName, ev.Header.LogPos)
+		return true, nil
+	}
+	return false, nil
+}
+
+// ExtractBinlog 从本地 binlog 文件(指定 --binlogDir 时)或者从 MySQL 实时拉取事件, 把选中的事件写到新的 binlog 文件
+func ExtractBinlog(ctx context.Context, db *sql.DB, cfg replication.BinlogSyncerConfig, position mysql.Position, options *model.DaemonOptions, state *parseState) error {
+	extractor, err := newBinlogExtractor(options, state)
+	if err != nil {
+		return err
+	}
+	defer extractor.Close()
+
+	if options.BinlogSql.BinlogDir != "" {
+		rng, err := newStopRange(options)
+		if err != nil {
+			return err
+		}
+		binlogFiles, err := getBinlogFiles(db, options.BinlogSql.BinlogDir)
+		if err != nil {
+			return err
+		}
+		stopExtract := fmt.Errorf("stop extract")
+		parser := replication.NewBinlogParser()
+		parser.SetVerifyChecksum(true)
+		// position 是 --startFile/--startPose 或者由 --startTime 找到的位置, 第一个文件从该位置开始读取
+		for _, binlogFile := range selectBinlogFiles(binlogFiles, position.Name, options.BinlogSql.StopFile) {
+			offset := int64(0)
+			if binlogFile == position.Name {
+				offset = int64(position.Pos)
+			}
+			done := false
+			err := parser.ParseFile(filepath.Join(options.BinlogSql.BinlogDir, binlogFile), offset, func(ev *replication.BinlogEvent) error {
+				stop, err := extractor.extractEvent(rng, ev, binlogFile)
+				if stop && err == nil {
+					done = true
+					return stopExtract
+				}
+				return err
+			})
+			if done {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("extract binlog file %s failed: %v", binlogFile, err)
+			}
+		}
+		return nil
+	}
+
+	// 未开启 --stopNever 时读到启动时的主库位置结束
+	rng, err := newStreamRange(db, options)
+	if err != nil {
+		return err
+	}
+	if rng.Done(position) {
+		log.Info().Msgf("start position %s:%d is already the current master position", position.Name, position.Pos)
+		return nil
+	}
+	reader, err := binlog.NewServerReader(cfg, position, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	lastEvent := time.Now()
+	for {
+		ev, fileName, err := rng.nextEvent(ctx, reader, lastEvent)
+		if err != nil {
+			if errors.Is(err, errIdleStop) {
+				log.Info().Msgf("no binlog event for %s, stop extracting.", idleStopTimeout)
+				return nil
+			}
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+		if ev.Header.EventType == replication.HEARTBEAT_EVENT || ev.Header.EventType == replication.HEARTBEAT_LOG_EVENT_V2 {
+			continue
+		}
+		lastEvent = time.Now()
+		if stop, err := extractor.extractEvent(rng, ev, fileName); stop || err != nil {
+			return err
+		}
+	}
+}
@@ -49,7 +49,7 @@ func BinlogActionFlag(options *model.DaemonOptions) []cli.Flag {
 		cli.StringFlag{
 			Name:        "mode",
 			Value:       "general",
-			Usage:       "sql mode: flashback(restore sql); general(get binlog sql); stat(get binlog file statistics of write info)",
+			Usage:       "sql mode: flashback(restore sql); general(get binlog sql); stat(get binlog file statistics of write info); extract(write selected events to new binlog files in --outputDir); verify(check binlog files integrity, output json report); decommission(last write time of tables in retained binlogs, for table decommission check); capacity(binlog growth rate, per-table share and projected disk usage for --retention)",
 			Destination: &options.BinlogSql.Mode,
 		},
 		cli.IntFlag{
@@ -92,31 +92,78 @@ func BinlogActionFlag(options *model.DaemonOptions) []cli.Flag {
 		cli.StringFlag{
 			Name:        "startTime",
 			Value:       "",
-			Usage:       "binlog start start time",
+			Usage:       "binlog start time, e.g. 2024-01-02 15:04:05; without --startFile the start file and position are found by binary search",
 			Destination: &options.BinlogSql.StartTime,
 		},
 		cli.StringFlag{
 			Name:        "stopTime",
 			Value:       "",
-			Usage:       "binlog start start time",
+			Usage:       "binlog stop time, stop reading at the first event after it",
 			Destination: &options.BinlogSql.StopTime,
 		},
+		cli.StringFlag{
+			Name:        "stopGtid",
+			Value:       "",
+			Usage:       "stop after the transaction of the gtid is committed, e.g. 3e11fa47-71ca-11e1-9e33-c80aa9429562:100",
+			Destination: &options.BinlogSql.StopGTID,
+		},
 		cli.StringFlag{
 			Name:        "output",
 			Value:       "",
-			Usage:       "sql output file",
+			Usage:       "sql output file, refuse to overwrite the existing file unless --force",
 			Destination: &options.BinlogSql.OutFile,
 		},
+		cli.StringFlag{
+			Name:        "outputCompress",
+			Value:       "none",
+			Usage:       "compress output file: none, gzip, zstd",
+			Destination: &options.BinlogSql.OutputCompress,
+		},
+		cli.StringFlag{
+			Name:        "outputSplit",
+			Value:       "",
+			Usage:       "split output file by size, e.g. 512M, 1G; or by binlog file: binlog",
+			Destination: &options.BinlogSql.OutputSplit,
+		},
+		cli.BoolFlag{
+			Name:        "force",
+			Usage:       "overwrite the output file if it exists",
+			Destination: &options.BinlogSql.Force,
+		},
 		cli.StringFlag{
 			Name:        "stopNever",
 			Value:       "false",
-			Usage:       "keep running when read all binlog files",
+			Usage:       "keep running when read all binlog files, otherwise stop at the current master position",
 			Destination: &options.BinlogSql.StopNever,
 		},
+		cli.IntFlag{
+			Name:        "heartbeat",
+			Value:       30,
+			Usage:       "master heartbeat period(second) to detect dead connection, 0 to disable",
+			Destination: &options.BinlogSql.Heartbeat,
+		},
+		cli.StringFlag{
+			Name:        "checkpoint",
+			Value:       "",
+			Usage:       "file to save the last processed position, a restarted process continues from it",
+			Destination: &options.BinlogSql.Checkpoint,
+		},
+		cli.StringFlag{
+			Name:        "resume",
+			Value:       "pos",
+			Usage:       "stopNever mode: reconnect from the last processed transaction by pos(file and position) or gtid",
+			Destination: &options.BinlogSql.ResumeBy,
+		},
+		cli.IntFlag{
+			Name:        "maxRetry",
+			Value:       0,
+			Usage:       "stopNever mode: max reconnect retries, 0 means unlimited",
+			Destination: &options.BinlogSql.MaxRetry,
+		},
 		cli.StringFlag{
 			Name:        "ddl",
 			Value:       "false",
-			Usage:       "including ddl sql",
+			Usage:       "including ddl sql, flashback mode outputs reverse ddl and warnings for non-reversible ddl",
 			Destination: &options.BinlogSql.DDL,
 		},
 		cli.StringFlag{
@@ -131,6 +178,72 @@ func BinlogActionFlag(options *model.DaemonOptions) []cli.Flag {
 			Usage:       "binlog file dir",
 			Destination: &options.BinlogSql.BinlogDir,
 		},
+		cli.StringFlag{
+			Name:        "format",
+			Value:       "sql",
+			Usage:       "output format: sql(generated sql); binlog-base64(BINLOG statements like mysqlbinlog, can be replayed by mysql client)",
+			Destination: &options.BinlogSql.Format,
+		},
+		cli.StringFlag{
+			Name:        "gtid",
+			Value:       "",
+			Usage:       "only parse transactions in the gtid set, e.g. 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100",
+			Destination: &options.BinlogSql.GTIDSet,
+		},
+		cli.StringFlag{
+			Name:        "outputDir",
+			Value:       "",
+			Usage:       "extract mode: directory of the new binlog files",
+			Destination: &options.BinlogSql.OutputDir,
+		},
+		cli.StringFlag{
+			Name:        "tables",
+			Value:       "",
+			Usage:       "decommission mode: tables to check separated by comma, support wildcard, e.g. db1.t1,db2.log_*; default use --db/--table",
+			Destination: &options.BinlogSql.Tables,
+		},
+		cli.StringFlag{
+			Name:        "reportFormat",
+			Value:       "",
+			Usage:       "report format, decommission mode: csv(default), json; capacity mode: table(default), json",
+			Destination: &options.BinlogSql.ReportFormat,
+		},
+		cli.StringFlag{
+			Name:        "retention",
+			Value:       "",
+			Usage:       "capacity mode: target binlog retention to project disk usage, e.g. 7d, 72h; default use binlog_expire_logs_seconds",
+			Destination: &options.BinlogSql.Retention,
+		},
+		cli.IntFlag{
+			Name:        "workers",
+			Value:       4,
+			Usage:       "number of binlog files parsed concurrently",
+			Destination: &options.BinlogSql.Workers,
+		},
+		cli.StringFlag{
+			Name:        "mask",
+			Value:       "",
+			Usage:       "mask columns in output, rules separated by comma: db.table.column:method[:keep_first[:keep_last]], method: redact, hash, keep, fake, column supports wildcard, e.g. db1.user.phone:keep:3:4,*.*.email:fake",
+			Destination: &options.BinlogSql.Mask,
+		},
+		cli.StringFlag{
+			Name:        "maskSalt",
+			Value:       "",
+			Usage:       "salt of mask method hash and fake",
+			Destination: &options.BinlogSql.MaskSalt,
+		},
+		cli.StringFlag{
+			Name:        "where",
+			Value:       "",
+			Usage:       "filter rows by condition, applied to each row of multi-row events, support comparison, IN, BETWEEN, LIKE, IS NULL, AND/OR/NOT, ENUM/SET columns are compared by member names, e.g. \"user_id=1001 and status in (3,4)\"",
+			Destination: &options.BinlogSql.Where,
+		},
+		cli.StringFlag{
+			Name:        "whereImage",
+			Value:       "any",
+			Usage:       "row image of update checked by --where: any(before or after), before, after",
+			Destination: &options.BinlogSql.WhereImage,
+		},
 	}
 }
 
@@ -0,0 +1,335 @@
+package binlogsql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/pingcap/tidb/pkg/parser/format"
+	_ "github.com/pingcap/tidb/pkg/parser/test_driver"
+)
+
+// trackedTable 记录从 binlog DDL 中看到的表结构, 字段和索引定义都是可直接拼接到 ALTER TABLE 的文本
+type trackedTable struct {
+	columns    map[string]string // 小写列名 -> 列定义
+	indexes    map[string]string // 小写索引名 -> 索引定义
+	primaryKey string
+}
+
+// schemaTracker 跟踪解析范围内 DDL 对表结构的修改, 用于 flashback 模式推导反向 DDL.
+// 只有在本次解析的 binlog 中出现过的定义才能被还原, 其余情况输出不可逆警告
+type schemaTracker struct {
+	parser *parser.Parser
+	tables map[string]*trackedTable // key: db.table
+}
+
+func newSchemaTracker() *schemaTracker {
+	return &schemaTracker{
+		parser: parser.New(),
+		tables: make(map[string]*trackedTable),
+	}
+}
+
+func (t *schemaTracker) table(dbTable string) *trackedTable {
+	tbl, ok := t.tables[dbTable]
+	if !ok {
+		tbl = &trackedTable{columns: make(map[string]string), indexes: make(map[string]string)}
+		t.tables[dbTable] = tbl
+	}
+	return tbl
+}
+
+func restoreNode(node ast.Node) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags|format.RestoreStringWithoutCharset, &sb)
+	if err := node.Restore(ctx); err != nil {
+		return ""
+	}
+	return sb.String()
+}
+
+func tableKey(defaultDB string, name *ast.TableName) string {
+	db := name.Schema.O
+	if db == "" {
+		db = defaultDB
+	}
+	return strings.ToLower(db + "." + name.Name.O)
+}
+
+func quoteTable(defaultDB string, name *ast.TableName) string {
+	db := name.Schema.O
+	if db == "" {
+		db = defaultDB
+	}
+	if db == "" {
+		return fmt.Sprintf("`%s`", name.Name.O)
+	}
+	return fmt.Sprintf("`%s`.`%s`", db, name.Name.O)
+}
+
+// constraintName 返回索引名, 未命名索引按 MySQL 规则使用第一个索引列的列名
+func constraintName(c *ast.Constraint) string {
+	if c.Tp == ast.ConstraintPrimaryKey {
+		return "PRIMARY"
+	}
+	if c.Name != "" {
+		return c.Name
+	}
+	if len(c.Keys) > 0 && c.Keys[0].Column != nil {
+		return c.Keys[0].Column.Name.O
+	}
+	return ""
+}
+
+func isIndexConstraint(c *ast.Constraint) bool {
+	switch c.Tp {
+	case ast.ConstraintKey, ast.ConstraintIndex, ast.ConstraintUniq, ast.ConstraintUniqKey,
+		ast.ConstraintUniqIndex, ast.ConstraintFulltext:
+		return true
+	}
+	return false
+}
+
+func (tbl *trackedTable) trackConstraint(c *ast.Constraint) {
+	def := restoreNode(c)
+	if c.Tp == ast.ConstraintPrimaryKey {
+		tbl.primaryKey = def
+	} else if isIndexConstraint(c) {
+		tbl.indexes[strings.ToLower(constraintName(c))] = def
+	}
+}
+
+// ReverseDDL 返回 query 的反向语句, 无法推导的部分以 "-- WARNING" 注释行返回.
+// 同时会把 query 对表结构的修改记录到 tracker 中
+func (t *schemaTracker) ReverseDDL(defaultDB, query, fileName string, pos uint32) []string {
+	stmts, _, err := t.parser.Parse(query, "", "")
+	if err != nil {
+		return []string{fmt.Sprintf("-- WARNING: %s:%d DDL can not be parsed, no reverse sql generated: %v", fileName, pos, err)}
+	}
+
+	var result []string
+	for _, stmt := range stmts {
+		result = append(result, t.reverseStmt(defaultDB, stmt, fileName, pos)...)
+	}
+	return result
+}
+
+func (t *schemaTracker) reverseStmt(defaultDB string, stmt ast.StmtNode, fileName string, pos uint32) []string {
+	lost := func(format string, args ...interface{}) string {
+		return fmt.Sprintf("-- WARNING: %s:%d ", fileName, pos) + fmt.Sprintf(format, args...)
+	}
+
+	switch s := stmt.(type) {
+	case *ast.CreateTableStmt:
+		key := tableKey(defaultDB, s.Table)
+		delete(t.tables, key)
+		tbl := t.table(key)
+		for _, col := range s.Cols {
+			tbl.columns[strings.ToLower(col.Name.Name.O)] = restoreNode(col)
+		}
+		for _, c := range s.Constraints {
+			tbl.trackConstraint(c)
+		}
+		result := []string{fmt.Sprintf("DROP TABLE %s;", quoteTable(defaultDB, s.Table))}
+		if s.IfNotExists {
+			result = append([]string{lost("CREATE TABLE IF NOT EXISTS %s may have been a no-op, check before dropping", quoteTable(defaultDB, s.Table))}, result...)
+		}
+		return result
+
+	case *ast.DropTableStmt:
+		var result []string
+		for _, name := range s.Tables {
+			delete(t.tables, tableKey(defaultDB, name))
+			result = append(result, lost("DROP TABLE %s is not reversible, all data of the table was lost here, restore it from backup", quoteTable(defaultDB, name)))
+		}
+		return result
+
+	case *ast.TruncateTableStmt:
+		return []string{lost("TRUNCATE TABLE %s is not reversible, all rows of the table were deleted here without row events, restore them from backup", quoteTable(defaultDB, s.Table))}
+
+	case *ast.RenameTableStmt:
+		var pairs []string
+		for i := len(s.TableToTables) - 1; i >= 0; i-- {
+			tt := s.TableToTables[i]
+			oldKey, newKey := tableKey(defaultDB, tt.OldTable), tableKey(defaultDB, tt.NewTable)
+			if tbl, ok := t.tables[oldKey]; ok {
+				t.tables[newKey] = tbl
+				delete(t.tables, oldKey)
+			}
+			pairs = append(pairs, fmt.Sprintf("%s TO %s", quoteTable(defaultDB, tt.NewTable), quoteTable(defaultDB, tt.OldTable)))
+		}
+		return []string{fmt.Sprintf("RENAME TABLE %s;", strings.Join(pairs, ", "))}
+
+	case *ast.CreateIndexStmt:
+		key := tableKey(defaultDB, s.Table)
+		tbl := t.table(key)
+		tbl.indexes[strings.ToLower(s.IndexName)] = indexDefFromCreateIndex(s)
+		return []string{fmt.Sprintf("DROP INDEX `%s` ON %s;", s.IndexName, quoteTable(defaultDB, s.Table))}
+
+	case *ast.DropIndexStmt:
+		tbl := t.table(tableKey(defaultDB, s.Table))
+		def, ok := tbl.indexes[strings.ToLower(s.IndexName)]
+		if !ok {
+			return []string{lost("DROP INDEX `%s` ON %s can not be reversed, index definition is unknown", s.IndexName, quoteTable(defaultDB, s.Table))}
+		}
+		delete(tbl.indexes, strings.ToLower(s.IndexName))
+		return []string{fmt.Sprintf("ALTER TABLE %s ADD %s;", quoteTable(defaultDB, s.Table), def)}
+
+	case *ast.AlterTableStmt:
+		return t.reverseAlterTable(defaultDB, s, lost)
+
+	case *ast.CreateDatabaseStmt:
+		return []string{fmt.Sprintf("DROP DATABASE `%s`;", s.Name.O)}
+
+	case *ast.DropDatabaseStmt:
+		return []string{lost("DROP DATABASE `%s` is not reversible, all tables of the database were lost here, restore them from backup", s.Name.O)}
+
+	default:
+		return []string{lost("statement is not reversible: %s", restoreNode(stmt))}
+	}
+}
+
+func indexDefFromCreateIndex(s *ast.CreateIndexStmt) string {
+	var keys []string
+	for _, part := range s.IndexPartSpecifications {
+		keys = append(keys, restoreNode(part))
+	}
+	kind := "INDEX"
+	switch s.KeyType {
+	case ast.IndexKeyTypeUnique:
+		kind = "UNIQUE INDEX"
+	case ast.IndexKeyTypeFullText:
+		kind = "FULLTEXT INDEX"
+	case ast.IndexKeyTypeSpatial:
+		kind = "SPATIAL INDEX"
+	}
+	return fmt.Sprintf("%s `%s`(%s)", kind, s.IndexName, strings.Join(keys, ", "))
+}
+
+func (t *schemaTracker) reverseAlterTable(defaultDB string, s *ast.AlterTableStmt, lost func(string, ...interface{}) string) []string {
+	key := tableKey(defaultDB, s.Table)
+	tableName := quoteTable(defaultDB, s.Table)
+	tbl := t.table(key)
+
+	var (
+		specs    []string // 反向子句, 最终逆序拼接
+		warnings []string
+	)
+	for _, spec := range s.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				name := col.Name.Name.O
+				tbl.columns[strings.ToLower(name)] = restoreNode(col)
+				specs = append(specs, fmt.Sprintf("DROP COLUMN `%s`", name))
+			}
+
+		case ast.AlterTableDropColumn:
+			name := spec.OldColumnName.Name.O
+			delete(tbl.columns, strings.ToLower(name))
+			warnings = append(warnings, lost("ALTER TABLE %s DROP COLUMN `%s` is not reversible, data of the column was lost here", tableName, name))
+
+		case ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+			col := spec.NewColumns[0]
+			oldName := col.Name.Name.O
+			if spec.Tp == ast.AlterTableChangeColumn {
+				oldName = spec.OldColumnName.Name.O
+			}
+			prior, ok := tbl.columns[strings.ToLower(oldName)]
+			delete(tbl.columns, strings.ToLower(oldName))
+			tbl.columns[strings.ToLower(col.Name.Name.O)] = restoreNode(col)
+			if !ok {
+				warnings = append(warnings, lost("ALTER TABLE %s change of column `%s` can not be reversed, previous definition is unknown", tableName, oldName))
+				continue
+			}
+			if spec.Tp == ast.AlterTableChangeColumn {
+				specs = append(specs, fmt.Sprintf("CHANGE COLUMN `%s` %s", col.Name.Name.O, prior))
+			} else {
+				specs = append(specs, fmt.Sprintf("MODIFY COLUMN %s", prior))
+			}
+
+		case ast.AlterTableAlterColumn:
+			name := spec.NewColumns[0].Name.Name.O
+			prior, ok := tbl.columns[strings.ToLower(name)]
+			if !ok {
+				warnings = append(warnings, lost("ALTER TABLE %s ALTER COLUMN `%s` can not be reversed, previous definition is unknown", tableName, name))
+				continue
+			}
+			specs = append(specs, fmt.Sprintf("MODIFY COLUMN %s", prior))
+
+		case ast.AlterTableRenameColumn:
+			oldName, newName := spec.OldColumnName.Name.O, spec.NewColumnName.Name.O
+			if def, ok := tbl.columns[strings.ToLower(oldName)]; ok {
+				delete(tbl.columns, strings.ToLower(oldName))
+				tbl.columns[strings.ToLower(newName)] = strings.Replace(def, "`"+oldName+"`", "`"+newName+"`", 1)
+			}
+			specs = append(specs, fmt.Sprintf("RENAME COLUMN `%s` TO `%s`", newName, oldName))
+
+		case ast.AlterTableAddConstraint:
+			c := spec.Constraint
+			name := constraintName(c)
+			switch {
+			case c.Tp == ast.ConstraintPrimaryKey:
+				specs = append(specs, "DROP PRIMARY KEY")
+			case isIndexConstraint(c):
+				specs = append(specs, fmt.Sprintf("DROP INDEX `%s`", name))
+			case c.Tp == ast.ConstraintForeignKey && c.Name != "":
+				specs = append(specs, fmt.Sprintf("DROP FOREIGN KEY `%s`", c.Name))
+			case c.Tp == ast.ConstraintCheck && c.Name != "":
+				specs = append(specs, fmt.Sprintf("DROP CHECK `%s`", c.Name))
+			default:
+				warnings = append(warnings, lost("ALTER TABLE %s ADD %s can not be reversed, constraint name is unknown", tableName, restoreNode(c)))
+			}
+			tbl.trackConstraint(c)
+
+		case ast.AlterTableDropIndex:
+			def, ok := tbl.indexes[strings.ToLower(spec.Name)]
+			if !ok {
+				warnings = append(warnings, lost("ALTER TABLE %s DROP INDEX `%s` can not be reversed, index definition is unknown", tableName, spec.Name))
+				continue
+			}
+			delete(tbl.indexes, strings.ToLower(spec.Name))
+			specs = append(specs, "ADD "+def)
+
+		case ast.AlterTableDropPrimaryKey:
+			if tbl.primaryKey == "" {
+				warnings = append(warnings, lost("ALTER TABLE %s DROP PRIMARY KEY can not be reversed, primary key definition is unknown", tableName))
+				continue
+			}
+			specs = append(specs, "ADD "+tbl.primaryKey)
+			tbl.primaryKey = ""
+
+		case ast.AlterTableRenameIndex:
+			from, to := spec.FromKey.O, spec.ToKey.O
+			if def, ok := tbl.indexes[strings.ToLower(from)]; ok {
+				delete(tbl.indexes, strings.ToLower(from))
+				tbl.indexes[strings.ToLower(to)] = strings.Replace(def, "`"+from+"`", "`"+to+"`", 1)
+			}
+			specs = append(specs, fmt.Sprintf("RENAME INDEX `%s` TO `%s`", to, from))
+
+		case ast.AlterTableRenameTable:
+			newKey := tableKey(defaultDB, spec.NewTable)
+			t.tables[newKey] = tbl
+			delete(t.tables, key)
+			// 反向语句作用在新表名上
+			tableName = quoteTable(defaultDB, spec.NewTable)
+			specs = append(specs, fmt.Sprintf("RENAME TO %s", quoteTable(defaultDB, s.Table)))
+
+		case ast.AlterTableLock, ast.AlterTableAlgorithm, ast.AlterTableForce:
+			// 不影响表结构
+
+		default:
+			warnings = append(warnings, lost("ALTER TABLE %s clause can not be reversed: %s", tableName, restoreNode(spec)))
+		}
+	}
+
+	result := warnings
+	if len(specs) > 0 {
+		for i, j := 0, len(specs)-1; i < j; i, j = i+1, j-1 {
+			specs[i], specs[j] = specs[j], specs[i]
+		}
+		result = append(result, fmt.Sprintf("ALTER TABLE %s %s;", tableName, strings.Join(specs, ", ")))
+	}
+	return result
+}
@@ -0,0 +1,289 @@
+package binlogsql
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/v2/model"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+
+	// OutputSplitBinlog 每个 binlog 文件输出到单独的文件
+	OutputSplitBinlog = "binlog"
+
+	outputBufferSize    = 1 << 20
+	outputFlushInterval = time.Second
+)
+
+// outputWriter 是 binlogsql 的输出, 带缓冲, 支持压缩和按大小/binlog 文件切分.
+// 未指定 --output 时写到标准输出. 后台每秒刷新一次缓冲, --stopNever 持续输出时也能及时看到结果,
+// options.Ctx 取消(SIGINT)时立即刷新, Run 退出时 Close 关闭文件
+type outputWriter struct {
+	mu          sync.Mutex
+	path        string
+	compress    string
+	splitSize   int64 // 按未压缩的字节数切分, 0 表示不按大小切分
+	splitBinlog bool
+	force       bool
+
+	file       *os.File
+	comp       io.WriteCloser // 压缩层, 不压缩时为 nil
+	buf        *bufio.Writer
+	written    int64 // 当前文件已写入的未压缩字节数
+	index      int   // 按大小切分时的文件序号
+	binlogFile string
+
+	done chan struct{}
+}
+
+// parseOutputSize 解析 --outputSplit 的大小, 支持 K/M/G 后缀
+func parseOutputSize(size string) (int64, error) {
+	s, unit := size, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid output split: %s, should be binlog or size like 512M", size)
+	}
+	return n * unit, nil
+}
+
+func newOutputWriter(options *model.DaemonOptions) (*outputWriter, error) {
+	o := &outputWriter{
+		path:     options.BinlogSql.OutFile,
+		compress: options.BinlogSql.OutputCompress,
+		force:    options.BinlogSql.Force,
+		index:    1,
+		done:     make(chan struct{}),
+	}
+	if o.compress == "" {
+		o.compress = CompressNone
+	}
+	switch o.compress {
+	case CompressNone, CompressGzip, CompressZstd:
+	default:
+		return nil, fmt.Errorf("unsupported output compress: %s", o.compress)
+	}
+
+	split := options.BinlogSql.OutputSplit
+	if o.path == "" {
+		if o.compress != CompressNone || split != "" {
+			return nil, fmt.Errorf("--outputCompress and --outputSplit must be used with --output")
+		}
+		o.buf = bufio.NewWriterSize(os.Stdout, outputBufferSize)
+	} else if split == OutputSplitBinlog {
+		o.splitBinlog = true
+	} else if split != "" {
+		size, err := parseOutputSize(split)
+		if err != nil {
+			return nil, err
+		}
+		o.splitSize = size
+	} else if err := o.open(); err != nil {
+		// 不切分时立即创建文件, 文件已存在时尽早报错
+		return nil, err
+	}
+
+	ctx := options.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go o.flushLoop(ctx)
+	return o, nil
+}
+
+// fileName 返回下一个输出文件名, 压缩时自动加上扩展名
+func (o *outputWriter) fileName() string {
+	name := o.path
+	if o.splitBinlog {
+		name = fmt.Sprintf("%s.%s", o.path, o.binlogFile)
+	} else if o.splitSize > 0 {
+		name = fmt.Sprintf("%s.%06d", o.path, o.index)
+	}
+	switch {
+	case o.compress == CompressGzip && !strings.HasSuffix(name, ".gz"):
+		name += ".gz"
+	case o.compress == CompressZstd && !strings.HasSuffix(name, ".zst"):
+		name += ".zst"
+	}
+	return name
+}
+
+func (o *outputWriter) open() error {
+	name := o.fileName()
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if o.force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(name, flag, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("output file %s already exists, use --force to overwrite it", name)
+	}
+	if err != nil {
+		return fmt.Errorf("create output file %s failed: %v", name, err)
+	}
+
+	var w io.Writer = file
+	switch o.compress {
+	case CompressGzip:
+		o.comp = gzip.NewWriter(file)
+		w = o.comp
+	case CompressZstd:
+		enc, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		o.comp = enc
+		w = enc
+	}
+	o.file = file
+	o.buf = bufio.NewWriterSize(w, outputBufferSize)
+	o.written = 0
+	log.Info().Msgf("write output to %s", name)
+	return nil
+}
+
+// closeFile 刷新缓冲并关闭当前文件, 压缩流写入结尾
+func (o *outputWriter) closeFile() error {
+	if o.file == nil {
+		return nil
+	}
+	err := o.buf.Flush()
+	if o.comp != nil {
+		if cerr := o.comp.Close(); err == nil {
+			err = cerr
+		}
+		o.comp = nil
+	}
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	o.file = nil
+	o.buf = nil
+	return err
+}
+
+// SetBinlogFile 设置当前输出内容所属的 binlog 文件, 按 binlog 切分时切换到新的输出文件
+func (o *outputWriter) SetBinlogFile(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.splitBinlog || name == "" || name == o.binlogFile {
+		return nil
+	}
+	if err := o.closeFile(); err != nil {
+		return err
+	}
+	o.binlogFile = name
+	return nil
+}
+
+// WriteString 写入一段完整的输出(一条语句或一个报告), 切分只发生在两次写入之间
+func (o *outputWriter) WriteString(s string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.path != "" {
+		if o.splitSize > 0 && o.file != nil && o.written > 0 && o.written+int64(len(s)) > o.splitSize {
+			if err := o.closeFile(); err != nil {
+				return err
+			}
+			o.index++
+		}
+		if o.file == nil {
+			if o.splitBinlog && o.binlogFile == "" {
+				o.binlogFile = "unknown"
+			}
+			if err := o.open(); err != nil {
+				return err
+			}
+		}
+	}
+	n, err := o.buf.WriteString(s)
+	o.written += int64(n)
+	return err
+}
+
+// Write 写入一段内容, 写入失败时记录日志, 用于解析过程中的输出
+func (o *outputWriter) Write(s string) {
+	if err := o.WriteString(s); err != nil {
+		log.Error().Err(err).Msg("write output failed")
+	}
+}
+
+// Flush 把缓冲中的内容写到文件或标准输出, 压缩流会输出一个完整的块
+func (o *outputWriter) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.buf == nil {
+		return nil
+	}
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	switch c := o.comp.(type) {
+	case *gzip.Writer:
+		return c.Flush()
+	case *zstd.Encoder:
+		return c.Flush()
+	}
+	return nil
+}
+
+func (o *outputWriter) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ctx.Done():
+			if err := o.Flush(); err != nil {
+				log.Error().Err(err).Msg("flush output failed")
+			}
+			return
+		case <-ticker.C:
+			if err := o.Flush(); err != nil {
+				log.Error().Err(err).Msg("flush output failed")
+			}
+		}
+	}
+}
+
+// Close 刷新并关闭输出, 可以重复调用
+func (o *outputWriter) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	select {
+	case <-o.done:
+		return nil
+	default:
+		close(o.done)
+	}
+	if o.path == "" {
+		return o.buf.Flush()
+	}
+	return o.closeFile()
+}
@@ -0,0 +1,52 @@
+package binlogsql
+
+import "sync"
+
+// parallelFiles 用 workers 个协程并发处理 binlog 文件, 按文件顺序依次调用 emit.
+// 每个文件由 process 独立解析(使用自己的 BinlogParser, 表映射只在文件内有效),
+// 已解析但还没轮到输出的文件最多缓存 workers 个, 避免结果全部堆积在内存中.
+// emit 返回错误时停止派发新的文件, 并返回该错误
+func parallelFiles[T any](files []string, workers int, process func(fileName string) T, emit func(fileName string, result T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]chan T, len(files))
+	for i := range results {
+		results[i] = make(chan T, 1)
+	}
+
+	// tokens 限制正在解析和等待输出的文件数
+	tokens := make(chan struct{}, workers)
+	done := make(chan struct{})
+	dispatched := make(chan struct{})
+	var wg sync.WaitGroup
+	go func() {
+		defer close(dispatched)
+		for i, fileName := range files {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(i int, fileName string) {
+				defer wg.Done()
+				results[i] <- process(fileName)
+			}(i, fileName)
+		}
+	}()
+
+	var err error
+	for i, fileName := range files {
+		result := <-results[i]
+		<-tokens
+		if err = emit(fileName, result); err != nil {
+			break
+		}
+	}
+	// 出错提前退出时停止派发, 并等待已启动的解析结束
+	close(done)
+	<-dispatched
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,389 @@
+package binlogsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 在线读取时等待下一个事件的时间, 超过后认为已经读到了当前文件的末尾
+	probeEventTimeout = 5 * time.Second
+	// 无法获取主库位置时, 超过这个时间没有收到新事件认为已经读到了最新位置
+	idleStopTimeout = 10 * time.Second
+)
+
+// errIdleStop 超过 idleStopTimeout 没有收到新事件
+var errIdleStop = errors.New("no binlog event received in the idle timeout")
+
+// compareBinlogName 按文件序号比较 binlog 文件名, 序号超过 6 位时字符串比较会出错
+func compareBinlogName(a, b string) int {
+	ai, aerr := strconv.ParseUint(a[strings.LastIndex(a, ".")+1:], 10, 64)
+	bi, berr := strconv.ParseUint(b[strings.LastIndex(b, ".")+1:], 10, 64)
+	if aerr != nil || berr != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case ai < bi:
+		return -1
+	case ai > bi:
+		return 1
+	}
+	return 0
+}
+
+// positionReached 判断 file:pos 是否已经到达 target
+func positionReached(fileName string, pos uint32, target mysql.Position) bool {
+	if c := compareBinlogName(fileName, target.Name); c != 0 {
+		return c > 0
+	}
+	return pos >= target.Pos
+}
+
+// streamRange 在线读取时的结束条件: --stopFile/--stopPose, --stopTime, --stopGtid,
+// 未开启 --stopNever 时读到启动时主库的当前位置结束
+type streamRange struct {
+	stopPos   mysql.Position // Name 为空表示不限制
+	stopTime  time.Time
+	stopUUID  string
+	stopGNO   int64
+	masterPos mysql.Position // Name 为空表示不限制
+	idleStop  bool           // 无法获取主库位置时, 超过 idleStopTimeout 没有新事件时结束
+}
+
+// newStopRange 只包含 --stopFile/--stopPose, --stopTime, --stopGtid 的结束条件, 用于读取本地文件
+func newStopRange(options *model.DaemonOptions) (*streamRange, error) {
+	r := &streamRange{}
+	if options.BinlogSql.StopFile != "" {
+		r.stopPos = mysql.Position{Name: options.BinlogSql.StopFile, Pos: uint32(options.BinlogSql.StopPose)}
+	}
+	if options.BinlogSql.StopTime != "" {
+		r.stopTime = parseTime(options.BinlogSql.StopTime)
+	}
+	if options.BinlogSql.StopGTID != "" {
+		gtid := strings.ToLower(strings.TrimSpace(options.BinlogSql.StopGTID))
+		i := strings.LastIndex(gtid, ":")
+		gno, err := strconv.ParseInt(gtid[i+1:], 10, 64)
+		if i <= 0 || err != nil {
+			return nil, fmt.Errorf("invalid stop gtid %s, should be uuid:number", options.BinlogSql.StopGTID)
+		}
+		r.stopUUID, r.stopGNO = gtid[:i], gno
+	}
+	return r, nil
+}
+
+func newStreamRange(db *sql.DB, options *model.DaemonOptions) (*streamRange, error) {
+	r, err := newStopRange(options)
+	if err != nil {
+		return nil, err
+	}
+	if options.BinlogSql.StopNever == "false" || options.BinlogSql.StopNever == "0" {
+		pos, err := getMasterPosition(db)
+		if err != nil {
+			log.Warn().Err(err).Msgf("get current master position failed, stop after no event for %s", idleStopTimeout)
+			r.idleStop = true
+		} else {
+			r.masterPos = pos
+			log.Info().Msgf("stop at current master position %s:%d", pos.Name, pos.Pos)
+		}
+	}
+	return r, nil
+}
+
+// eventReader 按顺序返回原始事件和所在的 binlog 文件, 由 binlog.Reader 实现
+type eventReader interface {
+	NextEvent(ctx context.Context) (*replication.BinlogEvent, string, error)
+}
+
+// nextEvent 读取下一个事件, 开启 idleStop 时从 lastEvent 开始超过 idleStopTimeout 没有收到事件返回 errIdleStop.
+// 每收到一个事件(心跳除外)调用方更新 lastEvent, 持续有事件时不会结束
+func (r *streamRange) nextEvent(ctx context.Context, reader eventReader, lastEvent time.Time) (*replication.BinlogEvent, string, error) {
+	if !r.idleStop {
+		return reader.NextEvent(ctx)
+	}
+	idleCtx, cancel := context.WithDeadline(ctx, lastEvent.Add(idleStopTimeout))
+	defer cancel()
+	ev, fileName, err := reader.NextEvent(idleCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fileName, errIdleStop
+	}
+	return ev, fileName, err
+}
+
+// getMasterPosition 获取主库当前写到的位置, 8.4 起 SHOW MASTER STATUS 改名为 SHOW BINARY LOG STATUS
+func getMasterPosition(db *sql.DB) (mysql.Position, error) {
+	var pos mysql.Position
+	rows, err := db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		rows, err = db.Query("SHOW BINARY LOG STATUS")
+	}
+	if err != nil {
+		return pos, fmt.Errorf("get master status failed: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	if !rows.Next() {
+		return pos, fmt.Errorf("binary log is not enabled")
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return pos, err
+	}
+	p, err := strconv.ParseUint(string(values[1]), 10, 32)
+	if err != nil {
+		return pos, fmt.Errorf("invalid master position %s: %v", values[1], err)
+	}
+	return mysql.Position{Name: string(values[0]), Pos: uint32(p)}, nil
+}
+
+// Done 判断是否已经读到了启动时的主库位置, 用于一开始就没有新事件的情况
+func (r *streamRange) Done(committed mysql.Position) bool {
+	return r.masterPos.Name != "" && committed.Name != "" && positionReached(committed.Name, committed.Pos, r.masterPos)
+}
+
+// Before 在处理事件前判断是否超出结束位置或结束时间, 超出时不处理该事件
+func (r *streamRange) Before(ev *replication.BinlogEvent, fileName string) bool {
+	if ev.Header.LogPos == 0 {
+		// 开始同步时的伪造事件
+		return false
+	}
+	if r.stopPos.Name != "" {
+		if _, ok := ev.Event.(*replication.RotateEvent); ok {
+			// RotateEvent 到达时 fileName 已经是下一个文件
+			if compareBinlogName(fileName, r.stopPos.Name) > 0 {
+				return true
+			}
+		} else if start := ev.Header.LogPos - ev.Header.EventSize; positionReached(fileName, start, r.stopPos) &&
+			(r.stopPos.Pos > 0 || compareBinlogName(fileName, r.stopPos.Name) > 0) {
+			// 只指定 --stopFile 时读完整个文件
+			return true
+		}
+	}
+	if !r.stopTime.IsZero() && ev.Header.Timestamp > 0 && time.Unix(int64(ev.Header.Timestamp), 0).After(r.stopTime) {
+		return true
+	}
+	return false
+}
+
+// After 在事件处理后判断是否结束: 提交了 --stopGtid 指定的事务, 或到达启动时的主库位置
+func (r *streamRange) After(ev *replication.BinlogEvent, fileName string, committedGTID string) bool {
+	if r.stopUUID != "" && committedGTID != "" {
+		i := strings.LastIndex(committedGTID, ":")
+		gno, _ := strconv.ParseInt(committedGTID[i+1:], 10, 64)
+		if committedGTID[:i] == r.stopUUID && gno >= r.stopGNO {
+			return true
+		}
+	}
+	if r.masterPos.Name == "" || ev.Header.LogPos == 0 {
+		return false
+	}
+	if _, ok := ev.Event.(*replication.RotateEvent); ok {
+		return false
+	}
+	return positionReached(fileName, ev.Header.LogPos, r.masterPos)
+}
+
+// eventTimeProbe 读取一个 binlog 文件开头的事件, 返回第一个带时间戳的事件(FORMAT_DESCRIPTION_EVENT)的时间
+type eventTimeProbe func(fileName string) (time.Time, error)
+
+// findStartFile 按文件的第一个事件时间二分查找 --startTime 所在的文件, 即最后一个开始时间不晚于 startTime 的文件
+func findStartFile(files []string, startTime time.Time, probe eventTimeProbe) (string, error) {
+	var probeErr error
+	i := sort.Search(len(files), func(i int) bool {
+		if probeErr != nil {
+			return true
+		}
+		t, err := probe(files[i])
+		if err != nil {
+			probeErr = err
+			return true
+		}
+		return t.After(startTime)
+	})
+	if probeErr != nil {
+		return "", probeErr
+	}
+	if i > 0 {
+		i--
+	}
+	return files[i], nil
+}
+
+// startPositionFinder 在文件中查找第一个开始时间不早于 startTime 的事务的起始位置
+type startPositionFinder struct {
+	startTime time.Time
+	boundary  uint32 // 最后一个事务边界
+	inTrx     bool
+}
+
+// Next 处理一个事件, 返回找到的位置; next 不为空表示当前文件已读完, 应从下一个文件开头开始
+func (f *startPositionFinder) Next(ev *replication.BinlogEvent) (pos uint32, next string, found bool) {
+	if ev.Header.LogPos == 0 {
+		return 0, "", false
+	}
+	eventTime := time.Unix(int64(ev.Header.Timestamp), 0)
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		return 0, string(e.NextLogName), true
+	case *replication.GTIDEvent:
+		if !f.inTrx && !eventTime.Before(f.startTime) {
+			return f.boundary, "", true
+		}
+		f.inTrx = true
+		return 0, "", false
+	case *replication.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+		if !f.inTrx && !eventTime.Before(f.startTime) {
+			return f.boundary, "", true
+		}
+		if query == "BEGIN" {
+			f.inTrx = true
+			return 0, "", false
+		}
+		if f.inTrx && !isTrxEnd(ev) {
+			// 语句格式的事务中的 DML, XA START/END
+			return 0, "", false
+		}
+	case *replication.FormatDescriptionEvent, *replication.PreviousGTIDsEvent:
+	default:
+		if !isTrxEnd(ev) {
+			return 0, "", false
+		}
+	}
+	f.inTrx = false
+	f.boundary = ev.Header.LogPos
+	return 0, "", false
+}
+
+// localFirstEventTime 返回本地 binlog 文件第一个带时间戳的事件的时间, 即文件的创建时间
+func localFirstEventTime(binlogDir, fileName string) (time.Time, error) {
+	stopParse := fmt.Errorf("stop parse")
+	var t time.Time
+	parser := replication.NewBinlogParser()
+	err := parser.ParseFile(filepath.Join(binlogDir, fileName), 0, func(ev *replication.BinlogEvent) error {
+		if ev.Header.Timestamp == 0 {
+			return nil
+		}
+		t = time.Unix(int64(ev.Header.Timestamp), 0)
+		return stopParse
+	})
+	if err != nil && err != stopParse && !strings.Contains(err.Error(), stopParse.Error()) {
+		return t, err
+	}
+	return t, nil
+}
+
+// findStartPositionLocal 在 --binlogDir 的本地文件中查找 --startTime 的起始位置
+func findStartPositionLocal(binlogDir string, files []string, startTime time.Time) (mysql.Position, error) {
+	stopParse := fmt.Errorf("stop parse")
+	fileName, err := findStartFile(files, startTime, func(fileName string) (time.Time, error) {
+		return localFirstEventTime(binlogDir, fileName)
+	})
+	if err != nil {
+		return mysql.Position{}, err
+	}
+
+	pos := mysql.Position{Name: fileName, Pos: 4}
+	finder := &startPositionFinder{startTime: startTime, boundary: 4}
+	parser := replication.NewBinlogParser()
+	err = parser.ParseFile(filepath.Join(binlogDir, fileName), 0, func(ev *replication.BinlogEvent) error {
+		p, next, found := finder.Next(ev)
+		if !found {
+			pos.Pos = finder.boundary
+			return nil
+		}
+		if next != "" {
+			pos = mysql.Position{Name: next, Pos: 4}
+		} else {
+			pos.Pos = p
+		}
+		return stopParse
+	})
+	if err != nil && err != stopParse && !strings.Contains(err.Error(), stopParse.Error()) {
+		return pos, err
+	}
+	return pos, nil
+}
+
+// readOnlineEvents 通过复制协议从文件开头读取事件直到 handle 返回 true, 或超时没有新事件
+func readOnlineEvents(ctx context.Context, cfg replication.BinlogSyncerConfig, fileName string, handle func(ev *replication.BinlogEvent) bool) error {
+	reader, err := binlog.NewServerReader(cfg, mysql.Position{Name: fileName, Pos: 4}, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for {
+		evCtx, cancel := context.WithTimeout(ctx, probeEventTimeout)
+		ev, _, err := reader.NextEvent(evCtx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			// 已经读到正在写入的文件末尾
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if handle(ev) {
+			return nil
+		}
+	}
+}
+
+// onlineFirstEventTime 通过复制协议读取 binlog 文件第一个带时间戳的事件的时间
+func onlineFirstEventTime(ctx context.Context, cfg replication.BinlogSyncerConfig, fileName string) (time.Time, error) {
+	var t time.Time
+	err := readOnlineEvents(ctx, cfg, fileName, func(ev *replication.BinlogEvent) bool {
+		if ev.Header.Timestamp == 0 {
+			return false
+		}
+		t = time.Unix(int64(ev.Header.Timestamp), 0)
+		return true
+	})
+	return t, err
+}
+
+// findStartPositionOnline 通过复制协议读取主库的 binlog 查找 --startTime 的起始位置
+func findStartPositionOnline(ctx context.Context, cfg replication.BinlogSyncerConfig, files []string, startTime time.Time) (mysql.Position, error) {
+	fileName, err := findStartFile(files, startTime, func(fileName string) (time.Time, error) {
+		return onlineFirstEventTime(ctx, cfg, fileName)
+	})
+	if err != nil {
+		return mysql.Position{}, err
+	}
+
+	pos := mysql.Position{Name: fileName, Pos: 4}
+	finder := &startPositionFinder{startTime: startTime, boundary: 4}
+	err = readOnlineEvents(ctx, cfg, fileName, func(ev *replication.BinlogEvent) bool {
+		p, next, found := finder.Next(ev)
+		if !found {
+			pos.Pos = finder.boundary
+			return false
+		}
+		if next != "" {
+			pos = mysql.Position{Name: next, Pos: 4}
+		} else {
+			pos.Pos = p
+		}
+		return true
+	})
+	return pos, err
+}
@@ -0,0 +1,142 @@
+package binlogsql
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestCompareBinlogName(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect int
+	}{
+		{"mysql-bin.000001", "mysql-bin.000002", -1},
+		{"mysql-bin.000010", "mysql-bin.000009", 1},
+		{"mysql-bin.000003", "mysql-bin.000003", 0},
+		// 序号超过 6 位, 字符串比较的结果相反
+		{"mysql-bin.999999", "mysql-bin.1000000", -1},
+		{"mysql-bin.1000001", "mysql-bin.999999", 1},
+		// 没有数字序号时按字符串比较
+		{"mysql-bin.abc", "mysql-bin.abd", -1},
+	}
+	for _, tt := range tests {
+		if got := compareBinlogName(tt.a, tt.b); got != tt.expect {
+			t.Errorf("compareBinlogName(%s, %s) = %d, expect %d", tt.a, tt.b, got, tt.expect)
+		}
+	}
+}
+
+func TestFindStartFile(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	files := []string{"mysql-bin.999998", "mysql-bin.999999", "mysql-bin.1000000", "mysql-bin.1000001"}
+	// 每个文件的第一个事件时间相隔一小时
+	probe := func(fileName string) (time.Time, error) {
+		for i, f := range files {
+			if f == fileName {
+				return base.Add(time.Duration(i) * time.Hour), nil
+			}
+		}
+		return time.Time{}, errors.New("file not found")
+	}
+	tests := []struct {
+		name      string
+		startTime time.Time
+		expect    string
+	}{
+		{"before first file", base.Add(-time.Hour), "mysql-bin.999998"},
+		{"first event of file", base.Add(time.Hour), "mysql-bin.999999"},
+		{"inside file", base.Add(150 * time.Minute), "mysql-bin.1000000"},
+		{"after last file", base.Add(10 * time.Hour), "mysql-bin.1000001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findStartFile(files, tt.startTime, probe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expect {
+				t.Errorf("start file is %s, expect %s", got, tt.expect)
+			}
+		})
+	}
+
+	if _, err := findStartFile(files, base, func(string) (time.Time, error) { return time.Time{}, errors.New("read failed") }); err == nil {
+		t.Error("probe error is not returned")
+	}
+}
+
+// 开始位置是第一个开始时间不早于 startTime 的事务之前的事务边界
+func TestStartPositionFinder(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	event := func(e replication.Event, eventType replication.EventType, logPos uint32, offset time.Duration) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: eventType, LogPos: logPos, Timestamp: uint32(base.Add(offset).Unix())},
+			Event:  e,
+		}
+	}
+	gtid := func(logPos uint32, offset time.Duration) *replication.BinlogEvent {
+		return event(&replication.GTIDEvent{}, replication.GTID_EVENT, logPos, offset)
+	}
+	xid := func(logPos uint32, offset time.Duration) *replication.BinlogEvent {
+		return event(&replication.XIDEvent{}, replication.XID_EVENT, logPos, offset)
+	}
+	query := func(q string, logPos uint32, offset time.Duration) *replication.BinlogEvent {
+		return event(&replication.QueryEvent{Query: []byte(q)}, replication.QUERY_EVENT, logPos, offset)
+	}
+	events := []*replication.BinlogEvent{
+		event(&replication.FormatDescriptionEvent{}, replication.FORMAT_DESCRIPTION_EVENT, 126, 0),
+		gtid(200, time.Minute), query("BEGIN", 280, time.Minute), xid(400, time.Minute),
+		// 事务开始于 startTime 之前, 提交在之后, 不作为开始位置
+		gtid(480, 2*time.Minute), query("BEGIN", 560, 2*time.Minute), xid(700, 4*time.Minute),
+		gtid(780, 5*time.Minute), query("BEGIN", 860, 5*time.Minute), xid(1000, 5*time.Minute),
+	}
+
+	finder := &startPositionFinder{startTime: base.Add(3 * time.Minute), boundary: 4}
+	for _, ev := range events {
+		if pos, next, found := finder.Next(ev); found {
+			if pos != 700 || next != "" {
+				t.Errorf("start position is %d %q, expect 700", pos, next)
+			}
+			return
+		}
+	}
+	t.Error("start position not found")
+}
+
+// streamerReader 用 BinlogStreamer 模拟在线读取
+type streamerReader struct {
+	*replication.BinlogStreamer
+}
+
+func (r streamerReader) NextEvent(ctx context.Context) (*replication.BinlogEvent, string, error) {
+	ev, err := r.GetEvent(ctx)
+	return ev, "mysql-bin.000001", err
+}
+
+// idleStop 时从最后一个事件开始计时, 有事件时不会结束
+func TestNextEventIdleStop(t *testing.T) {
+	streamer := streamerReader{replication.NewBinlogStreamer()}
+	rng := &streamRange{idleStop: true}
+	ev := &replication.BinlogEvent{Header: &replication.EventHeader{EventType: replication.XID_EVENT, LogPos: 100}, Event: &replication.XIDEvent{}}
+	if err := streamer.AddEventToStreamer(ev); err != nil {
+		t.Fatal(err)
+	}
+	// 有事件等待读取时直接返回
+	got, fileName, err := rng.nextEvent(context.Background(), streamer, time.Now().Add(-idleStopTimeout/2))
+	if err != nil || got != ev || fileName != "mysql-bin.000001" {
+		t.Fatalf("next event is %v, %v", got, err)
+	}
+	if _, _, err := rng.nextEvent(context.Background(), streamer, time.Now().Add(-idleStopTimeout)); !errors.Is(err, errIdleStop) {
+		t.Errorf("expect idle stop, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := rng.nextEvent(ctx, streamer, time.Now()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect canceled, got %v", err)
+	}
+}
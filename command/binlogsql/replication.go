@@ -1,14 +1,17 @@
 package binlogsql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"example.com/m/v2/model"
 	"fmt"
+	"io"
 	"regexp"
 	"strings"
 	"time"
 
+	"example.com/m/v2/pkg/binlog"
 	"github.com/go-mysql-org/go-mysql/replication"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/rs/zerolog/log"
@@ -22,23 +25,49 @@ type BinlogInfo struct {
 	Sqls       []string
 }
 
+// binlogFileSize 是 SHOW BINARY LOGS 的一行
+type binlogFileSize struct {
+	Name string
+	Size int64
+}
+
+// showBinaryLogs 执行 SHOW BINARY LOGS, 8.0 起多了 Encrypted 列
+func showBinaryLogs(db *sql.DB) ([]binlogFileSize, error) {
+	rows, err := db.Query("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []binlogFileSize
+	for rows.Next() {
+		var f binlogFileSize
+		dest := []interface{}{&f.Name, &f.Size}
+		for i := len(dest); i < len(columns); i++ {
+			dest = append(dest, new(sql.RawBytes))
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
 func getBinlogFiles(db *sql.DB, optionBinlogDir string) ([]string, error) {
 	var binlogFiles []string
 	var err error
 	if optionBinlogDir == "" {
-		rows, err := db.Query("SHOW BINARY LOGS")
+		files, err := showBinaryLogs(db)
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var logName string
-			var size int64
-			if err := rows.Scan(&logName, &size); err != nil {
-				return nil, err
-			}
-			binlogFiles = append(binlogFiles, logName)
+		for _, f := range files {
+			binlogFiles = append(binlogFiles, f.Name)
 		}
 	} else {
 		binlogFiles, err = GetFileNameByDir(optionBinlogDir)
@@ -50,7 +79,19 @@ func getBinlogFiles(db *sql.DB, optionBinlogDir string) ([]string, error) {
 	return binlogFiles, nil
 }
 
-func analyzeBinlogFile(fileName string, binlogDir string, parser *replication.BinlogParser, db *sql.DB, options *model.DaemonOptions) (*BinlogInfo, error) {
+// selectBinlogFiles 按 --startFile/--stopFile 截取 binlog 文件列表, 文件名按序号递增
+func selectBinlogFiles(binlogFiles []string, startFile, stopFile string) []string {
+	var selected []string
+	for _, binlogFile := range binlogFiles {
+		if (startFile != "" && compareBinlogName(binlogFile, startFile) < 0) || (stopFile != "" && compareBinlogName(binlogFile, stopFile) > 0) {
+			continue
+		}
+		selected = append(selected, binlogFile)
+	}
+	return selected
+}
+
+func analyzeBinlogFile(fileName string, binlogDir string, db *sql.DB, options *model.DaemonOptions, state *parseState) (*BinlogInfo, error) {
 	binlogInfo := &BinlogInfo{
 		Name:       fileName,
 		DbTableMap: make(map[string]struct{}),
@@ -60,6 +101,26 @@ func analyzeBinlogFile(fileName string, binlogDir string, parser *replication.Bi
 
 	// 处理事件的回调函数
 	onEvent := func(ev *replication.BinlogEvent) error {
+		if state != nil {
+			if e, ok := ev.Event.(*replication.GTIDEvent); ok {
+				state.trackGTID(e)
+			}
+			if options.BinlogSql.Format == FormatBinlogBase64 {
+				if out := state.Base64.Encode(ev, fileName, eventSelected(options, ev, state), state.XA); out != "" {
+					binlogInfo.Sqls = append(binlogInfo.Sqls, out)
+				}
+				return nil
+			}
+			if state.SkipTrx {
+				return nil
+			}
+			// XA 分支的 sql 和在线解析一样缓存到 XA COMMIT 时输出
+			if xaOut, ok := state.XA.Handle(ev, fileName); ok {
+				binlogInfo.Sqls = append(binlogInfo.Sqls, xaOut...)
+				return nil
+			}
+		}
+
 		switch e := ev.Event.(type) {
 		case *replication.RotateEvent:
 			// 忽略 RotateEvent
@@ -87,8 +148,18 @@ func analyzeBinlogFile(fileName string, binlogDir string, parser *replication.Bi
 
 					dbTable := fmt.Sprintf("%s.%s", strings.ToLower(string(e.Schema)), strings.ToLower(fmt.Sprintf("%v", tableName)))
 					binlogInfo.DbTableMap[dbTable] = struct{}{}
+					if state != nil {
+						// DDL 之后的行事件重新查询表结构
+						state.Decoder.Decode(ev, fileName)
+					}
 
-					sqlStr := fmt.Sprintf("/*%s:%d, Executed At: %s*/\n%s;", fileName, ev.Header.LogPos, time.Unix(int64(ev.Header.Timestamp), 0).Format("2006-01-02 15:04:05"), sqlStr)
+					if options.BinlogSql.Mode == "flashback" && state != nil {
+						// flashback 模式输出反向 DDL, 不能原样输出
+						sqlStr = strings.Join(state.Tracker.ReverseDDL(string(e.Schema), string(e.Query), fileName, ev.Header.LogPos), "\n")
+					} else {
+						sqlStr += ";"
+					}
+					sqlStr := fmt.Sprintf("/*%s:%d, Executed At: %s*/\n%s", fileName, ev.Header.LogPos, time.Unix(int64(ev.Header.Timestamp), 0).Format("2006-01-02 15:04:05"), sqlStr)
 					binlogInfo.Sqls = append(binlogInfo.Sqls, sqlStr)
 				}
 			}
@@ -103,12 +174,21 @@ func analyzeBinlogFile(fileName string, binlogDir string, parser *replication.Bi
 
 			dbTable := fmt.Sprintf("%s.%s", strings.ToLower(string(e.Table.Schema)), strings.ToLower(string(e.Table.Table)))
 			binlogInfo.DbTableMap[dbTable] = struct{}{}
-			transactionID := ev.Header.LogPos
-			eventTime := time.Unix(int64(ev.Header.Timestamp), 0)
-			sql, err := generateSQL(db, ev.Header.EventType, e, options.BinlogSql.Mode, transactionID, eventTime, fileName)
+			if state == nil {
+				// stat 模式只统计库表, 不生成 sql
+				return nil
+			}
+			change, err := state.Decoder.Decode(ev, fileName)
+			if err != nil {
+				log.Error().Err(err).Msgf("decode rows event at %s:%d failed", fileName, ev.Header.LogPos)
+				return fmt.Errorf("decode rows event at %s:%d failed: %v", fileName, ev.Header.LogPos, err)
+			}
+			sql, err := generateSQL(change, options.BinlogSql.Mode, state)
 			if err != nil {
-				fmt.Printf("parse mysql 5.5 binlog error\n")
-			} else {
+				log.Error().Err(err).Msgf("generate sql of rows event at %s:%d failed", fileName, ev.Header.LogPos)
+				return fmt.Errorf("generate sql of rows event at %s:%d failed: %v", fileName, ev.Header.LogPos, err)
+			}
+			if sql != "" && !state.XA.Buffer(sql) {
 				binlogInfo.Sqls = append(binlogInfo.Sqls, sql)
 			}
 
@@ -118,10 +198,20 @@ func analyzeBinlogFile(fileName string, binlogDir string, parser *replication.Bi
 		return nil
 	}
 
-	// 解析 binlog 文件
-	err := parser.ParseFile(binlogDir+"/"+fileName, 0, onEvent)
-	if err != nil {
-		return nil, err
+	// 解析 binlog 文件, 行事件需要按 TableMap 和 DDL 的顺序处理, 这里读取原始事件
+	reader := binlog.NewFileReader(binlogDir, []string{fileName}, nil)
+	defer reader.Close()
+	for {
+		ev, _, err := reader.NextEvent(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := onEvent(ev); err != nil {
+			return nil, err
+		}
 	}
 
 	return binlogInfo, nil
@@ -162,7 +252,7 @@ func extractTableName(sql string) (string, error) {
 	return "", fmt.Errorf("could not extract table name from SQL: %s", sql)
 }
 
-func GetBinlogInfo(db *sql.DB, optionBinlogDir string, options *model.DaemonOptions) error {
+func GetBinlogInfo(db *sql.DB, optionBinlogDir string, options *model.DaemonOptions, out *outputWriter) error {
 	var (
 		err       error
 		binlogDir string
@@ -185,28 +275,28 @@ func GetBinlogInfo(db *sql.DB, optionBinlogDir string, options *model.DaemonOpti
 		return err
 	}
 
-	// 初始化 binlog 解析器
-	parser := replication.NewBinlogParser()
-	parser.SetVerifyChecksum(true)
-	fmt.Printf("| binlog file name | start time | end time | (tables included file)\n")
-	for _, binlogFile := range binlogFiles {
-		binlogInfo, err := analyzeBinlogFile(binlogFile, binlogDir, parser, db, options)
-		if err != nil {
-			log.Printf("Error analyzing binlog file %s: %v", binlogFile, err)
-			continue
+	out.Write("| binlog file name | start time | end time | (tables included file)\n")
+	// 多个文件并发解析, 按文件顺序输出
+	return parallelFiles(binlogFiles, options.BinlogSql.Workers, func(binlogFile string) binlogFileResult {
+		return analyzeBinlogFileResult(binlogFile, binlogDir, db, options, nil)
+	}, func(binlogFile string, result binlogFileResult) error {
+		if result.err != nil {
+			log.Printf("Error analyzing binlog file %s: %v", binlogFile, result.err)
+			return nil
 		}
+		binlogInfo := result.info
 
 		// 打印 binlog 文件的信息
-		fmt.Printf("| %s | %s | %s |\n", binlogInfo.Name, binlogInfo.StartTime.Format("2006-01-02 15:04:05.000"), binlogInfo.EndTime.Format("2006-01-02 15:04:05.000"))
-		fmt.Printf("----------------------------------------------------------------------\n")
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("| %s | %s | %s |\n", binlogInfo.Name, binlogInfo.StartTime.Format("2006-01-02 15:04:05.000"), binlogInfo.EndTime.Format("2006-01-02 15:04:05.000")))
+		sb.WriteString("----------------------------------------------------------------------\n")
 		for dbTable := range binlogInfo.DbTableMap {
-			fmt.Printf("\t%s\n", dbTable)
+			sb.WriteString(fmt.Sprintf("\t%s\n", dbTable))
 		}
-		fmt.Printf("----------------------------------------------------------------------\n")
-		fmt.Println()
-
-	}
-	return nil
+		sb.WriteString("----------------------------------------------------------------------\n\n")
+		out.Write(sb.String())
+		return nil
+	})
 }
 
 func getBinlogDirectory(db *sql.DB) (string, error) {
@@ -235,26 +325,79 @@ func getBinlogDirectory(db *sql.DB) (string, error) {
 
 }
 
-func GetBinlogSql(db *sql.DB, binlogFile string, options *model.DaemonOptions) error {
-	parser := replication.NewBinlogParser()
-	parser.SetVerifyChecksum(true)
-	binlogInfo, err := analyzeBinlogFile(binlogFile, options.BinlogSql.BinlogDir, parser, db, options)
-	if err != nil {
-		log.Printf("Error analyzing binlog file %s: %v", binlogFile, err)
-		return err
+func GetBinlogSql(db *sql.DB, binlogFile string, options *model.DaemonOptions, state *parseState) error {
+	result := analyzeBinlogFileResult(binlogFile, options.BinlogSql.BinlogDir, db, options, state)
+	if result.err != nil {
+		log.Printf("Error analyzing binlog file %s: %v", binlogFile, result.err)
+		return result.err
+	}
+	return printBinlogSqls(state.Out, result.info)
+}
+
+// GetBinlogSqlFiles 并发解析多个 binlog 文件, 按 binlog 顺序输出 sql.
+// flashback 反向 DDL 和 binlog-base64 依赖前面文件的解析状态, 这两种情况按顺序逐个解析.
+// 并发解析时每个文件使用独立的解析状态, 事务不会跨文件, 表映射只在文件内有效; 但如果文件结束时还有 XA 分支没有 COMMIT/ROLLBACK,
+// 后面的文件需要该文件的 XA 状态, 从下一个文件开始丢弃并发解析的结果, 带着该状态按顺序重新解析
+func GetBinlogSqlFiles(db *sql.DB, binlogFiles []string, options *model.DaemonOptions, state *parseState) error {
+	workers := options.BinlogSql.Workers
+	if options.BinlogSql.Format == FormatBinlogBase64 || (options.BinlogSql.Mode == "flashback" && options.BinlogSql.DDL != "false") {
+		workers = 1
 	}
+	// sequential 只在按顺序调用的 emit 中读写
+	sequential := workers <= 1
+	return parallelFiles(binlogFiles, workers, func(binlogFile string) binlogFileResult {
+		fileState := state
+		if workers > 1 {
+			// 每个文件都从事务边界开始, GTID 过滤状态可以按文件独立
+			var err error
+			if fileState, err = newParseState(db, options); err != nil {
+				return binlogFileResult{err: err}
+			}
+		}
+		return analyzeBinlogFileResult(binlogFile, options.BinlogSql.BinlogDir, db, options, fileState)
+	}, func(binlogFile string, result binlogFileResult) error {
+		if sequential && result.state != state {
+			result = analyzeBinlogFileResult(binlogFile, options.BinlogSql.BinlogDir, db, options, state)
+		}
+		if result.err != nil {
+			log.Printf("Error analyzing binlog file %s: %v", binlogFile, result.err)
+			fmt.Printf("parse sql from binlog file %s error\n", binlogFile)
+			return result.err
+		}
+		if options.Ctx != nil && options.Ctx.Err() != nil {
+			// 收到退出信号, 停止解析后续文件
+			return options.Ctx.Err()
+		}
+		if !sequential && result.state.XA.Open() {
+			log.Info().Msgf("XA branch is still open at the end of %s, parse the following files in order", binlogFile)
+			state.XA = result.state.XA
+			sequential = true
+		}
+		return printBinlogSqls(state.Out, result.info)
+	})
+}
 
-	// 打印 或输出 解析到的sql
+type binlogFileResult struct {
+	info  *BinlogInfo
+	state *parseState // 解析文件使用的状态
+	err   error
+}
+
+// analyzeBinlogFileResult 使用独立的解析器分析一个文件, 可以在多个协程中同时调用
+func analyzeBinlogFileResult(binlogFile, binlogDir string, db *sql.DB, options *model.DaemonOptions, state *parseState) binlogFileResult {
+	info, err := analyzeBinlogFile(binlogFile, binlogDir, db, options, state)
+	return binlogFileResult{info: info, state: state, err: err}
+}
+
+// printBinlogSqls 打印 或输出 解析到的sql
+func printBinlogSqls(out *outputWriter, binlogInfo *BinlogInfo) error {
+	if err := out.SetBinlogFile(binlogInfo.Name); err != nil {
+		return err
+	}
 	for _, sql := range binlogInfo.Sqls {
-		if options.BinlogSql.OutFile == "" {
-			fmt.Printf("%s\n", sql)
-		} else {
-			err := AppendToFile(options.BinlogSql.OutFile, sql)
-			if err != nil {
-				log.Error().Err(err).Msg("append SQL to output file failed")
-			}
+		if err := out.WriteString(sql + "\n"); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
@@ -6,26 +6,121 @@ import (
 	"errors"
 	"example.com/m/v2/common"
 	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
 	"fmt"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/rs/zerolog/log"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 )
 
-type Column struct {
-	Name string // 列名
-	Type string // 数据类型
+// parseState 保存解析 binlog 事件流时跨事件的状态
+type parseState struct {
+	Table   binlog.Table // 当前事务最后一个事件的库表, 用于过滤 XID 事件
+	Decoder *binlog.Decoder
+	Tracker *schemaTracker
+	GTIDSet mysql.GTIDSet // --gtid 指定的事务集合, nil 表示不过滤
+	SkipTrx bool          // 当前事务不在 GTIDSet 中, 跳过直到事务结束
+	Base64  *base64Encoder
+	Out     *outputWriter
+	Masker  *common.Masker // --mask 指定的字段脱敏规则, nil 表示不脱敏
+	Where   *rowFilter     // --where 指定的行过滤条件, nil 表示不过滤
+	XA      *xaTracker
 }
 
-type TableSchema struct {
-	DbName    string
-	TableName string
-	Columns   []Column
+func newParseState(db *sql.DB, options *model.DaemonOptions) (*parseState, error) {
+	state := &parseState{
+		Decoder: binlog.NewDecoder(binlog.NewDBSchema(db)),
+		Tracker: newSchemaTracker(),
+		Base64:  newBase64Encoder(),
+		XA:      newXATracker(),
+	}
+	if options.BinlogSql.GTIDSet != "" {
+		gtidSet, err := mysql.ParseMysqlGTIDSet(options.BinlogSql.GTIDSet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gtid set %s: %v", options.BinlogSql.GTIDSet, err)
+		}
+		state.GTIDSet = gtidSet
+	}
+	if options.BinlogSql.Where != "" {
+		where, err := newRowFilter(options.BinlogSql.Where, options.BinlogSql.WhereImage)
+		if err != nil {
+			return nil, err
+		}
+		state.Where = where
+	}
+	if options.BinlogSql.Mask != "" {
+		rules, err := common.ParseMaskRules(options.BinlogSql.Mask)
+		if err != nil {
+			return nil, err
+		}
+		if state.Masker, err = common.NewMasker(common.MaskConfig{Salt: options.BinlogSql.MaskSalt, Rules: rules}); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// trackGTID 在 GTID 事件处判断后续事务是否需要跳过
+func (state *parseState) trackGTID(e *replication.GTIDEvent) {
+	if state.GTIDSet == nil {
+		return
+	}
+	next, err := e.GTIDNext()
+	if err != nil {
+		log.Warn().Err(err).Msg("decode gtid event failed")
+		state.SkipTrx = false
+		return
+	}
+	state.SkipTrx = !state.GTIDSet.Contain(next)
+}
+
+// inTimeRange 判断事件是否在 --startTime/--stopTime 范围内
+func inTimeRange(options *model.DaemonOptions, eventTime time.Time) bool {
+	if options.BinlogSql.StartTime != "" && eventTime.Before(parseTime(options.BinlogSql.StartTime)) {
+		return false
+	}
+	if options.BinlogSql.StopTime != "" && eventTime.After(parseTime(options.BinlogSql.StopTime)) {
+		return false
+	}
+	return true
+}
+
+// tableSelected 判断库表是否满足 --db/--table 过滤
+func tableSelected(options *model.DaemonOptions, dbName, tableName string) bool {
+	return (options.BinlogSql.DBName == "" || dbName == options.BinlogSql.DBName) &&
+		(options.BinlogSql.TableName == "" || tableName == options.BinlogSql.TableName)
+}
+
+// eventSelected 判断事件是否通过时间、GTID和库表过滤, 用于按原始事件输出的格式
+func eventSelected(options *model.DaemonOptions, ev *replication.BinlogEvent, state *parseState) bool {
+	if !inTimeRange(options, time.Unix(int64(ev.Header.Timestamp), 0)) || state.SkipTrx {
+		return false
+	}
+	switch e := ev.Event.(type) {
+	case *replication.RowsEvent:
+		return tableSelected(options, string(e.Table.Schema), string(e.Table.Table))
+	case *replication.QueryEvent:
+		query := string(e.Query)
+		if binlog.IsDDL(query) {
+			if options.BinlogSql.DDL == "false" {
+				return false
+			}
+			dbName, tableName := binlog.ParseDDL(query)
+			return tableSelected(options, dbName, tableName)
+		}
+		// 语句格式的 DML, 表名不带库名时使用当前库
+		if dbName, tableName, ok := binlog.ParseDML(query); ok {
+			if dbName == "" {
+				dbName = string(e.Schema)
+			}
+			return tableSelected(options, dbName, tableName)
+		}
+	}
+	return false
 }
 
 func Run(options *model.DaemonOptions, _args []string) error {
@@ -45,48 +140,94 @@ func Run(options *model.DaemonOptions, _args []string) error {
 	var db *sql.DB
 	var err error
 	var version string
-	var ctx context.Context
-	var cancel context.CancelFunc
 
-	if options.BinlogSql.StopNever == "false" || options.BinlogSql.StopNever == "0" {
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	} else {
-		ctx = context.Background()
+	// options.Ctx 在收到 SIGINT/SIGTERM 时取消, 解析循环退出后由 defer 刷新并关闭输出
+	parent := options.Ctx
+	if parent == nil {
+		parent = context.Background()
 	}
-
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel() // 确保在函数结束时释放资源
 
-	//输入参数检查
-	if host != "" && port != 0 && user != "" && password != "" {
-		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, dbName)
-		db, err = sql.Open("mysql", dsn)
-		if err != nil {
-			log.Error().Err(err).Msg(fmt.Sprintf("connection to mysql '%s' failed ", dsn))
-			return err
-		}
-		version, err = model.GetMysqlVersion(db)
-		if err != nil {
-			fmt.Printf("get mysql version error:%v\n", err)
-		}
+	//模式 verify/decommission/capacity, 指定 --binlogDir 且未给出连接信息时只读本地文件, 不需要连接 MySQL
+	offline := (options.BinlogSql.Mode == "verify" || options.BinlogSql.Mode == "decommission" || options.BinlogSql.Mode == "capacity") && options.BinlogSql.BinlogDir != "" && host == ""
 
-		defer db.Close()
-		if outFile != "" {
-			err := CreateFile(outFile)
+	//输入参数检查
+	if !offline {
+		if host != "" && port != 0 && user != "" && password != "" {
+			dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, dbName)
+			db, err = sql.Open("mysql", dsn)
+			if err != nil {
+				log.Error().Err(err).Msg(fmt.Sprintf("connection to mysql '%s' failed ", dsn))
+				return err
+			}
+			version, err = model.GetMysqlVersion(db)
 			if err != nil {
-				return errors.New(fmt.Sprintf("output file %s check not pass: %v", err))
+				fmt.Printf("get mysql version error:%v\n", err)
 			}
+
+			defer db.Close()
+		} else {
+			fmt.Printf("action %s must give ip,port,user,password, and the user must have replication slave,replication client ,super privileges\n", options.ActionType)
+			return errors.New("options given error")
 		}
-	} else {
-		fmt.Printf("action %s must give ip,port,user,password, and the user must have replication slave,replication client ,super privileges\n", options.ActionType)
-		return errors.New("options given error")
 	}
 
+	switch options.BinlogSql.Format {
+	case FormatSQL:
+	case FormatBinlogBase64:
+		if options.BinlogSql.Mode == "flashback" {
+			return errors.New("format binlog-base64 can not be used in flashback mode")
+		}
+	default:
+		return fmt.Errorf("unsupported output format: %s", options.BinlogSql.Format)
+	}
+	// binlog-base64 和 extract 输出原始事件, 无法对字段脱敏或按行过滤
+	if (options.BinlogSql.Mask != "" || options.BinlogSql.Where != "") && (options.BinlogSql.Format == FormatBinlogBase64 || options.BinlogSql.Mode == "extract") {
+		return errors.New("--mask and --where can not be used with format binlog-base64 or extract mode")
+	}
+
+	state, err := newParseState(db, options)
+	if err != nil {
+		return err
+	}
+
+	out, err := newOutputWriter(options)
+	if err != nil {
+		return fmt.Errorf("output file %s check not pass: %v", outFile, err)
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			log.Error().Err(err).Msg("close output failed")
+		}
+	}()
+	state.Out = out
+
 	//模式 stat, 统计binlog文件有哪些表有写入
 	if options.BinlogSql.Mode == "stat" {
-		err := GetBinlogInfo(db, options.BinlogSql.BinlogDir, options)
+		err := GetBinlogInfo(db, options.BinlogSql.BinlogDir, options, out)
 		return err
 	}
 
+	//模式 decommission, 统计每个表最后一次写入时间
+	if options.BinlogSql.Mode == "decommission" {
+		return GetDecommissionReport(db, options, out)
+	}
+
+	//模式 verify, 检查 binlog 文件完整性
+	if options.BinlogSql.Mode == "verify" {
+		return VerifyBinlog(db, options, out)
+	}
+
+	defer func() {
+		if footer := state.Base64.Footer(); footer != "" {
+			out.Write(footer)
+		}
+		for _, line := range state.XA.Finish() {
+			out.Write(line + "\n")
+		}
+	}()
+
 	cfg := replication.BinlogSyncerConfig{
 		ServerID: uint32(serverID),
 		Flavor:   "mysql",
@@ -96,17 +237,45 @@ func Run(options *model.DaemonOptions, _args []string) error {
 		Password: password,
 		Charset:  charset,
 		Logger:   &NoOpLogger{},
+		// 心跳用于发现断开的连接, 超过两个心跳周期没有收到数据认为连接已断开
+		HeartbeatPeriod: time.Duration(options.BinlogSql.Heartbeat) * time.Second,
+		ReadTimeout:     2 * time.Duration(options.BinlogSql.Heartbeat) * time.Second,
+		// 由 binlogStream 在事务边界重连, 不使用 go-mysql 从事务中间位置重连
+		DisableRetrySync: true,
 	}
 
-	syncer := replication.NewBinlogSyncer(cfg)
-
-	defer syncer.Close()
+	//模式 capacity, 统计 binlog 增长速度和保留容量
+	if options.BinlogSql.Mode == "capacity" {
+		return GetCapacityReport(ctx, db, cfg, options, out)
+	}
 
 	position := mysql.Position{
 		Name: startFile,
 		Pos:  uint32(startPose),
 	}
 
+	// 只指定 --startTime 时按文件的第一个事件时间二分查找开始的文件和位置
+	if startFile == "" && options.BinlogSql.StartTime != "" {
+		startTime := parseTime(options.BinlogSql.StartTime)
+		binlogFiles, err := getBinlogFiles(db, options.BinlogSql.BinlogDir)
+		if err != nil {
+			return err
+		}
+		if options.BinlogSql.BinlogDir != "" {
+			position, err = findStartPositionLocal(options.BinlogSql.BinlogDir, binlogFiles, startTime)
+		} else {
+			position, err = findStartPositionOnline(ctx, cfg, binlogFiles, startTime)
+		}
+		if err != nil {
+			return fmt.Errorf("find start position of %s failed: %v", options.BinlogSql.StartTime, err)
+		}
+		log.Info().Msgf("start time %s found at %s:%d", options.BinlogSql.StartTime, position.Name, position.Pos)
+	}
+
+	if options.BinlogSql.Mode == "extract" {
+		return ExtractBinlog(ctx, db, cfg, position, options, state)
+	}
+
 	if strings.HasPrefix(version, "5.5") {
 		if options.BinlogSql.BinlogDir == "" {
 			errMsg := fmt.Sprintf("The 5.5 version must give the binglog directory by --binlogDir")
@@ -120,63 +289,56 @@ func Run(options *model.DaemonOptions, _args []string) error {
 			return err
 		}
 
-		// 初始化 binlog 解析器
-		parser := replication.NewBinlogParser()
-		parser.SetVerifyChecksum(true)
-		for _, binFile := range binlogFiles {
-			err := GetBinlogSql(db, binFile, options)
-			if err != nil {
-				fmt.Printf("parse sql from binlog file %s error\n", binFile)
-				return err
-			}
-		}
-		return nil
+		// 多个文件并发解析, 按 binlog 顺序输出
+		return GetBinlogSqlFiles(db, binlogFiles, options, state)
 	} else {
-		streamer, err := syncer.StartSync(position)
+		stream, err := newBinlogStream(db, cfg, position, options, state)
 		if err != nil {
-			log.Error().Err(err)
 			return err
 		}
-		var schema TableSchema
-		for {
-			ev, err := streamer.GetEvent(ctx)
-
-			if err != nil {
-				// 检查是否是超时导致的退出
-				if errors.Is(err, context.DeadlineExceeded) {
-					log.Info().Msg(fmt.Sprintf("Context deadline exceeded: exiting binlog stream."))
-					return nil
-				}
-				//GTID切换导致匿名事务解析异常，需要reset master
-				if strings.Contains(err.Error(), "Cannot replicate anonymous transaction") {
-					log.Warn().Msg("Skipping anonymous transaction due to GTID_MODE enforcement")
-					position = syncer.GetNextPosition() // 跳到下一个 binlog 位点
-					return err
-				}
-
-				// 处理其他错误
-				log.Info().Msg(fmt.Sprintf("Error in binlog streaming: %v\n", err))
-				return err
-			}
+		return stream.Run(ctx)
+	}
+}
 
-			err = ParseBinlogSQL(db, ev, options, syncer.GetNextPosition().Name, &schema)
-			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("parse binlog to sql err."))
-			}
+func ParseBinlogSQL(db *sql.DB, ev *replication.BinlogEvent, options *model.DaemonOptions, fileName string, state *parseState) error {
+	schema := &state.Table
+	out := state.Out
+	if err := out.SetBinlogFile(fileName); err != nil {
+		return err
+	}
+	if e, ok := ev.Event.(*replication.GTIDEvent); ok {
+		state.trackGTID(e)
+		state.Decoder.Decode(ev, fileName)
+	}
+	if options.BinlogSql.Format == FormatBinlogBase64 {
+		if encoded := state.Base64.Encode(ev, fileName, eventSelected(options, ev, state), state.XA); encoded != "" {
+			out.Write(encoded)
 		}
+		return nil
 	}
 
-}
-
-func ParseBinlogSQL(db *sql.DB, ev *replication.BinlogEvent, options *model.DaemonOptions, fileName string, schema *TableSchema) error {
 	eventTime := time.Unix(int64(ev.Header.Timestamp), 0)
-	if (options.BinlogSql.StartTime != "" && eventTime.Before(parseTime(options.BinlogSql.StartTime))) || (options.BinlogSql.StopTime != "" && eventTime.After(parseTime(options.BinlogSql.StopTime))) {
+	if !inTimeRange(options, eventTime) {
 		//continue
 		return nil
 	}
+	if state.SkipTrx {
+		if _, ok := ev.Event.(*replication.XIDEvent); ok {
+			state.SkipTrx = false
+		}
+		return nil
+	}
 
 	transactionID := ev.Header.LogPos
 
+	// XA 分支的 sql 缓存到 XA COMMIT 时输出, XA ROLLBACK 的分支不输出
+	if xaOut, ok := state.XA.Handle(ev, fileName); ok {
+		for _, line := range xaOut {
+			out.Write(line + "\n")
+		}
+		return nil
+	}
+
 	switch e := ev.Event.(type) {
 	case *replication.QueryEvent:
 		// 检查是否是事务开始的 QueryEvent
@@ -187,46 +349,51 @@ func ParseBinlogSQL(db *sql.DB, ev *replication.BinlogEvent, options *model.Daem
 		}
 
 		// 如果是DDL语句，检查是否作用于指定的db和table
-		if IsDDL(string(e.Query)) {
-			schema.DbName, schema.TableName = ParseDDL(string(e.Query))
-			if (options.BinlogSql.DBName != "" && schema.DbName != options.BinlogSql.DBName) || (options.BinlogSql.TableName != "" && schema.TableName != options.BinlogSql.TableName) {
+		if binlog.IsDDL(string(e.Query)) {
+			// DDL 之后的行事件重新查询表结构
+			if _, err := state.Decoder.Decode(ev, fileName); err != nil {
+				return err
+			}
+			schema.Schema, schema.Name = binlog.ParseDDL(string(e.Query))
+			if !tableSelected(options, schema.Schema, schema.Name) {
 				//continue
 				return nil
 			}
 		}
-		if options.BinlogSql.DDL != "false" {
-			if options.BinlogSql.OutFile != "" {
-				err := AppendToFile(options.BinlogSql.OutFile, string(e.Query))
-				if err != nil {
-					log.Error().Err(err).Msg("append SQL to output file failed")
-				}
-			} else {
-				fmt.Printf("/*%s:%d, Executed At: %s*/\n %s;\n", fileName, transactionID, eventTime.Format("2006-01-02 15:04:05"), e.Query)
+		if options.BinlogSql.DDL != "false" && options.BinlogSql.Mode == "flashback" {
+			// flashback 模式不能原样输出 DDL, 只输出可推导的反向 DDL 和不可逆警告
+			if !binlog.IsDDL(string(e.Query)) {
+				return nil
 			}
+			reverse := fmt.Sprintf("/*%s:%d, Executed At: %s*/\n%s\n", fileName, transactionID, eventTime.Format("2006-01-02 15:04:05"),
+				strings.Join(state.Tracker.ReverseDDL(string(e.Schema), string(e.Query), fileName, transactionID), "\n"))
+			out.Write(reverse)
+		} else if options.BinlogSql.DDL != "false" {
+			out.Write(fmt.Sprintf("/*%s:%d, Executed At: %s*/\n %s;\n", fileName, transactionID, eventTime.Format("2006-01-02 15:04:05"), e.Query))
 		}
 		return nil
 
 	case *replication.RowsEvent:
-		schema.DbName = string(e.Table.Schema)
-		schema.TableName = string(e.Table.Table)
+		schema.Schema = string(e.Table.Schema)
+		schema.Name = string(e.Table.Table)
 
-		if (options.BinlogSql.DBName != "" && schema.DbName != options.BinlogSql.DBName) || (options.BinlogSql.TableName != "" && schema.TableName != options.BinlogSql.TableName) {
+		if !tableSelected(options, schema.Schema, schema.Name) {
 			//continue
 			return nil
 		}
 
-		sql, err := generateSQL(db, ev.Header.EventType, e, options.BinlogSql.Mode, transactionID, eventTime, fileName)
+		change, err := state.Decoder.Decode(ev, fileName)
+		if err != nil {
+			log.Error().Err(err).Msg("Error decoding rows event")
+			return err
+		}
+		sql, err := generateSQL(change, options.BinlogSql.Mode, state)
 		if err != nil {
 			log.Error().Err(err).Msg("Error generating SQL")
 			return err
 		}
-		if options.BinlogSql.OutFile != "" {
-			err := AppendToFile(options.BinlogSql.OutFile, sql)
-			if err != nil {
-				log.Error().Err(err).Msg("append SQL to output file failed")
-			}
-		} else {
-			fmt.Printf("%s\n", sql)
+		if sql != "" && !state.XA.Buffer(sql) {
+			out.Write(sql + "\n")
 		}
 		return nil
 
@@ -236,31 +403,24 @@ func ParseBinlogSQL(db *sql.DB, ev *replication.BinlogEvent, options *model.Daem
 		}
 		rotate := fmt.Sprintf("Rotate to %s, pos %d\n", e.NextLogName, e.Position)
 		if options.BinlogSql.RotateFlag != "false" {
-			if options.BinlogSql.OutFile != "" {
-				err := AppendToFile(options.BinlogSql.OutFile, rotate)
-				if err != nil {
-					log.Error().Err(err).Msg("append SQL to output file failed")
-				}
-			} else {
-				fmt.Printf("-- %s\n", rotate)
-			}
+			out.Write(fmt.Sprintf("-- %s\n", rotate))
 		}
 		return nil
 
 	case *replication.XIDEvent:
-		if (options.BinlogSql.DBName != "" && schema.DbName != options.BinlogSql.DBName) || (options.BinlogSql.TableName != "" && schema.TableName != options.BinlogSql.TableName) {
+		if !tableSelected(options, schema.Schema, schema.Name) {
 			//continue
-			schema.DbName = ""
-			schema.TableName = ""
+			schema.Schema = ""
+			schema.Name = ""
 			return nil
 		}
-		fmt.Printf("/* Xid=%d, Position=%d */\n", e.XID, ev.Header.LogPos)
+		out.Write(fmt.Sprintf("/* Xid=%d, Position=%d */\n", e.XID, ev.Header.LogPos))
 		return nil
 
 	case *replication.GTIDEvent:
 		uuid := FormatGTID(e.SID)
 		gtid := fmt.Sprintf("%s:%d", uuid, e.GNO) // GTID 格式：UUID:GNO
-		fmt.Printf("/* GTID %s */\n", gtid)
+		out.Write(fmt.Sprintf("/* GTID %s */\n", gtid))
 		return nil
 
 	default:
@@ -271,30 +431,6 @@ func ParseBinlogSQL(db *sql.DB, ev *replication.BinlogEvent, options *model.Daem
 
 }
 
-func IsDDL(query string) bool {
-	ddlRegex := regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|RENAME|TRUNCATE)\s+`)
-	return ddlRegex.MatchString(query)
-}
-
-func ParseDDL(query string) (string, string) {
-	// 假设DDL语句的格式为: CREATE TABLE db.table (...), ALTER TABLE db.table ..., DROP TABLE db.table ...
-	ddlRegex := regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|RENAME|TRUNCATE)\s+(TABLE\s+)?(?P<db>\w+)\.(?P<table>\w+)`)
-	match := ddlRegex.FindStringSubmatch(query)
-
-	if len(match) == 0 {
-		return "", ""
-	}
-
-	paramsMap := make(map[string]string)
-	for i, name := range ddlRegex.SubexpNames() {
-		if i != 0 && name != "" {
-			paramsMap[name] = match[i]
-		}
-	}
-
-	return paramsMap["db"], paramsMap["table"]
-}
-
 func parseTime(timeStr string) time.Time {
 	t, err := time.Parse("2006-01-02 15:04:05", timeStr)
 	if err != nil {
@@ -304,74 +440,74 @@ func parseTime(timeStr string) time.Time {
 	return t
 }
 
-func generateSQL(db *sql.DB, eventType replication.EventType, e *replication.RowsEvent, mode string, transactionID uint32, eventTime time.Time, fileName string) (string, error) {
-	schema := string(e.Table.Schema)
-	table := string(e.Table.Table)
-
-	tableColumn, err := getColumn(db, schema, table)
-	if err != nil {
-		return "", err
+// generateSQL 生成行变更的 SQL, --where 过滤后没有行时返回空串
+func generateSQL(change *binlog.Change, mode string, state *parseState) (string, error) {
+	// 先按原始值过滤再脱敏
+	rows := change.Rows
+	if state.Where != nil {
+		if rows = state.Where.Filter(change.Table.Columns, rows); len(rows) == 0 {
+			return "", nil
+		}
 	}
+	maskRows(change.Table, rows, state.Masker)
 
 	var sqls []string
-	switch eventType {
-	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+	switch change.Type {
+	case binlog.Insert:
 		if mode == "flashback" {
-			sqls = generateDeleteSQL(tableColumn, e.Rows)
+			sqls = generateDeleteSQL(change.Table, rows)
 		} else {
-			sqls = generateInsertSQL(tableColumn, e.Rows)
+			sqls = generateInsertSQL(change.Table, rows)
 		}
-	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+	case binlog.Update:
 		if mode == "flashback" {
-			sqls = generateReverseUpdateSQL(tableColumn, e.Rows)
+			sqls = generateReverseUpdateSQL(change.Table, rows)
 		} else {
-			sqls = generateUpdateSQL(tableColumn, e.Rows)
+			sqls = generateUpdateSQL(change.Table, rows)
 		}
-	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+	case binlog.Delete:
 		if mode == "flashback" {
-			sqls = generateInsertSQL(tableColumn, e.Rows)
+			sqls = generateInsertSQL(change.Table, rows)
 		} else {
-			sqls = generateDeleteSQL(tableColumn, e.Rows)
+			sqls = generateDeleteSQL(change.Table, rows)
 		}
 	default:
-		return "", fmt.Errorf("unsupported event type: %v", eventType)
+		return "", fmt.Errorf("unsupported change type: %v", change.Type)
 	}
 
-	// 将事务 ID 和执行时间添加到每条 SQL 语句中
+	// 将事务 ID 和执行时间添加到每条 SQL 语句中, XA 分支中的语句带上 xid
+	xa := ""
+	if xid := state.XA.XID(); xid != "" {
+		xa = ", XA: " + xid
+	}
 	for i, sql := range sqls {
-		sqls[i] = fmt.Sprintf("/*%s:%d, Executed At: %s*/\n%s", fileName, transactionID, eventTime.Format("2006-01-02 15:04:05"), sql)
+		sqls[i] = fmt.Sprintf("/*%s:%d, Executed At: %s%s*/\n%s", change.Position.Name, change.Position.Pos, change.Timestamp.Format("2006-01-02 15:04:05"), xa, sql)
 	}
 
 	return strings.Join(sqls, "\n"), nil
 }
 
-func getColumn(db *sql.DB, schema, table string) (TableSchema, error) {
-	var tableColumn TableSchema
-	var column Column
-	if db == nil {
-		return tableColumn, fmt.Errorf("database connection is not available")
+// maskRows 在生成子句前按 --mask 规则替换字段值, 脱敏后的 SQL 只用于查看, 不能回放
+func maskRows(table *binlog.Table, rows []binlog.Row, masker *common.Masker) {
+	if masker == nil {
+		return
 	}
-	tableColumn.DbName = schema
-	tableColumn.TableName = table
-	query := "SELECT COLUMN_NAME,DATA_TYPE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION;"
-	rows, err := db.Query(query, schema, table)
-	if err != nil {
-		return tableColumn, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		if err := rows.Scan(&column.Name, &column.Type); err != nil {
-			return tableColumn, err
+	mask := func(values []interface{}) {
+		for i, value := range values {
+			if i >= len(table.Columns) {
+				break
+			}
+			values[i] = masker.Mask(table.Schema, table.Name, table.Columns[i].Name, value)
 		}
-
-		tableColumn.Columns = append(tableColumn.Columns, column)
 	}
-	return tableColumn, nil
+	for _, row := range rows {
+		mask(row.Before)
+		mask(row.After)
+	}
 }
 
 // 生成列-值子句的通用函数
-func generateClauses(columnNames []Column, values []interface{}, insertFlag bool) []string {
+func generateClauses(columnNames []binlog.Column, values []interface{}, insertFlag bool) []string {
 	clauses := []string{}
 
 	for i, value := range values {
@@ -390,6 +526,12 @@ func generateClauses(columnNames []Column, values []interface{}, insertFlag bool
 				}
 				clause = fmt.Sprintf("%s='%v'", columnNames[i].Name, v)
 			}
+		} else if valType == "binary" {
+			if insertFlag {
+				clause = fmt.Sprintf("X'%s'", v)
+			} else {
+				clause = fmt.Sprintf("%s=X'%s'", columnNames[i].Name, v)
+			}
 		} else if valType == "int" {
 			if insertFlag {
 				clause = fmt.Sprintf("%v", v)
@@ -414,59 +556,55 @@ func generateClauses(columnNames []Column, values []interface{}, insertFlag bool
 	return clauses
 }
 
-func generateInsertSQL(tableColumn TableSchema, rows [][]interface{}) []string {
+func generateInsertSQL(table *binlog.Table, rows []binlog.Row) []string {
 	var sqls []string
 	var columnNames []string
-	for _, colName := range tableColumn.Columns {
+	for _, colName := range table.Columns {
 		columnNames = append(columnNames, colName.Name)
 	}
 	columns := strings.Join(columnNames, ", ")
 
-	// 用来存储所有行的 VALUES 子句
+	// 用来存储所有行的 VALUES 子句, insert 取后镜像, flashback delete 取前镜像
 	var valuesClauses []string
 	for _, row := range rows {
-		values := generateClauses(tableColumn.Columns, row, true)
+		values := generateClauses(table.Columns, row.Image(), true)
 		valuesClause := fmt.Sprintf("(%s)", strings.Join(values, ", "))
 		valuesClauses = append(valuesClauses, valuesClause)
 	}
 
 	// 将所有 VALUES 子句拼接成一条 SQL 语句
-	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s;", tableColumn.TableName, columns, strings.Join(valuesClauses, ", "))
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s;", table.Name, columns, strings.Join(valuesClauses, ", "))
 	sqls = append(sqls, sql)
 	return sqls
 }
 
-func generateUpdateSQL(tableColumn TableSchema, rows [][]interface{}) []string {
+func generateUpdateSQL(table *binlog.Table, rows []binlog.Row) []string {
 	var sqls []string
-	for i := 0; i < len(rows); i += 2 {
-		before := rows[i]
-		after := rows[i+1]
-		setClauses := generateClauses(tableColumn.Columns, after, false)
-		whereClauses := generateClauses(tableColumn.Columns, before, false)
-		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", tableColumn.TableName, strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
+	for _, row := range rows {
+		setClauses := generateClauses(table.Columns, row.After, false)
+		whereClauses := generateClauses(table.Columns, row.Before, false)
+		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", table.Name, strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
 		sqls = append(sqls, sql)
 	}
 	return sqls
 }
 
-func generateReverseUpdateSQL(tableColumn TableSchema, rows [][]interface{}) []string {
+func generateReverseUpdateSQL(table *binlog.Table, rows []binlog.Row) []string {
 	var sqls []string
-	for i := 0; i < len(rows); i += 2 {
-		before := rows[i]
-		after := rows[i+1]
-		setClauses := generateClauses(tableColumn.Columns, before, false)
-		whereClauses := generateClauses(tableColumn.Columns, after, false)
-		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", tableColumn.TableName, strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
+	for _, row := range rows {
+		setClauses := generateClauses(table.Columns, row.Before, false)
+		whereClauses := generateClauses(table.Columns, row.After, false)
+		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", table.Name, strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
 		sqls = append(sqls, sql)
 	}
 	return sqls
 }
 
-func generateDeleteSQL(tableColumn TableSchema, rows [][]interface{}) []string {
+func generateDeleteSQL(table *binlog.Table, rows []binlog.Row) []string {
 	var sqls []string
 	for _, row := range rows {
-		whereClauses := generateClauses(tableColumn.Columns, row, false)
-		sql := fmt.Sprintf("DELETE FROM %s WHERE %s;", tableColumn.TableName, strings.Join(whereClauses, " AND "))
+		whereClauses := generateClauses(table.Columns, row.Image(), false)
+		sql := fmt.Sprintf("DELETE FROM %s WHERE %s;", table.Name, strings.Join(whereClauses, " AND "))
 		sqls = append(sqls, sql)
 	}
 	return sqls
@@ -0,0 +1,333 @@
+package binlogsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ResumeByPos  = "pos"
+	ResumeByGTID = "gtid"
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+	checkpointInterval  = time.Second
+)
+
+// streamCheckpoint 记录最后一个完整处理的事务, 进程重启后从这里继续
+type streamCheckpoint struct {
+	File      string    `json:"file"`
+	Pos       uint32    `json:"pos"`
+	GTID      string    `json:"gtid,omitempty"`     // 最后一个事务的 GTID
+	GTIDSet   string    `json:"gtid_set,omitempty"` // 已处理的 GTID 集合, 从文件开头解析时才能得到
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func loadCheckpoint(path string) (*streamCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &streamCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", path, err)
+	}
+	return cp, nil
+}
+
+// saveCheckpoint 先写临时文件再重命名, 进程中途退出也不会留下不完整的 checkpoint
+func saveCheckpoint(path string, cp *streamCheckpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// binlogStream 通过 binlog.Reader 在线读取 binlog, --stopNever 时连接断开会按退避时间重连,
+// 重连从最后一个完整处理的事务结束位置(或 GTID 集合)开始, 已输出过的事件不会重复输出
+type binlogStream struct {
+	db      *sql.DB
+	cfg     replication.BinlogSyncerConfig
+	options *model.DaemonOptions
+	state   *parseState
+	reader  *binlog.Reader
+	rng     *streamRange
+
+	retry     bool // 出错时是否重连, 只有 --stopNever 时重连
+	resumeBy  string
+	committed mysql.Position // 最后一个完整处理的事务的结束位置
+	gtidSet   mysql.GTIDSet  // 已处理的 GTID 集合, 未知时为 nil
+	trxGTID   string         // 当前事务的 GTID
+	lastGTID  string         // 最后一个完整处理的事务的 GTID
+	inTrx     bool
+	emitted   mysql.Position // 已经输出的最后一个事件, 重连后跳过重复收到的事件
+
+	savedAt time.Time
+}
+
+func newBinlogStream(db *sql.DB, cfg replication.BinlogSyncerConfig, position mysql.Position, options *model.DaemonOptions, state *parseState) (*binlogStream, error) {
+	rng, err := newStreamRange(db, options)
+	if err != nil {
+		return nil, err
+	}
+	s := &binlogStream{
+		rng:       rng,
+		db:        db,
+		cfg:       cfg,
+		options:   options,
+		state:     state,
+		retry:     options.BinlogSql.StopNever != "false" && options.BinlogSql.StopNever != "0",
+		resumeBy:  options.BinlogSql.ResumeBy,
+		committed: position,
+	}
+	if s.resumeBy == "" {
+		s.resumeBy = ResumeByPos
+	}
+	if s.resumeBy != ResumeByPos && s.resumeBy != ResumeByGTID {
+		return nil, fmt.Errorf("unsupported resume mode: %s", s.resumeBy)
+	}
+
+	if options.BinlogSql.Checkpoint == "" {
+		return s, nil
+	}
+	cp, err := loadCheckpoint(options.BinlogSql.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	if cp != nil {
+		log.Info().Msgf("continue from checkpoint %s: %s:%d %s", options.BinlogSql.Checkpoint, cp.File, cp.Pos, cp.GTIDSet)
+		s.committed = mysql.Position{Name: cp.File, Pos: cp.Pos}
+		s.lastGTID = cp.GTID
+		if cp.GTIDSet != "" {
+			if s.gtidSet, err = mysql.ParseMysqlGTIDSet(cp.GTIDSet); err != nil {
+				return nil, fmt.Errorf("invalid gtid set in checkpoint %s: %v", options.BinlogSql.Checkpoint, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// start 从最后一个完整处理的事务开始同步, --resume=gtid 且已知 GTID 集合时按 GTID 同步
+func (s *binlogStream) start() error {
+	var err error
+	if s.resumeBy == ResumeByGTID && s.gtidSet != nil {
+		log.Info().Msgf("start binlog stream from gtid set %s", s.gtidSet.String())
+		s.reader, err = binlog.NewServerReaderGTID(s.cfg, s.gtidSet.Clone(), nil)
+		return err
+	}
+	if s.resumeBy == ResumeByGTID {
+		log.Warn().Msg("gtid set is unknown, start binlog stream by file and position")
+	}
+	log.Info().Msgf("start binlog stream from %s:%d", s.committed.Name, s.committed.Pos)
+	s.reader, err = binlog.NewServerReader(s.cfg, s.committed, nil)
+	return err
+}
+
+// reconnect 关闭旧连接, 按指数退避重新建立连接, ctx 取消或超过 --maxRetry 时返回错误
+func (s *binlogStream) reconnect(ctx context.Context, cause error) error {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		if s.options.BinlogSql.MaxRetry > 0 && attempt > s.options.BinlogSql.MaxRetry {
+			return fmt.Errorf("reconnect failed after %d retries: %v", s.options.BinlogSql.MaxRetry, cause)
+		}
+		log.Warn().Err(cause).Msgf("binlog stream broken, reconnect in %s (attempt %d)", backoff, attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		s.close()
+		err := s.start()
+		if err == nil {
+			return nil
+		}
+		cause = err
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// track 根据事件更新事务边界和已处理位置, 事务提交时返回该事务的 GTID
+func (s *binlogStream) track(ev *replication.BinlogEvent, fileName string) string {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		// 事务之间的 Rotate 也是一个完整的位置
+		if !s.inTrx {
+			s.committed = mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}
+		}
+		return ""
+	case *replication.PreviousGTIDsEvent:
+		// 从文件开头同步时可以得到之前已执行的 GTID 集合
+		if s.gtidSet == nil && !s.inTrx {
+			if set, err := mysql.ParseMysqlGTIDSet(e.GTIDSets); err == nil {
+				s.gtidSet = set
+			}
+		}
+	case *replication.GTIDEvent:
+		s.inTrx = true
+		if next, err := e.GTIDNext(); err == nil {
+			s.trxGTID = next.String()
+		}
+	case *replication.QueryEvent:
+		if strings.ToUpper(strings.TrimSpace(string(e.Query))) == "BEGIN" {
+			s.inTrx = true
+		}
+	}
+	if !isTrxEnd(ev) || ev.Header.LogPos == 0 {
+		return ""
+	}
+	s.inTrx = false
+	s.committed = mysql.Position{Name: fileName, Pos: ev.Header.LogPos}
+	gtid := s.trxGTID
+	if gtid != "" {
+		s.lastGTID = gtid
+		if s.gtidSet != nil {
+			if err := s.gtidSet.Update(gtid); err != nil {
+				log.Warn().Err(err).Msgf("update gtid set with %s failed", gtid)
+			}
+		}
+		s.trxGTID = ""
+	}
+	return gtid
+}
+
+// duplicated 判断事件是否在重连前已经输出过
+func (s *binlogStream) duplicated(ev *replication.BinlogEvent, fileName string) bool {
+	if _, ok := ev.Event.(*replication.RotateEvent); ok || ev.Header.LogPos == 0 || fileName != s.emitted.Name {
+		return false
+	}
+	return ev.Header.LogPos <= s.emitted.Pos
+}
+
+// saveCheckpoint 输出刷新后再记录 checkpoint, 保证 checkpoint 之前的结果已经写出
+func (s *binlogStream) saveCheckpoint(force bool) {
+	if s.options.BinlogSql.Checkpoint == "" || s.committed.Name == "" {
+		return
+	}
+	if !force && time.Since(s.savedAt) < checkpointInterval {
+		return
+	}
+	if err := s.state.Out.Flush(); err != nil {
+		log.Error().Err(err).Msg("flush output before checkpoint failed")
+		return
+	}
+	cp := &streamCheckpoint{File: s.committed.Name, Pos: s.committed.Pos, GTID: s.lastGTID, UpdatedAt: time.Now()}
+	if s.gtidSet != nil {
+		cp.GTIDSet = s.gtidSet.String()
+	}
+	if err := saveCheckpoint(s.options.BinlogSql.Checkpoint, cp); err != nil {
+		log.Error().Err(err).Msg("save checkpoint failed")
+		return
+	}
+	s.savedAt = time.Now()
+}
+
+// close 关闭当前的连接
+func (s *binlogStream) close() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+}
+
+// Run 读取并解析 binlog 直到 ctx 结束; 未开启 --stopNever 时出错直接返回
+func (s *binlogStream) Run(ctx context.Context) error {
+	defer s.saveCheckpoint(true)
+	// 重连后会换成新的 reader, 退出时关闭最后一个
+	defer s.close()
+
+	if s.rng.Done(s.committed) {
+		log.Info().Msgf("start position %s:%d is already the current master position", s.committed.Name, s.committed.Pos)
+		return nil
+	}
+	if err := s.start(); err != nil {
+		if !s.retry {
+			log.Error().Err(err)
+			return err
+		}
+		if err = s.reconnect(ctx, err); err != nil {
+			return err
+		}
+	}
+	lastEvent := time.Now()
+	for {
+		ev, fileName, err := s.rng.nextEvent(ctx, s.reader, lastEvent)
+
+		if err != nil {
+			// 无法获取主库位置时, 一段时间没有新事件认为已经读到最新位置
+			if errors.Is(err, errIdleStop) {
+				log.Info().Msgf("no binlog event for %s, exiting binlog stream.", idleStopTimeout)
+				return nil
+			}
+			// 收到退出信号, 正常返回以便刷新输出
+			if errors.Is(err, context.Canceled) {
+				log.Info().Msg("binlog stream canceled, exiting.")
+				return nil
+			}
+			//GTID切换导致匿名事务解析异常, 按 GTID 同步时改为按位点重连, 按位点同步时直接重连
+			if strings.Contains(err.Error(), "Cannot replicate anonymous transaction") && s.resumeBy == ResumeByGTID {
+				log.Warn().Msg("anonymous transaction found, resume by file and position")
+				s.resumeBy = ResumeByPos
+			}
+
+			// 处理其他错误
+			log.Info().Msg(fmt.Sprintf("Error in binlog streaming: %v\n", err))
+			if !s.retry {
+				return err
+			}
+			if err = s.reconnect(ctx, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ev.Header.EventType == replication.HEARTBEAT_EVENT || ev.Header.EventType == replication.HEARTBEAT_LOG_EVENT_V2 {
+			continue
+		}
+		lastEvent = time.Now()
+		if s.rng.Before(ev, fileName) {
+			log.Info().Msgf("reach the stop position or time at %s:%d, exiting binlog stream.", fileName, ev.Header.LogPos)
+			return nil
+		}
+		if !s.duplicated(ev, fileName) {
+			err = ParseBinlogSQL(s.db, ev, s.options, fileName, s.state)
+			if err != nil {
+				log.Error().Err(err).Msg(fmt.Sprintf("parse binlog to sql err."))
+			}
+			// RotateEvent 的位点属于上一个文件, 不能作为新文件的输出位置
+			if _, ok := ev.Event.(*replication.RotateEvent); !ok && ev.Header.LogPos > 0 {
+				s.emitted = mysql.Position{Name: fileName, Pos: ev.Header.LogPos}
+			}
+		}
+		committedGTID := s.track(ev, fileName)
+		if !s.inTrx {
+			s.saveCheckpoint(false)
+		}
+		if s.rng.After(ev, fileName, committedGTID) {
+			log.Info().Msgf("reach the stop gtid or master position at %s:%d, exiting binlog stream.", fileName, ev.Header.LogPos)
+			return nil
+		}
+	}
+}
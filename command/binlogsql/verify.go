@@ -0,0 +1,263 @@
+package binlogsql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/m/v2/model"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+// verify 模式发现的问题类型
+const (
+	IssueBadMagic        = "bad_magic"
+	IssueChecksum        = "checksum_mismatch"
+	IssueDecode          = "decode_error"
+	IssueTruncated       = "truncated_event"
+	IssuePosition        = "position_mismatch"
+	IssueFileGap         = "file_gap"
+	IssueGTIDGap         = "gtid_gap"
+	IssueUnterminatedTrx = "unterminated_transaction"
+)
+
+type VerifyIssue struct {
+	Type    string `json:"type"`
+	File    string `json:"file"`
+	Pos     uint32 `json:"pos"`
+	Message string `json:"message"`
+}
+
+type VerifyFileResult struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Events    int       `json:"events"`
+	Checksum  bool      `json:"checksum"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	NextFile  string    `json:"next_file,omitempty"` // 文件末尾 Rotate 事件指向的文件
+	Issues    int       `json:"issues"`
+}
+
+type VerifyReport struct {
+	BinlogDir string             `json:"binlog_dir"`
+	CheckedAt time.Time          `json:"checked_at"`
+	OK        bool               `json:"ok"`
+	Files     []VerifyFileResult `json:"files"`
+	Issues    []VerifyIssue      `json:"issues"`
+}
+
+// binlogVerifier 逐个事件检查 binlog 文件, 跨文件保存 GTID 和事务状态
+type binlogVerifier struct {
+	report  *VerifyReport
+	lastGNO map[string]int64 // server uuid -> 最后一个 GNO
+
+	trxOpen  bool
+	trxBegun bool // 事务以 BEGIN/XA START 开始, 其中的语句不会结束事务
+	trxFile  string
+	trxPos   uint32
+}
+
+func (v *binlogVerifier) addIssue(result *VerifyFileResult, issueType string, pos uint32, format string, args ...interface{}) {
+	result.Issues++
+	v.report.Issues = append(v.report.Issues, VerifyIssue{
+		Type:    issueType,
+		File:    result.Name,
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *binlogVerifier) beginTrx(fileName string, pos uint32, result *VerifyFileResult) {
+	if v.trxOpen {
+		v.addIssue(result, IssueUnterminatedTrx, pos, "transaction started at %s:%d is not terminated by XID/COMMIT", v.trxFile, v.trxPos)
+	}
+	v.trxOpen = true
+	v.trxBegun = false
+	v.trxFile = fileName
+	v.trxPos = pos
+}
+
+// verifyFile 检查单个 binlog 文件, 读到的每个事件都会校验 CRC, log_pos 和事务边界
+func (v *binlogVerifier) verifyFile(path string) VerifyFileResult {
+	result := VerifyFileResult{Name: filepath.Base(path)}
+
+	f, err := os.Open(path)
+	if err != nil {
+		v.addIssue(&result, IssueDecode, 0, "open file failed: %v", err)
+		return result
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err == nil {
+		result.Size = st.Size()
+	}
+
+	magic := make([]byte, len(binlogMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, binlogMagic) {
+		v.addIssue(&result, IssueBadMagic, 0, "file does not start with binlog magic header")
+		return result
+	}
+
+	parser := replication.NewBinlogParser()
+	parser.SetVerifyChecksum(true)
+	pos := uint32(len(binlogMagic))
+	header := make([]byte, replication.EventHeaderSize)
+	for {
+		n, err := io.ReadFull(f, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.addIssue(&result, IssueTruncated, pos, "trailing event header is truncated, got %d of %d bytes", n, replication.EventHeaderSize)
+			break
+		}
+		eventSize := binary.LittleEndian.Uint32(header[9:])
+		logPos := binary.LittleEndian.Uint32(header[13:])
+		if eventSize < uint32(replication.EventHeaderSize) {
+			v.addIssue(&result, IssueDecode, pos, "invalid event size %d, stop checking the rest of file", eventSize)
+			break
+		}
+		raw := make([]byte, eventSize)
+		copy(raw, header)
+		if n, err := io.ReadFull(f, raw[replication.EventHeaderSize:]); err != nil {
+			v.addIssue(&result, IssueTruncated, pos, "trailing %s is truncated, got %d of %d bytes",
+				replication.EventType(header[4]), n+replication.EventHeaderSize, eventSize)
+			break
+		}
+		result.Events++
+		if logPos != 0 && logPos != pos+eventSize {
+			v.addIssue(&result, IssuePosition, pos, "log_pos %d in header does not match the end of event %d", logPos, pos+eventSize)
+		}
+
+		ev, err := parser.Parse(raw)
+		if err != nil {
+			if errors.Is(err, replication.ErrChecksumMismatch) || strings.Contains(err.Error(), replication.ErrChecksumMismatch.Error()) {
+				v.addIssue(&result, IssueChecksum, pos, "%s checksum mismatch", replication.EventType(header[4]))
+			} else {
+				v.addIssue(&result, IssueDecode, pos, "decode %s failed: %v", replication.EventType(header[4]), err)
+			}
+			pos += eventSize
+			continue
+		}
+		v.checkEvent(ev, pos, &result)
+		pos += eventSize
+	}
+	return result
+}
+
+func (v *binlogVerifier) checkEvent(ev *replication.BinlogEvent, pos uint32, result *VerifyFileResult) {
+	if ev.Header.Timestamp > 0 {
+		eventTime := time.Unix(int64(ev.Header.Timestamp), 0)
+		if result.StartTime.IsZero() {
+			result.StartTime = eventTime
+		}
+		result.EndTime = eventTime
+	}
+
+	switch e := ev.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		result.Checksum = e.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32
+
+	case *replication.RotateEvent:
+		result.NextFile = string(e.NextLogName)
+		if e.Position != 4 {
+			v.addIssue(result, IssueFileGap, pos, "rotate to %s at position %d instead of 4", e.NextLogName, e.Position)
+		}
+
+	case *replication.GTIDEvent:
+		v.beginTrx(result.Name, pos, result)
+		if len(e.SID) == 0 || e.GNO == 0 {
+			return
+		}
+		uuid := FormatGTID(e.SID)
+		if last, ok := v.lastGNO[uuid]; ok && e.GNO != last+1 {
+			v.addIssue(result, IssueGTIDGap, pos, "gtid %s:%d follows %s:%d", uuid, e.GNO, uuid, last)
+		}
+		v.lastGNO[uuid] = e.GNO
+
+	case *replication.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+		switch {
+		case query == "BEGIN":
+			// GTID 事件已经开启了事务
+			if !v.trxOpen || v.trxFile != result.Name {
+				v.beginTrx(result.Name, pos, result)
+			}
+			v.trxBegun = true
+		case isTrxEnd(ev):
+			// 在下面统一结束事务
+		default:
+			if op, _ := parseXAQuery(query); op == XAStart {
+				v.trxBegun = true
+			} else if !v.trxBegun {
+				// 没有 BEGIN 的单条语句自成一个事务
+				v.trxOpen = false
+			}
+		}
+	}
+
+	// XID, COMMIT/ROLLBACK, DDL, XA PREPARE 和 XA COMMIT/ROLLBACK 结束事务
+	if isTrxEnd(ev) {
+		v.trxOpen = false
+	}
+}
+
+// VerifyBinlog 检查 binlog 文件的完整性, 输出 JSON 报告, 发现问题时返回错误使进程以非 0 退出
+func VerifyBinlog(db *sql.DB, options *model.DaemonOptions, out *outputWriter) error {
+	binlogDir := options.BinlogSql.BinlogDir
+	var err error
+	if binlogDir == "" {
+		binlogDir, err = getBinlogDirectory(db)
+		if err != nil {
+			fmt.Printf("please give the binglog directory by --binlogDir\n")
+			return err
+		}
+	}
+	binlogFiles, err := getBinlogFiles(db, options.BinlogSql.BinlogDir)
+	if err != nil {
+		return err
+	}
+	binlogFiles = selectBinlogFiles(binlogFiles, options.BinlogSql.StartFile, options.BinlogSql.StopFile)
+
+	report := &VerifyReport{BinlogDir: binlogDir, CheckedAt: time.Now(), Files: []VerifyFileResult{}, Issues: []VerifyIssue{}}
+	verifier := &binlogVerifier{report: report, lastGNO: make(map[string]int64)}
+	for i, binlogFile := range binlogFiles {
+		result := verifier.verifyFile(filepath.Join(binlogDir, binlogFile))
+		// 文件末尾的 Rotate 必须指向下一个文件, 否则中间有文件缺失
+		if i+1 < len(binlogFiles) && result.NextFile != "" && result.NextFile != binlogFiles[i+1] {
+			verifier.addIssue(&result, IssueFileGap, uint32(result.Size), "rotate to %s but next file is %s", result.NextFile, binlogFiles[i+1])
+		}
+		if verifier.trxOpen && verifier.trxFile == binlogFile && i+1 < len(binlogFiles) {
+			verifier.addIssue(&result, IssueUnterminatedTrx, verifier.trxPos, "transaction is not terminated at the end of file")
+			verifier.trxOpen = false
+		}
+		report.Files = append(report.Files, result)
+		log.Info().Msgf("verify binlog file %s: %d events, %d issues", binlogFile, result.Events, result.Issues)
+	}
+	if verifier.trxOpen {
+		// 最后一个文件可能仍在写入, 只要不是已轮转的文件也按问题报告, 由监控判断
+		last := &report.Files[len(report.Files)-1]
+		verifier.addIssue(last, IssueUnterminatedTrx, verifier.trxPos, "transaction is not terminated at the end of the last file")
+	}
+	report.OK = len(report.Issues) == 0
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	out.Write(string(data) + "\n")
+
+	if !report.OK {
+		return fmt.Errorf("binlog verify found %d issues in %d files", len(report.Issues), len(report.Files))
+	}
+	return nil
+}
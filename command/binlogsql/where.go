@@ -0,0 +1,463 @@
+package binlogsql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"example.com/m/v2/pkg/binlog"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/pingcap/tidb/pkg/parser/opcode"
+	"github.com/pingcap/tidb/pkg/parser/test_driver"
+)
+
+const (
+	WhereImageAny    = "any"    // update 的前镜像或后镜像满足条件即输出
+	WhereImageBefore = "before" // 按前镜像判断, insert 没有前镜像时使用后镜像
+	WhereImageAfter  = "after"  // 按后镜像判断, delete 没有后镜像时使用前镜像
+)
+
+// rowFilter 是 --where 指定的行过滤条件, 对多行事件中的每一行单独判断.
+// 支持比较运算、IN、BETWEEN、LIKE、IS NULL、AND/OR/NOT, 与 NULL 的比较结果按 SQL 语义视为不满足.
+// 字符串比较区分大小写, 字段与数字比较时字符串按数字比较
+type rowFilter struct {
+	expr  ast.ExprNode
+	image string
+	likes map[string]*regexp.Regexp
+}
+
+func newRowFilter(where, image string) (*rowFilter, error) {
+	if image == "" {
+		image = WhereImageAny
+	}
+	switch image {
+	case WhereImageAny, WhereImageBefore, WhereImageAfter:
+	default:
+		return nil, fmt.Errorf("unsupported where image: %s, should be any, before or after", image)
+	}
+	stmt, err := parser.New().ParseOneStmt("SELECT 1 FROM t WHERE "+where, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid where condition %q: %v", where, err)
+	}
+	sel, ok := stmt.(*ast.SelectStmt)
+	if !ok || sel.Where == nil {
+		return nil, fmt.Errorf("invalid where condition %q", where)
+	}
+	f := &rowFilter{expr: sel.Where, image: image, likes: make(map[string]*regexp.Regexp)}
+	if err := f.check(sel.Where); err != nil {
+		return nil, fmt.Errorf("invalid where condition %q: %v", where, err)
+	}
+	return f, nil
+}
+
+// check 在解析参数时检查表达式, 避免到了事件中才发现不支持的写法
+func (f *rowFilter) check(node ast.ExprNode) error {
+	switch n := node.(type) {
+	case *ast.ColumnNameExpr, *test_driver.ValueExpr:
+		return nil
+	case *ast.ParenthesesExpr:
+		return f.check(n.Expr)
+	case *ast.UnaryOperationExpr:
+		switch n.Op {
+		case opcode.Not, opcode.Not2, opcode.Minus, opcode.Plus:
+			return f.check(n.V)
+		}
+		return fmt.Errorf("unsupported operator %s", n.Op)
+	case *ast.BinaryOperationExpr:
+		switch n.Op {
+		case opcode.LogicAnd, opcode.LogicOr, opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ:
+		default:
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		if err := f.check(n.L); err != nil {
+			return err
+		}
+		return f.check(n.R)
+	case *ast.PatternInExpr:
+		if n.Sel != nil {
+			return fmt.Errorf("subquery is not supported")
+		}
+		for _, item := range append([]ast.ExprNode{n.Expr}, n.List...) {
+			if err := f.check(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *ast.BetweenExpr:
+		for _, item := range []ast.ExprNode{n.Expr, n.Left, n.Right} {
+			if err := f.check(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *ast.PatternLikeOrIlikeExpr:
+		if err := f.check(n.Expr); err != nil {
+			return err
+		}
+		return f.check(n.Pattern)
+	case *ast.IsNullExpr:
+		return f.check(n.Expr)
+	}
+	return fmt.Errorf("unsupported expression %s", restoreNode(node))
+}
+
+// Filter 返回满足条件的行, update 的行按 --whereImage 选择前镜像、后镜像或任一镜像匹配
+func (f *rowFilter) Filter(columns []binlog.Column, rows []binlog.Row) []binlog.Row {
+	var selected []binlog.Row
+	for _, row := range rows {
+		var ok bool
+		switch {
+		case row.Before == nil || row.After == nil:
+			ok = f.match(columns, row.Image())
+		case f.image == WhereImageBefore:
+			ok = f.match(columns, row.Before)
+		case f.image == WhereImageAfter:
+			ok = f.match(columns, row.After)
+		default:
+			ok = f.match(columns, row.Before) || f.match(columns, row.After)
+		}
+		if ok {
+			selected = append(selected, row)
+		}
+	}
+	return selected
+}
+
+func (f *rowFilter) match(columns []binlog.Column, row []interface{}) bool {
+	v, err := f.eval(f.expr, columns, row)
+	if err != nil {
+		return false
+	}
+	b, ok := toBool(v)
+	return ok && b
+}
+
+// eval 计算表达式的值, nil 表示 NULL, 逻辑运算结果为 int64 的 0/1
+func (f *rowFilter) eval(node ast.ExprNode, columns []binlog.Column, row []interface{}) (interface{}, error) {
+	switch n := node.(type) {
+	case *ast.ColumnNameExpr:
+		for i, col := range columns {
+			if i < len(row) && strings.EqualFold(col.Name, n.Name.Name.O) {
+				// ENUM/SET 按成员名比较, 和 SQL 中的写法一致
+				return col.MemberValue(row[i]), nil
+			}
+		}
+		// 表中没有该字段时视为 NULL, 不满足条件
+		return nil, nil
+	case *test_driver.ValueExpr:
+		v := n.GetValue()
+		if d, ok := v.(*test_driver.MyDecimal); ok {
+			// decimal 常量按数值比较, 与 decimal 字段(字符串)比较时字段也转为数值
+			x, err := strconv.ParseFloat(d.String(), 64)
+			return x, err
+		}
+		return v, nil
+	case *ast.ParenthesesExpr:
+		return f.eval(n.Expr, columns, row)
+	case *ast.UnaryOperationExpr:
+		v, err := f.eval(n.V, columns, row)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		switch n.Op {
+		case opcode.Not, opcode.Not2:
+			b, _ := toBool(v)
+			return boolValue(!b), nil
+		case opcode.Minus:
+			if x, ok := toFloat(v); ok {
+				if i, ok := v.(int64); ok {
+					return -i, nil
+				}
+				return -x, nil
+			}
+			return nil, fmt.Errorf("invalid operand of -: %v", v)
+		}
+		return v, nil
+	case *ast.BinaryOperationExpr:
+		l, err := f.eval(n.L, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		r, err := f.eval(n.R, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case opcode.LogicAnd:
+			lb, lok := toBool(l)
+			rb, rok := toBool(r)
+			if (lok && !lb) || (rok && !rb) {
+				return int64(0), nil
+			}
+			if !lok || !rok {
+				return nil, nil
+			}
+			return int64(1), nil
+		case opcode.LogicOr:
+			lb, lok := toBool(l)
+			rb, rok := toBool(r)
+			if (lok && lb) || (rok && rb) {
+				return int64(1), nil
+			}
+			if !lok || !rok {
+				return nil, nil
+			}
+			return int64(0), nil
+		case opcode.NullEQ:
+			if l == nil || r == nil {
+				return boolValue(l == nil && r == nil), nil
+			}
+			return boolValue(compareValues(l, r) == 0), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		c := compareValues(l, r)
+		switch n.Op {
+		case opcode.EQ:
+			return boolValue(c == 0), nil
+		case opcode.NE:
+			return boolValue(c != 0), nil
+		case opcode.LT:
+			return boolValue(c < 0), nil
+		case opcode.LE:
+			return boolValue(c <= 0), nil
+		case opcode.GT:
+			return boolValue(c > 0), nil
+		case opcode.GE:
+			return boolValue(c >= 0), nil
+		}
+		return nil, fmt.Errorf("unsupported operator %s", n.Op)
+	case *ast.PatternInExpr:
+		v, err := f.eval(n.Expr, columns, row)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		hasNull := false
+		for _, item := range n.List {
+			iv, err := f.eval(item, columns, row)
+			if err != nil {
+				return nil, err
+			}
+			if iv == nil {
+				hasNull = true
+				continue
+			}
+			if compareValues(v, iv) == 0 {
+				return boolValue(!n.Not), nil
+			}
+		}
+		if hasNull {
+			return nil, nil
+		}
+		return boolValue(n.Not), nil
+	case *ast.BetweenExpr:
+		v, err := f.eval(n.Expr, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		left, err := f.eval(n.Left, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		right, err := f.eval(n.Right, columns, row)
+		if err != nil || v == nil || left == nil || right == nil {
+			return nil, err
+		}
+		in := compareValues(v, left) >= 0 && compareValues(v, right) <= 0
+		return boolValue(in != n.Not), nil
+	case *ast.PatternLikeOrIlikeExpr:
+		v, err := f.eval(n.Expr, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		p, err := f.eval(n.Pattern, columns, row)
+		if err != nil || v == nil || p == nil {
+			return nil, err
+		}
+		re, err := f.likeRegexp(toString(p), n.Escape, !n.IsLike)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue(re.MatchString(toString(v)) != n.Not), nil
+	case *ast.IsNullExpr:
+		v, err := f.eval(n.Expr, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue((v == nil) != n.Not), nil
+	}
+	return nil, fmt.Errorf("unsupported expression %s", restoreNode(node))
+}
+
+// likeRegexp 把 LIKE 模式转换为正则表达式, % 匹配任意个字符, _ 匹配一个字符
+func (f *rowFilter) likeRegexp(pattern string, escape byte, ignoreCase bool) (*regexp.Regexp, error) {
+	key := fmt.Sprintf("%t:%c:%s", ignoreCase, escape, pattern)
+	if re, ok := f.likes[key]; ok {
+		return re, nil
+	}
+	if escape == 0 {
+		escape = '\\'
+	}
+	var sb strings.Builder
+	sb.WriteString("^")
+	if ignoreCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("(?s)")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == rune(escape) && i+1 < len(runes):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, err
+	}
+	f.likes[key] = re
+	return re, nil
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// toBool 把值转换为逻辑值, NULL 返回 ok=false
+func toBool(v interface{}) (bool, bool) {
+	if v == nil {
+		return false, false
+	}
+	if x, ok := toFloat(v); ok {
+		return x != 0, true
+	}
+	x, _ := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+	return x != 0, true
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// toFloat 返回数值类型的值, 字符串等非数值类型返回 ok=false
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), true
+	case int8:
+		return float64(x), true
+	case int16:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint8:
+		return float64(x), true
+	case uint16:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// toInt64 返回整数类型的值, 超出 int64 范围时 ok=false
+func toInt64(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), true
+	case int8:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case uint8:
+		return int64(x), true
+	case uint16:
+		return int64(x), true
+	case uint32:
+		return int64(x), true
+	case uint:
+		return int64(x), x <= math.MaxInt64
+	case uint64:
+		return int64(x), x <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// compareValues 比较两个非 NULL 值: 都是整数时按整数比较, 有一方是数值时另一方的字符串转为数值比较,
+// 都是字符串时按字符串比较
+func compareValues(l, r interface{}) int {
+	if li, ok := toInt64(l); ok {
+		if ri, ok := toInt64(r); ok {
+			switch {
+			case li < ri:
+				return -1
+			case li > ri:
+				return 1
+			}
+			return 0
+		}
+	}
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if lok != rok {
+		if !lok {
+			lf, lok = parseNumber(l)
+		} else {
+			rf, rok = parseNumber(r)
+		}
+	}
+	if lok && rok {
+		switch {
+		case lf < rf:
+			return -1
+		case lf > rf:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(toString(l), toString(r))
+}
+
+// parseNumber 把数字形式的字符串解析为数值
+func parseNumber(v interface{}) (float64, bool) {
+	if x, ok := toFloat(v); ok {
+		return x, true
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+	return x, err == nil
+}
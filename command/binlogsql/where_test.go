@@ -0,0 +1,96 @@
+package binlogsql
+
+import (
+	"testing"
+
+	"example.com/m/v2/pkg/binlog"
+)
+
+func TestRowFilterMatch(t *testing.T) {
+	columns := []binlog.Column{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "varchar"},
+		{Name: "amount", Type: "decimal"},
+		{Name: "status", Type: "enum", Members: []string{"new", "paid", "refund"}},
+		{Name: "tags", Type: "set", Members: []string{"a", "b", "c"}},
+		{Name: "note", Type: "varchar"},
+	}
+	// binlog 中 ENUM 是序号, SET 是位图, decimal 是字符串
+	row := []interface{}{int32(1001), "Alice", "12.50", int64(2), int64(5), nil}
+
+	tests := []struct {
+		where  string
+		expect bool
+	}{
+		{"id = 1001", true},
+		{"id != 1001", false},
+		{"id > 1000 and id <= 1001", true},
+		{"id in (3, 4)", false},
+		{"id not in (3, 4)", true},
+		{"id between 1000 and 2000", true},
+		{"amount > 12.4", true},
+		{"amount = '12.50'", true},
+		{"name = 'alice'", false},
+		{"name like 'Al%'", true},
+		{"name like 'al%'", false},
+		{"name not like '_lice'", false},
+		{"note is null", true},
+		{"note = 'x'", false},
+		{"not (note = 'x')", false},
+		{"note <=> null", true},
+		{"id = 1 or note is null", true},
+		{"missing = 1", false},
+		// ENUM/SET 按成员名比较
+		{"status = 'paid'", true},
+		{"status in ('new', 'refund')", false},
+		{"status != 'new'", true},
+		{"tags = 'a,c'", true},
+		{"tags like '%c'", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			f, err := newRowFilter(tt.where, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.match(columns, row); got != tt.expect {
+				t.Errorf("match = %v, expect %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestRowFilterInvalid(t *testing.T) {
+	for _, where := range []string{"id = (select 1)", "id +", "upper(name) = 'A'"} {
+		if _, err := newRowFilter(where, ""); err == nil {
+			t.Errorf("newRowFilter(%q) should fail", where)
+		}
+	}
+	if _, err := newRowFilter("id = 1", "middle"); err == nil {
+		t.Error("invalid where image should fail")
+	}
+}
+
+func TestRowFilterImage(t *testing.T) {
+	columns := []binlog.Column{{Name: "id", Type: "int"}, {Name: "status", Type: "enum", Members: []string{"new", "paid"}}}
+	update := binlog.Row{Before: []interface{}{int64(1), int64(1)}, After: []interface{}{int64(1), int64(2)}}
+	insert := binlog.Row{After: []interface{}{int64(2), int64(1)}}
+	tests := []struct {
+		image  string
+		expect int
+	}{
+		{WhereImageAny, 2},
+		{WhereImageBefore, 2},
+		{WhereImageAfter, 1},
+	}
+	for _, tt := range tests {
+		f, err := newRowFilter("status = 'new'", tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// insert 没有前镜像, 按后镜像判断
+		if rows := f.Filter(columns, []binlog.Row{update, insert}); len(rows) != tt.expect {
+			t.Errorf("image %s selected %d rows, expect %d", tt.image, len(rows), tt.expect)
+		}
+	}
+}
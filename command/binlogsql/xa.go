@@ -0,0 +1,204 @@
+package binlogsql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+const (
+	XAStart    = "START"
+	XAEnd      = "END"
+	XACommit   = "COMMIT"
+	XARollback = "ROLLBACK"
+)
+
+// XA 事务在 binlog 中的形式:
+//
+//	GTID, XA START xid, 行事件..., XA END xid, XA_PREPARE(事务结束)
+//	GTID, XA COMMIT xid 或 XA ROLLBACK xid(单独的一个事务, 可能在很久之后甚至在后面的 binlog 文件中)
+//
+// XA COMMIT ... ONE PHASE 没有单独的提交事件, XA_PREPARE 中的 one_phase 标志表示分支已提交
+var xaQueryRegex = regexp.MustCompile(`(?is)^\s*XA\s+(START|BEGIN|END|COMMIT|ROLLBACK)\s+(.*?)\s*(\s(ONE\s+PHASE|JOIN|RESUME|SUSPEND(\s+FOR\s+MIGRATE)?))?\s*$`)
+
+// parseXAQuery 解析 XA 语句, 返回操作和规范化的 xid, 不是 XA 语句时 op 为空
+func parseXAQuery(query string) (op string, xid string) {
+	match := xaQueryRegex.FindStringSubmatch(query)
+	if match == nil {
+		return "", ""
+	}
+	op = strings.ToUpper(match[1])
+	if op == "BEGIN" {
+		op = XAStart
+	}
+	return op, normalizeXID(match[2])
+}
+
+// normalizeXID 去掉空白并统一十六进制大小写, XA 语句和 XA_PREPARE 事件中的 xid 使用同样的格式
+func normalizeXID(xid string) string {
+	return strings.ToLower(strings.Join(strings.Fields(xid), ""))
+}
+
+// xaPrepare 解析 XA_PREPARE_LOG_EVENT, go-mysql 不解析该事件, 以 GenericEvent 返回.
+// 事件体: one_phase(1) formatID(4) gtrid_length(4) bqual_length(4) gtrid bqual
+func xaPrepare(ev *replication.BinlogEvent) (xid string, onePhase bool, ok bool) {
+	if ev.Header.EventType != replication.XA_PREPARE_LOG_EVENT {
+		return "", false, false
+	}
+	e, isGeneric := ev.Event.(*replication.GenericEvent)
+	if !isGeneric || len(e.Data) < 13 {
+		return "", false, false
+	}
+	data := e.Data
+	formatID := int32(binary.LittleEndian.Uint32(data[1:]))
+	gtridLen := int(binary.LittleEndian.Uint32(data[5:]))
+	bqualLen := int(binary.LittleEndian.Uint32(data[9:]))
+	if gtridLen < 0 || bqualLen < 0 || len(data) < 13+gtridLen+bqualLen {
+		return "", false, false
+	}
+	gtrid := data[13 : 13+gtridLen]
+	bqual := data[13+gtridLen : 13+gtridLen+bqualLen]
+	return normalizeXID(fmt.Sprintf("X'%x',X'%x',%d", gtrid, bqual, formatID)), data[0] != 0, true
+}
+
+// isTrxEnd 判断事件是否结束一个事务: XID, COMMIT/ROLLBACK, DDL(隐式提交), XA_PREPARE, XA COMMIT/ROLLBACK
+func isTrxEnd(ev *replication.BinlogEvent) bool {
+	switch e := ev.Event.(type) {
+	case *replication.XIDEvent:
+		return true
+	case *replication.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+		if query == "COMMIT" || query == "ROLLBACK" || binlog.IsDDL(query) {
+			return true
+		}
+		op, _ := parseXAQuery(query)
+		return op == XACommit || op == XARollback
+	}
+	_, _, ok := xaPrepare(ev)
+	return ok
+}
+
+// xaBranch 已 PREPARE 但还没有看到 COMMIT/ROLLBACK 的 XA 分支
+type xaBranch struct {
+	xid  string
+	sqls []string
+	file string
+	pos  uint32
+}
+
+// xaTracker 跟踪 XA 事务, XA START 到 XA_PREPARE 之间生成的 sql 先缓存,
+// 看到 XA COMMIT 时输出, XA ROLLBACK 时丢弃, 避免输出最终回滚的分支
+type xaTracker struct {
+	current *xaBranch            // 正在执行的 XA 分支, XA START 到 XA_PREPARE 之间不为 nil
+	pending map[string]*xaBranch // 已 PREPARE 的分支
+	order   []string             // pending 的 PREPARE 顺序
+}
+
+func newXATracker() *xaTracker {
+	return &xaTracker{pending: make(map[string]*xaBranch)}
+}
+
+// XID 返回当前所在的 XA 分支, 不在 XA 事务中时为空
+func (t *xaTracker) XID() string {
+	if t.current == nil {
+		return ""
+	}
+	return t.current.xid
+}
+
+// Open 判断是否有正在执行或已 PREPARE 但还没有 COMMIT/ROLLBACK 的分支
+func (t *xaTracker) Open() bool {
+	return t.current != nil || len(t.order) > 0
+}
+
+// Buffer 在 XA 分支中时缓存 sql 并返回 true
+func (t *xaTracker) Buffer(sql string) bool {
+	if t.current == nil {
+		return false
+	}
+	t.current.sqls = append(t.current.sqls, sql)
+	return true
+}
+
+// Handle 处理 XA 相关事件, 返回需要输出的内容; handled 为 false 表示不是 XA 事件
+func (t *xaTracker) Handle(ev *replication.BinlogEvent, fileName string) (out []string, handled bool) {
+	if xid, onePhase, ok := xaPrepare(ev); ok {
+		branch := t.current
+		t.current = nil
+		if branch == nil {
+			// XA START 在解析范围之前
+			branch = &xaBranch{xid: xid}
+		}
+		branch.file, branch.pos = fileName, ev.Header.LogPos
+		if onePhase {
+			return t.flush(branch, fmt.Sprintf("/* XA %s COMMIT ONE PHASE, %s:%d */", xid, fileName, ev.Header.LogPos)), true
+		}
+		if _, ok := t.pending[xid]; !ok {
+			t.order = append(t.order, xid)
+		}
+		t.pending[xid] = branch
+		return nil, true
+	}
+
+	e, ok := ev.Event.(*replication.QueryEvent)
+	if !ok {
+		return nil, false
+	}
+	op, xid := parseXAQuery(string(e.Query))
+	switch op {
+	case XAStart:
+		t.current = &xaBranch{xid: xid}
+	case XAEnd:
+	case XACommit:
+		branch, ok := t.take(xid)
+		if !ok {
+			return []string{fmt.Sprintf("/* XA %s COMMIT, %s:%d, prepared before the start position, rows not parsed */", xid, fileName, ev.Header.LogPos)}, true
+		}
+		return t.flush(branch, fmt.Sprintf("/* XA %s COMMIT, %s:%d, prepared at %s:%d */", xid, fileName, ev.Header.LogPos, branch.file, branch.pos)), true
+	case XARollback:
+		if branch, ok := t.take(xid); ok {
+			return []string{fmt.Sprintf("/* XA %s ROLLBACK, %s:%d, %d statements of the branch prepared at %s:%d skipped */", xid, fileName, ev.Header.LogPos, len(branch.sqls), branch.file, branch.pos)}, true
+		}
+		// 未 PREPARE 的分支回滚时不写 binlog, 这里只可能是解析范围之前 PREPARE 的分支
+		return nil, true
+	default:
+		return nil, false
+	}
+	return nil, true
+}
+
+func (t *xaTracker) take(xid string) (*xaBranch, bool) {
+	branch, ok := t.pending[xid]
+	if !ok {
+		return nil, false
+	}
+	delete(t.pending, xid)
+	for i, x := range t.order {
+		if x == xid {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	return branch, true
+}
+
+func (t *xaTracker) flush(branch *xaBranch, header string) []string {
+	return append([]string{header}, branch.sqls...)
+}
+
+// Finish 解析结束时对还没有结果的分支输出警告, 这些分支在解析范围内没有 COMMIT/ROLLBACK, 可能仍处于 PREPARED 状态.
+// 分支最终可能回滚, 重放或 flashback 其中的语句都有风险, 这里只输出 xid, 不输出语句
+func (t *xaTracker) Finish() []string {
+	var out []string
+	for _, xid := range t.order {
+		branch := t.pending[xid]
+		out = append(out, fmt.Sprintf("/* WARNING: XA %s prepared at %s:%d, COMMIT/ROLLBACK not found, %d statements not output, check XA RECOVER */", xid, branch.file, branch.pos, len(branch.sqls)))
+	}
+	t.pending = make(map[string]*xaBranch)
+	t.order = nil
+	return out
+}
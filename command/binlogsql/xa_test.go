@@ -0,0 +1,149 @@
+package binlogsql
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func queryEvent(query string, logPos uint32) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT, LogPos: logPos},
+		Event:  &replication.QueryEvent{Query: []byte(query)},
+	}
+}
+
+// xaPrepareEvent 构造 XA_PREPARE_LOG_EVENT, go-mysql 以 GenericEvent 返回
+func xaPrepareEvent(gtrid, bqual string, onePhase bool, logPos uint32) *replication.BinlogEvent {
+	data := make([]byte, 13, 13+len(gtrid)+len(bqual))
+	if onePhase {
+		data[0] = 1
+	}
+	binary.LittleEndian.PutUint32(data[1:], 1)
+	binary.LittleEndian.PutUint32(data[5:], uint32(len(gtrid)))
+	binary.LittleEndian.PutUint32(data[9:], uint32(len(bqual)))
+	data = append(append(data, gtrid...), bqual...)
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.XA_PREPARE_LOG_EVENT, LogPos: logPos},
+		Event:  &replication.GenericEvent{Data: data},
+	}
+}
+
+func TestParseXAQuery(t *testing.T) {
+	tests := []struct {
+		query, op, xid string
+	}{
+		{"XA START 'a','b'", XAStart, "'a','b'"},
+		{"xa begin X'61',X'62',1", XAStart, "x'61',x'62',1"},
+		{"XA END X'61',X'62',1", XAEnd, "x'61',x'62',1"},
+		{"XA COMMIT X'61', X'62', 1 ONE PHASE", XACommit, "x'61',x'62',1"},
+		{"XA ROLLBACK X'61',X'62',1", XARollback, "x'61',x'62',1"},
+		{"INSERT INTO t VALUES (1)", "", ""},
+	}
+	for _, tt := range tests {
+		op, xid := parseXAQuery(tt.query)
+		if op != tt.op || xid != tt.xid {
+			t.Errorf("parseXAQuery(%q) = %q, %q, expect %q, %q", tt.query, op, xid, tt.op, tt.xid)
+		}
+	}
+}
+
+func TestXATracker(t *testing.T) {
+	const xid = "x'61',x'62',1"
+	tests := []struct {
+		name     string
+		end      *replication.BinlogEvent // XA_PREPARE 之后的事件, nil 表示解析范围内没有结果
+		onePhase bool
+		expect   []string // 输出的语句
+		finish   int      // Finish 输出的警告数
+	}{
+		{name: "commit", end: queryEvent("XA COMMIT X'61',X'62',1", 500), expect: []string{"sql1", "sql2"}},
+		{name: "rollback", end: queryEvent("XA ROLLBACK X'61',X'62',1", 500)},
+		{name: "one phase", onePhase: true, expect: []string{"sql1", "sql2"}},
+		{name: "unresolved", finish: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newXATracker()
+			if _, ok := tracker.Handle(queryEvent("XA START X'61',X'62',1", 100), "mysql-bin.000001"); !ok {
+				t.Fatal("XA START not handled")
+			}
+			if tracker.XID() != xid {
+				t.Errorf("xid is %q, expect %q", tracker.XID(), xid)
+			}
+			for _, sql := range []string{"sql1", "sql2"} {
+				if !tracker.Buffer(sql) {
+					t.Fatalf("%s not buffered in XA branch", sql)
+				}
+			}
+			tracker.Handle(queryEvent("XA END X'61',X'62',1", 300), "mysql-bin.000001")
+			out, _ := tracker.Handle(xaPrepareEvent("a", "b", tt.onePhase, 400), "mysql-bin.000001")
+			if tracker.Buffer("sql3") {
+				t.Error("sql buffered after XA PREPARE")
+			}
+			if tt.end != nil {
+				out, _ = tracker.Handle(tt.end, "mysql-bin.000002")
+			}
+
+			var sqls []string
+			for _, line := range out {
+				if !strings.HasPrefix(line, "/*") {
+					sqls = append(sqls, line)
+				}
+			}
+			if !reflect.DeepEqual(sqls, tt.expect) {
+				t.Errorf("output statements %v, expect %v", sqls, tt.expect)
+			}
+
+			// 还处于 PREPARED 的分支只输出警告和 xid, 不输出语句
+			finish := tracker.Finish()
+			if len(finish) != tt.finish {
+				t.Fatalf("finish output %v, expect %d warnings", finish, tt.finish)
+			}
+			for _, line := range finish {
+				if !strings.Contains(line, "WARNING") || !strings.Contains(line, xid) || strings.Contains(line, "sql1") {
+					t.Errorf("unexpected finish output %q", line)
+				}
+			}
+		})
+	}
+}
+
+// binlog-base64 格式回滚的分支不输出行事件, 提交的分支在 XA COMMIT 时作为普通事务输出
+func TestBase64XA(t *testing.T) {
+	rows := &replication.BinlogEvent{
+		Header:  &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, LogPos: 250},
+		Event:   &replication.RowsEvent{TableID: 1, Table: &replication.TableMapEvent{Schema: []byte("db"), Table: []byte("t")}},
+		RawData: []byte("rows"),
+	}
+	tableMap := &replication.BinlogEvent{
+		Header:  &replication.EventHeader{EventType: replication.TABLE_MAP_EVENT, LogPos: 200},
+		Event:   &replication.TableMapEvent{TableID: 1},
+		RawData: []byte("tablemap"),
+	}
+	encode := func(end string) string {
+		b := newBase64Encoder()
+		xa := newXATracker()
+		var sb strings.Builder
+		for _, ev := range []*replication.BinlogEvent{
+			queryEvent("XA START X'61',X'62',1", 100), tableMap, rows,
+			queryEvent("XA END X'61',X'62',1", 300), xaPrepareEvent("a", "b", false, 400),
+			queryEvent(end, 500),
+		} {
+			sb.WriteString(b.Encode(ev, "mysql-bin.000001", true, xa))
+		}
+		return sb.String()
+	}
+
+	rowsBase64 := "cm93cw=="
+	committed := encode("XA COMMIT X'61',X'62',1")
+	if !strings.Contains(committed, rowsBase64) || !strings.Contains(committed, "BEGIN") || !strings.Contains(committed, "COMMIT/*!*/;") {
+		t.Errorf("committed branch output:\n%s", committed)
+	}
+	if rolledBack := encode("XA ROLLBACK X'61',X'62',1"); strings.Contains(rolledBack, rowsBase64) {
+		t.Errorf("rolled back branch output:\n%s", rolledBack)
+	}
+}
@@ -0,0 +1,320 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	clickhouseVersionColumn = "_version"
+	clickhouseDeletedColumn = "is_deleted"
+
+	clickhouseDefaultBatchSize     = 100000
+	clickhouseDefaultBatchBytes    = 64 << 20
+	clickhouseDefaultFlushInterval = 10
+)
+
+var (
+	binlogFileIndexRegex = regexp.MustCompile(`\.(\d+)$`)
+	mysqlFspRegex        = regexp.MustCompile(`^(?:datetime|timestamp)\((\d)\)`)
+)
+
+// clickhouseTable 是一个已创建的目标表和未写入的数据
+type clickhouseTable struct {
+	name    string   // 带库名的表名, 已加反引号
+	columns []string // 同步的字段, 与源表字段同名
+	buf     bytes.Buffer
+	rows    int
+}
+
+// clickhouseTarget 通过 HTTP 接口同步到 ClickHouse. 目标表使用 ReplacingMergeTree(_version, is_deleted) 按主键排序,
+// _version 由 binlog 位置生成, 删除写入 is_deleted=1 的行. 数据按批量大小或 flushInterval 以 TabSeparated 格式批量写入
+type clickhouseTarget struct {
+	client   *http.Client
+	config   conf.ClickHouseConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	tables   map[string]*clickhouseTable // 源表 db.table 到目标表
+	rows     int
+	bytes    int
+}
+
+func newClickHouseTarget(source *sql.DB, syncConf *conf.Config, options *model.DaemonOptions) (*clickhouseTarget, error) {
+	config := syncConf.Target.ClickHouse
+	if config.URL == "" {
+		return nil, fmt.Errorf("clickhouse url is not configured")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = clickhouseDefaultBatchSize
+	}
+	if config.BatchBytes <= 0 {
+		config.BatchBytes = clickhouseDefaultBatchBytes
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = clickhouseDefaultFlushInterval
+	}
+	client := &http.Client{}
+	if config.Timeout > 0 {
+		client.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+
+	t := &clickhouseTarget{client: client, config: config, syncConf: syncConf, options: options, tables: make(map[string]*clickhouseTable)}
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			target, err := t.createTable(options.Ctx, source, mapping.Database, table)
+			if err != nil {
+				return nil, err
+			}
+			t.tables[mapping.Database+"."+table.Table] = target
+		}
+	}
+	return t, nil
+}
+
+// createTable 按 MySQL 字段定义创建目标表, 表已存在时不修改. 目标表为 target_name(支持 db.table), 默认为配置的 database 或源库下的同名表
+func (t *clickhouseTarget) createTable(ctx context.Context, source *sql.DB, dbName string, mapping conf.TableMapping) (*clickhouseTable, error) {
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[dbName+"."+mapping.Table]
+	if len(pkNames) == 0 {
+		return nil, fmt.Errorf("table %s.%s has no primary key, can not sync to clickhouse", dbName, mapping.Table)
+	}
+	database, name := dbName, mapping.Table
+	if t.config.Database != "" {
+		database = t.config.Database
+	}
+	if mapping.TargetName != "" {
+		name = mapping.TargetName
+		if d, n, ok := strings.Cut(name, "."); ok {
+			database, name = d, n
+		}
+	}
+	table := &clickhouseTable{name: quoteName(database) + "." + quoteName(name)}
+
+	rows, err := source.Query("SELECT COLUMN_NAME,DATA_TYPE,COLUMN_TYPE,IS_NULLABLE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", dbName, mapping.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var defs []string
+	for rows.Next() {
+		var column, dataType, columnType, nullable string
+		if err := rows.Scan(&column, &dataType, &columnType, &nullable); err != nil {
+			return nil, err
+		}
+		if len(mapping.Columns) > 0 && !containsFold(mapping.Columns, column) && !containsFold(pkNames, column) {
+			continue
+		}
+		chType := clickhouseType(dataType, columnType)
+		// 排序键不能为 Nullable
+		if nullable == "YES" && !containsFold(pkNames, column) {
+			chType = "Nullable(" + chType + ")"
+		}
+		table.columns = append(table.columns, column)
+		defs = append(defs, quoteName(column)+" "+chType)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("no column information of %s.%s", dbName, mapping.Table)
+	}
+	defs = append(defs, quoteName(clickhouseVersionColumn)+" UInt64", quoteName(clickhouseDeletedColumn)+" UInt8")
+	orderBy := make([]string, len(pkNames))
+	for i, pk := range pkNames {
+		orderBy[i] = quoteName(pk)
+	}
+
+	if err := t.exec(ctx, "CREATE DATABASE IF NOT EXISTS "+quoteName(database), nil); err != nil {
+		return nil, err
+	}
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n  %s\n) ENGINE = ReplacingMergeTree(%s, %s) ORDER BY (%s)",
+		table.name, strings.Join(defs, ",\n  "), quoteName(clickhouseVersionColumn), quoteName(clickhouseDeletedColumn), strings.Join(orderBy, ", "))
+	if err := t.exec(ctx, ddl, nil); err != nil {
+		return nil, fmt.Errorf("create clickhouse table %s failed: %v", table.name, err)
+	}
+	log.Info().Msgf("clickhouse table %s is ready for %s.%s", table.name, dbName, mapping.Table)
+	return table, nil
+}
+
+// clickhouseType 把 MySQL 字段类型转为 ClickHouse 类型, 字符串、JSON、ENUM、SET、TIME 和二进制都使用 String
+func clickhouseType(dataType, columnType string) string {
+	unsigned := ""
+	if strings.Contains(columnType, "unsigned") {
+		unsigned = "U"
+	}
+	switch dataType {
+	case "tinyint":
+		return unsigned + "Int8"
+	case "smallint":
+		return unsigned + "Int16"
+	case "mediumint", "int", "integer":
+		return unsigned + "Int32"
+	case "bigint":
+		return unsigned + "Int64"
+	case "bit":
+		return "UInt64"
+	case "year":
+		return "UInt16"
+	case "float":
+		return "Float32"
+	case "double":
+		return "Float64"
+	case "decimal":
+		if m := mysqlNumericTypeRegex.FindStringSubmatch(columnType); m != nil {
+			scale := m[2]
+			if scale == "" {
+				scale = "0"
+			}
+			return fmt.Sprintf("Decimal(%s, %s)", m[1], scale)
+		}
+		return "Decimal(10, 0)"
+	case "date":
+		return "Date32"
+	case "datetime", "timestamp":
+		if m := mysqlFspRegex.FindStringSubmatch(columnType); m != nil && m[1] != "0" {
+			return fmt.Sprintf("DateTime64(%s)", m[1])
+		}
+		return "DateTime"
+	}
+	return "String"
+}
+
+// clickhouseVersion 由 binlog 文件序号和位置生成递增的版本号
+func clickhouseVersion(pos binlog.Change) uint64 {
+	var index uint64
+	if m := binlogFileIndexRegex.FindStringSubmatch(pos.Position.Name); m != nil {
+		index, _ = strconv.ParseUint(m[1], 10, 32)
+	}
+	return index<<32 | uint64(pos.Position.Pos)
+}
+
+func (t *clickhouseTarget) FlushInterval() time.Duration {
+	return time.Duration(t.config.FlushInterval) * time.Second
+}
+
+func (t *clickhouseTarget) Write(ctx context.Context, change *binlog.Change) error {
+	table := t.tables[change.Table.Schema+"."+change.Table.Name]
+	if table == nil {
+		return nil
+	}
+	version := clickhouseVersion(*change)
+	for _, row := range change.Rows {
+		// update 修改了主键时旧主键的行标记为删除
+		if change.Type == binlog.Delete || (change.Type == binlog.Update && t.keyChanged(change, row)) {
+			t.appendRow(table, change.Table, row.Before, version, 1)
+		}
+		if change.Type != binlog.Delete {
+			t.appendRow(table, change.Table, row.After, version, 0)
+		}
+	}
+	if t.rows >= t.config.BatchSize || t.bytes >= t.config.BatchBytes {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+func (t *clickhouseTarget) keyChanged(change *binlog.Change, row binlog.Row) bool {
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+	return rowKey(change.Table, pkNames, row.Before) != rowKey(change.Table, pkNames, row.After)
+}
+
+// appendRow 以 TabSeparated 格式缓存一行, BIT/ENUM/SET 已由 normalizeChange 转为 UInt64 和成员名
+func (t *clickhouseTarget) appendRow(table *clickhouseTable, source *binlog.Table, values []interface{}, version uint64, deleted int) {
+	n := table.buf.Len()
+	for _, col := range table.columns {
+		var value interface{}
+		if idx := source.ColumnIndex(col); idx >= 0 && idx < len(values) {
+			value = values[idx]
+		}
+		writeTSVValue(&table.buf, value)
+		table.buf.WriteByte('\t')
+	}
+	fmt.Fprintf(&table.buf, "%d\t%d\n", version, deleted)
+	table.rows++
+	t.rows++
+	t.bytes += table.buf.Len() - n
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r", "\x00", "\\0", "\b", "\\b", "\f", "\\f", "'", "\\'")
+
+func writeTSVValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("\\N")
+	case []byte:
+		tsvEscaper.WriteString(buf, string(v))
+	case string:
+		tsvEscaper.WriteString(buf, v)
+	default:
+		fmt.Fprint(buf, v)
+	}
+}
+
+// Flush 把每个表缓存的数据用一个 INSERT 写入
+func (t *clickhouseTarget) Flush(ctx context.Context) error {
+	for _, table := range t.tables {
+		if table.rows == 0 {
+			continue
+		}
+		columns := make([]string, 0, len(table.columns)+2)
+		for _, col := range table.columns {
+			columns = append(columns, quoteName(col))
+		}
+		columns = append(columns, quoteName(clickhouseVersionColumn), quoteName(clickhouseDeletedColumn))
+		query := fmt.Sprintf("INSERT INTO %s (%s) FORMAT TabSeparated", table.name, strings.Join(columns, ", "))
+		if err := t.exec(ctx, query, table.buf.Bytes()); err != nil {
+			return fmt.Errorf("insert into clickhouse table %s failed: %v", table.name, err)
+		}
+		log.Debug().Msgf("clickhouse %s inserted %d rows", table.name, table.rows)
+		table.buf.Reset()
+		table.rows = 0
+	}
+	t.rows, t.bytes = 0, 0
+	return nil
+}
+
+// exec 执行一个语句, data 不为 nil 时作为 INSERT 的数据, 否则语句放在请求体中
+func (t *clickhouseTarget) exec(ctx context.Context, query string, data []byte) error {
+	endpoint := strings.TrimRight(t.config.URL, "/") + "/"
+	body := []byte(query)
+	if data != nil {
+		endpoint += "?query=" + url.QueryEscape(query)
+		body = data
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if t.config.User != "" {
+		req.SetBasicAuth(t.config.User, t.config.Password)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("clickhouse: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func (t *clickhouseTarget) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// 全量和 binlog 的 BIT/ENUM/SET 值经过 normalizeChange 后写出相同的 TSV 行
+func TestClickHouseNormalizedRow(t *testing.T) {
+	table := &binlog.Table{Schema: "db", Name: "t", Columns: []binlog.Column{
+		{Name: "id", Type: "int"}, {Name: "flags", Type: "bit"}, {Name: "size", Type: "enum"}, {Name: "tags", Type: "set"}, {Name: "note", Type: "varchar"},
+	}}
+	options := &model.DaemonOptions{MysqlSync: &model.SyncOption{
+		PrimaryKeyColumnNames: map[string][]string{"db.t": {"id"}},
+		TableColumnMembers:    map[string][][]string{"db.t": {nil, nil, {"small", "large"}, {"a", "b"}, nil}},
+	}}
+	rows := map[string][]interface{}{
+		"dump":   {int64(1), []byte{0x01, 0x02}, "small", "a,b", "x\ty"},
+		"binlog": {int64(1), int64(258), int64(1), int64(3), "x\ty"},
+	}
+	for source, values := range rows {
+		target := &clickhouseTarget{
+			config:  conf.ClickHouseConfig{BatchSize: 100, BatchBytes: 1 << 20},
+			options: options,
+			tables:  map[string]*clickhouseTable{"db.t": {name: "`db`.`t`", columns: []string{"id", "flags", "size", "tags", "note"}}},
+		}
+		change := &binlog.Change{Type: binlog.Insert, Table: table, Rows: []binlog.Row{{After: values}}, Position: mysql.Position{Name: "mysql-bin.000002", Pos: 100}}
+		normalizeChange(change, options)
+		if err := target.Write(context.Background(), change); err != nil {
+			t.Fatal(err)
+		}
+		expect := "1\t258\tsmall\ta,b\tx\\ty\t8589934692\t0\n"
+		if got := target.tables["db.t"].buf.String(); got != expect {
+			t.Errorf("%s row is %q, expect %q", source, got, expect)
+		}
+	}
+}
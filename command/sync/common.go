@@ -1,5 +1,12 @@
 package sync
 
+import (
+	"example.com/m/v2/common"
+	"example.com/m/v2/model"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
 func Contains(slice []string, element string) bool {
 	for _, item := range slice {
 		if item == element {
@@ -8,3 +15,66 @@ func Contains(slice []string, element string) bool {
 	}
 	return false
 }
+
+// decodeRowsCharset 按源表字段字符集把 binlog 行数据中的字符串转为 UTF-8, 二进制字段保持 []byte
+func decodeRowsCharset(e *replication.RowsEvent, options *model.DaemonOptions) {
+	dbTable := string(e.Table.Schema) + "." + string(e.Table.Table)
+	columns := options.MysqlSync.TableColumnMap[dbTable]
+	types := options.MysqlSync.TableColumnTypes[dbTable]
+	charsets := options.MysqlSync.TableColumnCharsets[dbTable]
+
+	// information_schema 中没有字符集时使用 TableMap 元数据
+	collations := e.Table.CollationMap()
+	for _, row := range e.Rows {
+		for i, value := range row {
+			if i >= len(columns) {
+				break
+			}
+			charset := charsets[i]
+			if collationID, ok := collations[i]; ok && charset == "" {
+				charset = common.CharsetByCollationID(collationID)
+			}
+			decoded, err := common.DecodeColumnValue(value, types[i], charset)
+			if err != nil {
+				log.Warn().Err(err).Msgf("%s column %s charset decode failed", dbTable, columns[i])
+			}
+			row[i] = decoded
+		}
+	}
+}
+
+// maskColumn 按配置的脱敏规则处理字段值, 主键字段保持原值
+func maskColumn(options *model.DaemonOptions, dbName, tableName, column string, value interface{}) interface{} {
+	masker := options.MysqlSync.Masker
+	if masker == nil || Contains(options.MysqlSync.PrimaryKeyColumnNames[dbName+"."+tableName], column) {
+		return value
+	}
+	return masker.Mask(dbName, tableName, column, value)
+}
+
+// maskRowsEvent 对 binlog 行数据脱敏, 需在 decodeRowsCharset 之后调用
+func maskRowsEvent(e *replication.RowsEvent, options *model.DaemonOptions) {
+	if options.MysqlSync.Masker == nil {
+		return
+	}
+	dbName, tableName := string(e.Table.Schema), string(e.Table.Table)
+	columns := options.MysqlSync.TableColumnMap[dbName+"."+tableName]
+	for _, row := range e.Rows {
+		for i, value := range row {
+			if i >= len(columns) {
+				break
+			}
+			row[i] = maskColumn(options, dbName, tableName, columns[i], value)
+		}
+	}
+}
+
+// isBinaryColumn 判断源表字段是否为二进制类型
+func isBinaryColumn(options *model.DaemonOptions, dbTable string, column string) bool {
+	for i, col := range options.MysqlSync.TableColumnMap[dbTable] {
+		if col == column {
+			return common.IsBinaryColumn(options.MysqlSync.TableColumnTypes[dbTable][i], options.MysqlSync.TableColumnCharsets[dbTable][i])
+		}
+	}
+	return false
+}
@@ -1 +1,241 @@
 package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/rs/zerolog/log"
+)
+
+const esDefaultMaxRetry = 5
+
+// esTarget 通过 bulk API 同步到 Elasticsearch/OpenSearch, 文档 id 为 MySQL 主键
+type esTarget struct {
+	client   *http.Client
+	config   conf.ElasticsearchConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	host     int      // 当前使用的节点, 连接失败时切换到下一个
+	actions  [][]byte // 未提交的 bulk 操作, 每个操作包含 action 行和可选的文档行
+}
+
+func newESTarget(syncConf *conf.Config, options *model.DaemonOptions) (*esTarget, error) {
+	config := syncConf.Target.Elasticsearch
+	if len(config.Hosts) == 0 {
+		return nil, fmt.Errorf("elasticsearch hosts is not configured")
+	}
+	switch config.Refresh {
+	case "", "false", "true", "wait_for":
+	default:
+		return nil, fmt.Errorf("unsupported elasticsearch refresh: %s", config.Refresh)
+	}
+	if config.MaxRetry <= 0 {
+		config.MaxRetry = esDefaultMaxRetry
+	}
+	// 文档 id 来自主键, 没有主键的表无法更新和删除
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			if len(options.MysqlSync.PrimaryKeyColumnNames[mapping.Database+"."+table.Table]) == 0 {
+				return nil, fmt.Errorf("table %s.%s has no primary key, can not sync to elasticsearch", mapping.Database, table.Table)
+			}
+		}
+	}
+	client := &http.Client{}
+	if config.Timeout > 0 {
+		client.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	return &esTarget{client: client, config: config, syncConf: syncConf, options: options}, nil
+}
+
+// indexName 返回表对应的索引名: target_name, 或者按 index 模板生成, 默认 {db}_{table}. 索引名只能是小写
+func (t *esTarget) indexName(dbName, tableName string) string {
+	if mapping := findTableMapping(t.syncConf, dbName, tableName); mapping != nil && mapping.TargetName != "" {
+		return strings.ToLower(mapping.TargetName)
+	}
+	index := t.config.Index
+	if index == "" {
+		index = "{db}_{table}"
+	}
+	return strings.ToLower(strings.NewReplacer("{db}", dbName, "{table}", tableName).Replace(index))
+}
+
+func (t *esTarget) Write(ctx context.Context, change *binlog.Change) error {
+	index := t.indexName(change.Table.Schema, change.Table.Name)
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+
+	for _, row := range change.Rows {
+		switch change.Type {
+		case binlog.Insert:
+			if err := t.add("index", index, rowKey(change.Table, pkNames, row.After), rowDocument(change.Table, mapping, row.After)); err != nil {
+				return err
+			}
+		case binlog.Update:
+			id := rowKey(change.Table, pkNames, row.After)
+			// 主键被修改时删除旧文档
+			if oldID := rowKey(change.Table, pkNames, row.Before); oldID != id {
+				if err := t.add("delete", index, oldID, nil); err != nil {
+					return err
+				}
+			}
+			doc := map[string]interface{}{"doc": rowDocument(change.Table, mapping, row.After), "doc_as_upsert": true}
+			if err := t.add("update", index, id, doc); err != nil {
+				return err
+			}
+		case binlog.Delete:
+			if err := t.add("delete", index, rowKey(change.Table, pkNames, row.Before), nil); err != nil {
+				return err
+			}
+		}
+	}
+	if len(t.actions) >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// add 添加一个 bulk 操作, source 为 nil 时只有 action 行
+func (t *esTarget) add(action, index, id string, source interface{}) error {
+	meta := map[string]interface{}{"_index": index, "_id": id}
+	if t.config.Version > 0 && t.config.Version < 7 {
+		meta["_type"] = "_doc"
+	}
+	line, err := json.Marshal(map[string]interface{}{action: meta})
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(line)
+	buf.WriteByte('\n')
+	if source != nil {
+		doc, err := json.Marshal(source)
+		if err != nil {
+			return fmt.Errorf("encode document %s/%s failed: %v", index, id, err)
+		}
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+	t.actions = append(t.actions, buf.Bytes())
+	return nil
+}
+
+// Flush 提交缓存的操作, 有 429 和 5xx 的操作时按指数退避重试, 其他失败直接返回错误
+func (t *esTarget) Flush(ctx context.Context) error {
+	pending := t.actions
+	for attempt := 0; len(pending) > 0; attempt++ {
+		retry, err := t.bulk(ctx, pending)
+		if err != nil {
+			return err
+		}
+		if len(retry) == 0 {
+			break
+		}
+		if attempt >= t.config.MaxRetry {
+			return fmt.Errorf("elasticsearch bulk failed after %d retries, %d actions not written", attempt, len(retry))
+		}
+		backoff := time.Duration(100<<uint(attempt)) * time.Millisecond
+		if backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+		log.Warn().Msgf("elasticsearch bulk %d actions rejected, retry after %s", len(retry), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		pending = retry
+	}
+	t.actions = t.actions[:0]
+	return nil
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk 发送一次 bulk 请求, 返回需要重试的操作. 部分操作被拒绝时从第一个被拒绝的操作开始按原顺序全部重试,
+// 否则同一文档后面已成功的操作会先于重试的操作执行, 例如重试的 upsert 会恢复已被删除的文档
+func (t *esTarget) bulk(ctx context.Context, actions [][]byte) ([][]byte, error) {
+	body := bytes.Join(actions, nil)
+	host := strings.TrimRight(t.config.Hosts[t.host], "/")
+	url := host + "/_bulk"
+	if t.config.Refresh != "" {
+		url += "?refresh=" + t.config.Refresh
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if t.config.Username != "" {
+		req.SetBasicAuth(t.config.Username, t.config.Password)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// 连接失败时切换节点后全部重试
+		log.Warn().Err(err).Msgf("elasticsearch %s request failed", host)
+		t.host = (t.host + 1) % len(t.config.Hosts)
+		return actions, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return actions, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return actions, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("elasticsearch bulk failed: %s %s", resp.Status, data)
+	}
+
+	var result esBulkResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode elasticsearch bulk response failed: %v", err)
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(actions) {
+		return nil, fmt.Errorf("elasticsearch bulk response has %d items, expect %d", len(result.Items), len(actions))
+	}
+	firstRetry := -1
+	for i, item := range result.Items {
+		for action, r := range item {
+			switch {
+			case r.Status < 300, action == "delete" && r.Status == http.StatusNotFound:
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				if firstRetry < 0 {
+					firstRetry = i
+				}
+			default:
+				return nil, fmt.Errorf("elasticsearch %s failed: status %d %s", action, r.Status, r.Error)
+			}
+		}
+	}
+	if firstRetry < 0 {
+		return nil, nil
+	}
+	return actions[firstRetry:], nil
+}
+
+func (t *esTarget) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,186 @@
+package sync
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+)
+
+var esTestTable = &binlog.Table{Schema: "db", Name: "t", Columns: []binlog.Column{{Name: "id", Type: "int"}, {Name: "name", Type: "varchar"}}}
+
+// esTestServer 记录每次 bulk 请求的 query 和 body, 按顺序返回 responses, 用完后返回最后一个
+type esTestServer struct {
+	*httptest.Server
+	queries   []string
+	bodies    []string
+	responses []string
+}
+
+func newESTestServer(t *testing.T, responses ...string) *esTestServer {
+	s := &esTestServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("content type is %s", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.queries = append(s.queries, r.URL.RawQuery)
+		s.bodies = append(s.bodies, string(body))
+		resp := s.responses[min(len(s.bodies), len(s.responses))-1]
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestESTarget(t *testing.T, url, refresh string) *esTarget {
+	syncConf := &conf.Config{Mapping: []conf.MappingConfig{{Database: "db", Tables: []conf.TableMapping{{Table: "t"}}}}}
+	syncConf.Target.Elasticsearch = conf.ElasticsearchConfig{Hosts: []string{url}, Refresh: refresh, MaxRetry: 3}
+	options := &model.DaemonOptions{MysqlSync: &model.SyncOption{
+		WriteBatchSize:        1000,
+		PrimaryKeyColumnNames: map[string][]string{"db.t": {"id"}},
+	}}
+	target, err := newESTarget(syncConf, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func writeESChange(t *testing.T, target *esTarget, typ binlog.ChangeType, before, after []interface{}) {
+	change := &binlog.Change{Type: typ, Table: esTestTable, Rows: []binlog.Row{{Before: before, After: after}}}
+	if err := target.Write(context.Background(), change); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestESBulkBody(t *testing.T) {
+	server := newESTestServer(t, `{"errors":false,"items":[]}`)
+	target := newTestESTarget(t, server.URL, "wait_for")
+
+	writeESChange(t, target, binlog.Insert, nil, []interface{}{int64(1), "a"})
+	writeESChange(t, target, binlog.Update, []interface{}{int64(1), "a"}, []interface{}{int64(1), "b"})
+	// 修改主键时先删除旧文档
+	writeESChange(t, target, binlog.Update, []interface{}{int64(1), "b"}, []interface{}{int64(2), "b"})
+	writeESChange(t, target, binlog.Delete, []interface{}{int64(2), "b"}, nil)
+	if err := target.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := strings.Join([]string{
+		`{"index":{"_id":"1","_index":"db_t"}}`,
+		`{"id":1,"name":"a"}`,
+		`{"update":{"_id":"1","_index":"db_t"}}`,
+		`{"doc":{"id":1,"name":"b"},"doc_as_upsert":true}`,
+		`{"delete":{"_id":"1","_index":"db_t"}}`,
+		`{"update":{"_id":"2","_index":"db_t"}}`,
+		`{"doc":{"id":2,"name":"b"},"doc_as_upsert":true}`,
+		`{"delete":{"_id":"2","_index":"db_t"}}`,
+	}, "\n") + "\n"
+	if len(server.bodies) != 1 || server.bodies[0] != expect {
+		t.Fatalf("bulk body:\n%v\nexpect:\n%s", server.bodies, expect)
+	}
+	if server.queries[0] != "refresh=wait_for" {
+		t.Errorf("query is %q, expect refresh=wait_for", server.queries[0])
+	}
+	if len(target.actions) != 0 {
+		t.Errorf("%d actions left after flush", len(target.actions))
+	}
+}
+
+func TestESCompositeKey(t *testing.T) {
+	server := newESTestServer(t, `{"errors":false,"items":[]}`)
+	target := newTestESTarget(t, server.URL, "")
+	target.options.MysqlSync.PrimaryKeyColumnNames["db.t"] = []string{"id", "name"}
+
+	writeESChange(t, target, binlog.Insert, nil, []interface{}{int64(1), "a"})
+	if err := target.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(server.bodies[0], `{"index":{"_id":"1:a","_index":"db_t"}}`) {
+		t.Errorf("bulk body is %s", server.bodies[0])
+	}
+	if server.queries[0] != "" {
+		t.Errorf("query is %q, expect no refresh", server.queries[0])
+	}
+}
+
+func TestESDeleteNotFound(t *testing.T) {
+	server := newESTestServer(t, `{"errors":true,"items":[{"delete":{"status":404}},{"index":{"status":201}}]}`)
+	target := newTestESTarget(t, server.URL, "")
+
+	writeESChange(t, target, binlog.Delete, []interface{}{int64(1), "a"}, nil)
+	writeESChange(t, target, binlog.Insert, nil, []interface{}{int64(2), "b"})
+	if err := target.Flush(context.Background()); err != nil {
+		t.Fatalf("delete of missing document should succeed: %v", err)
+	}
+	if len(server.bodies) != 1 {
+		t.Errorf("%d requests, expect 1", len(server.bodies))
+	}
+}
+
+func TestESRetryRejectedItems(t *testing.T) {
+	server := newESTestServer(t,
+		`{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":429}},{"index":{"status":201}}]}`,
+		`{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}}]}`,
+	)
+	target := newTestESTarget(t, server.URL, "")
+
+	for i := int64(1); i <= 3; i++ {
+		writeESChange(t, target, binlog.Insert, nil, []interface{}{i, "a"})
+	}
+	if err := target.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.bodies) != 2 {
+		t.Fatalf("%d requests, expect 2", len(server.bodies))
+	}
+	// 从第一个被拒绝的操作开始按原顺序重试, 包括之后已成功的操作
+	expect := `{"index":{"_id":"2","_index":"db_t"}}` + "\n" + `{"id":2,"name":"a"}` + "\n" +
+		`{"index":{"_id":"3","_index":"db_t"}}` + "\n" + `{"id":3,"name":"a"}` + "\n"
+	if server.bodies[1] != expect {
+		t.Errorf("retry body:\n%s\nexpect:\n%s", server.bodies[1], expect)
+	}
+}
+
+// 被拒绝的 upsert 之后删除了同一文档, 重试时删除仍然在 upsert 之后
+func TestESRetryKeepsOrder(t *testing.T) {
+	server := newESTestServer(t,
+		`{"errors":true,"items":[{"update":{"status":503}},{"delete":{"status":200}}]}`,
+		`{"errors":true,"items":[{"update":{"status":200}},{"delete":{"status":404}}]}`,
+	)
+	target := newTestESTarget(t, server.URL, "")
+
+	writeESChange(t, target, binlog.Update, []interface{}{int64(1), "a"}, []interface{}{int64(1), "b"})
+	writeESChange(t, target, binlog.Delete, []interface{}{int64(1), "b"}, nil)
+	if err := target.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.bodies) != 2 || server.bodies[1] != server.bodies[0] {
+		t.Fatalf("retry body:\n%v\nexpect the whole batch in order", server.bodies)
+	}
+}
+
+func TestESItemError(t *testing.T) {
+	server := newESTestServer(t, `{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`)
+	target := newTestESTarget(t, server.URL, "")
+
+	writeESChange(t, target, binlog.Insert, nil, []interface{}{int64(1), "a"})
+	err := target.Flush(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatalf("expect mapping error, got %v", err)
+	}
+	if len(server.bodies) != 1 {
+		t.Errorf("%d requests, 4xx items should not be retried", len(server.bodies))
+	}
+}
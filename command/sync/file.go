@@ -0,0 +1,338 @@
+package sync
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FileFormatNDJSON = "ndjson"
+	FileFormatCSV    = "csv"
+
+	fileDefaultMaxSize        = 128
+	fileDefaultRotateInterval = 3600
+)
+
+// fileMetaColumns 是 csv 文件中每行变更前的元数据字段
+var fileMetaColumns = []string{"op", "file", "pos", "gtid", "commit_time"}
+
+// fileRecord 是 ndjson 文件中的一行
+type fileRecord struct {
+	Op         string                 `json:"op"`
+	Database   string                 `json:"database"`
+	Table      string                 `json:"table"`
+	File       string                 `json:"file"`
+	Pos        uint32                 `json:"pos"`
+	GTID       string                 `json:"gtid"`
+	CommitTime string                 `json:"commit_time"`
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+}
+
+// countWriter 统计写入文件的字节数, 用于按大小切分
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fileWriter 是一个表当前写入的文件
+type fileWriter struct {
+	path    string
+	file    *os.File
+	count   *countWriter
+	buf     *bufio.Writer
+	gz      *gzip.Writer
+	w       io.Writer // 写入数据的 writer, 开启压缩时为 gz, 否则为 buf
+	csv     *csv.Writer
+	columns []string // csv 表头中的表字段
+	opened  time.Time
+}
+
+// flush 把缓存的数据写入文件并 fsync
+func (w *fileWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *fileWriter) close() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// fileTarget 把全量和增量的行变更按表写入本地文件, 每行包含 op、binlog 文件和位置、GTID、提交时间.
+// 文件按大小或时间切分, Flush 时 fsync 所有打开的文件, 之后才保存 binlog 位点
+type fileTarget struct {
+	config   conf.FileConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	writers  map[string]*fileWriter // db.table 到当前文件
+}
+
+func newFileTarget(syncConf *conf.Config, options *model.DaemonOptions) (*fileTarget, error) {
+	config := syncConf.Target.File
+	if config.Dir == "" {
+		return nil, fmt.Errorf("file dir is not configured")
+	}
+	switch config.Format {
+	case "":
+		config.Format = FileFormatNDJSON
+	case FileFormatNDJSON, FileFormatCSV:
+	default:
+		return nil, fmt.Errorf("unsupported file format: %s", config.Format)
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = fileDefaultMaxSize
+	}
+	if config.RotateInterval <= 0 {
+		config.RotateInterval = fileDefaultRotateInterval
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileTarget{config: config, syncConf: syncConf, options: options, writers: make(map[string]*fileWriter)}, nil
+}
+
+// expired 判断文件是否达到切分的大小或时间
+func (t *fileTarget) expired(w *fileWriter, now time.Time) bool {
+	return w.count.n >= int64(t.config.MaxSize)<<20 || now.Sub(w.opened) >= time.Duration(t.config.RotateInterval)*time.Second
+}
+
+// open 创建表的新文件: {dir}/{db}/{table}/{table}-{打开时间}.{ndjson|csv}[.gz]
+func (t *fileTarget) open(dbName, tableName string, columns []string, now time.Time) (*fileWriter, error) {
+	dir := filepath.Join(t.config.Dir, dbName, tableName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ext := "." + t.config.Format
+	if t.config.Gzip {
+		ext += ".gz"
+	}
+	base := tableName + "-" + now.Format("20060102T150405")
+	var file *os.File
+	var path string
+	for i := 0; ; i++ {
+		path = filepath.Join(dir, base+ext)
+		if i > 0 {
+			path = filepath.Join(dir, base+"-"+strconv.Itoa(i)+ext)
+		}
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+	}
+	// 新文件的目录项也需要落盘
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	w := &fileWriter{path: path, file: file, opened: now}
+	w.count = &countWriter{w: file}
+	w.buf = bufio.NewWriterSize(w.count, 256<<10)
+	w.w = w.buf
+	if t.config.Gzip {
+		w.gz = gzip.NewWriter(w.buf)
+		w.w = w.gz
+	}
+	if t.config.Format == FileFormatCSV {
+		w.csv = csv.NewWriter(w.w)
+		w.columns = columns
+		if err := w.csv.Write(append(append([]string(nil), fileMetaColumns...), columns...)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	log.Info().Msgf("open file %s", path)
+	return w, nil
+}
+
+func (t *fileTarget) Write(ctx context.Context, change *binlog.Change) error {
+	key := change.Table.Schema + "." + change.Table.Name
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	var columns []string
+	var indexes []int
+	for i, col := range change.Table.Columns {
+		if mapping != nil && len(mapping.Columns) > 0 && !containsFold(mapping.Columns, col.Name) {
+			continue
+		}
+		columns = append(columns, col.Name)
+		indexes = append(indexes, i)
+	}
+
+	now := time.Now()
+	w := t.writers[key]
+	// csv 表头随表结构变化, 字段变化时切换到新文件
+	if w != nil && (t.expired(w, now) || (w.csv != nil && !equalStrings(w.columns, columns))) {
+		delete(t.writers, key)
+		if err := w.close(); err != nil {
+			return fmt.Errorf("close file %s failed: %v", w.path, err)
+		}
+	}
+	if w = t.writers[key]; w == nil {
+		var err error
+		if w, err = t.open(change.Table.Schema, change.Table.Name, columns, now); err != nil {
+			return fmt.Errorf("open file of %s failed: %v", key, err)
+		}
+		t.writers[key] = w
+	}
+
+	op := string(change.Type)
+	if isSnapshot(change) {
+		op = "snapshot"
+	}
+	commitTime := change.Timestamp.Format(time.RFC3339)
+	for _, row := range change.Rows {
+		if w.csv != nil {
+			values := row.Image()
+			record := []string{op, change.Position.Name, strconv.FormatUint(uint64(change.Position.Pos), 10), change.GTID, commitTime}
+			for _, idx := range indexes {
+				var value interface{}
+				if idx < len(values) {
+					value = values[idx]
+				}
+				record = append(record, csvValue(value))
+			}
+			if err := w.csv.Write(record); err != nil {
+				return fmt.Errorf("write file %s failed: %v", w.path, err)
+			}
+			continue
+		}
+
+		record := fileRecord{
+			Op:         op,
+			Database:   change.Table.Schema,
+			Table:      change.Table.Name,
+			File:       change.Position.Name,
+			Pos:        change.Position.Pos,
+			GTID:       change.GTID,
+			CommitTime: commitTime,
+		}
+		if row.Before != nil {
+			record.Before = rowDocument(change.Table, mapping, row.Before)
+		}
+		if row.After != nil {
+			record.After = rowDocument(change.Table, mapping, row.After)
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("encode row of %s failed: %v", key, err)
+		}
+		if _, err := w.w.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("write file %s failed: %v", w.path, err)
+		}
+	}
+	return nil
+}
+
+// csvValue 把字段值转为 csv 中的字符串, NULL 为空串, 二进制为十六进制
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return hex.EncodeToString(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush fsync 所有打开的文件, 达到切分时间的文件同时关闭
+func (t *fileTarget) Flush(ctx context.Context) error {
+	now := time.Now()
+	for key, w := range t.writers {
+		if t.expired(w, now) {
+			delete(t.writers, key)
+			if err := w.close(); err != nil {
+				return fmt.Errorf("close file %s failed: %v", w.path, err)
+			}
+			continue
+		}
+		if err := w.flush(); err != nil {
+			return fmt.Errorf("sync file %s failed: %v", w.path, err)
+		}
+	}
+	return nil
+}
+
+func (t *fileTarget) Close() error {
+	var errs []error
+	for key, w := range t.writers {
+		delete(t.writers, key)
+		if err := w.close(); err != nil {
+			errs = append(errs, fmt.Errorf("close file %s failed: %v", w.path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -31,13 +31,13 @@ func BinlogActionFlag(options *model.DaemonOptions) []cli.Flag {
 		cli.StringFlag{
 			Name:        "redis_write_mode",
 			Value:       "batch", // batch single
-			Usage:       "write data to redis mode when full dump ",
+			Usage:       "write data to redis mode, batch: pipeline every write_batch_size commands, single: write every change immediately",
 			Destination: &options.MysqlSync.WriteMode,
 		},
 		cli.IntFlag{
 			Name:        "write_batch_size",
 			Value:       1000,
-			Usage:       "write data to redis batch size when full dump",
+			Usage:       "write data to redis batch size when full dump, also the bulk size of elasticsearch",
 			Destination: &options.MysqlSync.WriteBatchSize,
 		},
 	}
@@ -1 +1,313 @@
 package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	KafkaFormatPlain    = "plain"
+	KafkaFormatCanal    = "canal"
+	KafkaFormatDebezium = "debezium"
+)
+
+// kafkaTarget 把每行变更作为一条消息发送到 Kafka, 消息 key 为主键, 同一行的变更进入同一个分区保证顺序
+type kafkaTarget struct {
+	writer   *kafka.Writer
+	config   conf.KafkaConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	messages []kafka.Message
+	id       int64 // canal 消息序号
+}
+
+func newKafkaTarget(syncConf *conf.Config, options *model.DaemonOptions) (*kafkaTarget, error) {
+	config := syncConf.Target.Kafka
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers is not configured")
+	}
+	switch config.Format {
+	case "":
+		config.Format = KafkaFormatPlain
+	case KafkaFormatPlain, KafkaFormatCanal, KafkaFormatDebezium:
+	default:
+		return nil, fmt.Errorf("unsupported kafka format: %s", config.Format)
+	}
+
+	transport := &kafka.Transport{}
+	if config.SASL.Enabled {
+		mechanism, err := kafkaSASL(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+	if config.TLS.Enabled {
+		tlsConfig := &tls.Config{}
+		if config.TLS.CACert != "" {
+			pem, err := os.ReadFile(config.TLS.CACert)
+			if err != nil {
+				return nil, fmt.Errorf("read kafka ca cert failed: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("invalid kafka ca cert %s", config.TLS.CACert)
+			}
+		}
+		transport.TLS = tlsConfig
+	}
+
+	writer := &kafka.Writer{
+		Addr: kafka.TCP(config.Brokers...),
+		// 与 Java 客户端相同的分区算法, 按 key 分区
+		Balancer:     &kafka.Murmur2Balancer{},
+		RequiredAcks: kafka.RequireAll,
+		BatchSize:    options.MysqlSync.WriteBatchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    transport,
+	}
+	return &kafkaTarget{writer: writer, config: config, syncConf: syncConf, options: options}, nil
+}
+
+func kafkaSASL(config conf.KafkaConfig) (sasl.Mechanism, error) {
+	switch strings.ToUpper(config.SASL.Mechanism) {
+	case "", "PLAIN":
+		return plain.Mechanism{Username: config.SASL.Username, Password: config.SASL.Password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, config.SASL.Username, config.SASL.Password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, config.SASL.Username, config.SASL.Password)
+	}
+	return nil, fmt.Errorf("unsupported kafka sasl mechanism: %s", config.SASL.Mechanism)
+}
+
+// topicName 返回表对应的 topic: target_name, 或者按 topic 模板生成, topic 不带 {db} {table} 时所有表写入同一个 topic
+func (t *kafkaTarget) topicName(dbName, tableName string) string {
+	if mapping := findTableMapping(t.syncConf, dbName, tableName); mapping != nil && mapping.TargetName != "" {
+		return mapping.TargetName
+	}
+	return strings.NewReplacer("{db}", dbName, "{table}", tableName).Replace(t.config.Topic)
+}
+
+func (t *kafkaTarget) Write(ctx context.Context, change *binlog.Change) error {
+	topic := t.topicName(change.Table.Schema, change.Table.Name)
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+	now := time.Now()
+
+	for i, row := range change.Rows {
+		var before, after map[string]interface{}
+		if row.Before != nil {
+			before = rowDocument(change.Table, mapping, row.Before)
+		}
+		if row.After != nil {
+			after = rowDocument(change.Table, mapping, row.After)
+		}
+		key := rowKey(change.Table, pkNames, row.Image())
+		if key == "" {
+			// 没有主键的表按表名分区, 保证表内顺序
+			key = change.Table.Schema + "." + change.Table.Name
+		}
+
+		var value interface{}
+		switch t.config.Format {
+		case KafkaFormatCanal:
+			t.id++
+			value = canalMessage(t.id, change, mapping, pkNames, before, after, now)
+		case KafkaFormatDebezium:
+			value = debeziumMessage(change, i, before, after, now)
+		default:
+			value = plainMessage(change, pkNames, before, after)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("encode kafka message of %s.%s failed: %v", change.Table.Schema, change.Table.Name, err)
+		}
+		t.messages = append(t.messages, kafka.Message{Topic: topic, Key: []byte(key), Value: data, Time: change.Timestamp})
+	}
+	if len(t.messages) >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush 同步发送缓存的消息, 所有副本确认后返回
+func (t *kafkaTarget) Flush(ctx context.Context) error {
+	if len(t.messages) == 0 {
+		return nil
+	}
+	if err := t.writer.WriteMessages(ctx, t.messages...); err != nil {
+		return fmt.Errorf("write kafka messages failed: %v", err)
+	}
+	t.messages = t.messages[:0]
+	return nil
+}
+
+func (t *kafkaTarget) Close() error {
+	return t.writer.Close()
+}
+
+// plainMessage 是默认的消息格式, 包含变更前后的字段和 binlog 位置
+func plainMessage(change *binlog.Change, pkNames []string, before, after map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{
+		"op":       string(change.Type),
+		"database": change.Table.Schema,
+		"table":    change.Table.Name,
+		"pk":       pkNames,
+		"before":   before,
+		"after":    after,
+		"file":     change.Position.Name,
+		"pos":      change.Position.Pos,
+		"gtid":     change.GTID,
+		"ts":       change.Timestamp.Unix(),
+	}
+	if isSnapshot(change) {
+		msg["snapshot"] = true
+	}
+	return msg
+}
+
+// canalMessage 生成 Canal flatMessage 格式的消息, 字段值都是字符串, old 只包含修改过的字段
+func canalMessage(id int64, change *binlog.Change, mapping *conf.TableMapping, pkNames []string, before, after map[string]interface{}, now time.Time) map[string]interface{} {
+	mysqlType := make(map[string]string)
+	sqlType := make(map[string]int)
+	for _, col := range change.Table.Columns {
+		if mapping != nil && len(mapping.Columns) > 0 && !containsFold(mapping.Columns, col.Name) {
+			continue
+		}
+		mysqlType[col.Name] = col.Type
+		sqlType[col.Name] = jdbcType(col.Type)
+	}
+
+	var data, old []map[string]interface{}
+	msgType := strings.ToUpper(string(change.Type))
+	switch change.Type {
+	case binlog.Insert:
+		data = []map[string]interface{}{canalValues(after)}
+	case binlog.Delete:
+		data = []map[string]interface{}{canalValues(before)}
+	case binlog.Update:
+		data = []map[string]interface{}{canalValues(after)}
+		changed := make(map[string]interface{})
+		for name, value := range before {
+			if fmt.Sprint(value) != fmt.Sprint(after[name]) {
+				changed[name] = value
+			}
+		}
+		old = []map[string]interface{}{canalValues(changed)}
+	}
+	return map[string]interface{}{
+		"id":        id,
+		"database":  change.Table.Schema,
+		"table":     change.Table.Name,
+		"pkNames":   pkNames,
+		"isDdl":     false,
+		"type":      msgType,
+		"es":        change.Timestamp.UnixMilli(),
+		"ts":        now.UnixMilli(),
+		"sql":       "",
+		"sqlType":   sqlType,
+		"mysqlType": mysqlType,
+		"data":      data,
+		"old":       old,
+		"gtid":      change.GTID,
+	}
+}
+
+// canalValues 把字段值转为字符串, 二进制按 ISO-8859-1 转为字符串, 与 Canal 一致
+func canalValues(doc map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(doc))
+	for name, value := range doc {
+		switch v := value.(type) {
+		case nil:
+			values[name] = nil
+		case []byte:
+			runes := make([]rune, len(v))
+			for i, b := range v {
+				runes[i] = rune(b)
+			}
+			values[name] = string(runes)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+// jdbcType 返回 MySQL 类型对应的 java.sql.Types, 用于 Canal 的 sqlType
+func jdbcType(dataType string) int {
+	switch dataType {
+	case "bit":
+		return -7
+	case "tinyint":
+		return -6
+	case "smallint":
+		return 5
+	case "mediumint", "int", "integer":
+		return 4
+	case "bigint":
+		return -5
+	case "float":
+		return 7
+	case "double":
+		return 8
+	case "decimal":
+		return 3
+	case "date", "year":
+		return 91
+	case "time":
+		return 92
+	case "datetime", "timestamp":
+		return 93
+	case "binary", "varbinary":
+		return -3
+	case "tinyblob", "blob", "mediumblob", "longblob":
+		return 2004
+	case "char":
+		return 1
+	case "text", "tinytext", "mediumtext", "longtext":
+		return 2005
+	}
+	return 12 // VARCHAR
+}
+
+// debeziumMessage 生成 Debezium MySQL connector 的 payload(schemas.enable=false), 全量同步的 op 为 r
+func debeziumMessage(change *binlog.Change, row int, before, after map[string]interface{}, now time.Time) map[string]interface{} {
+	op := map[binlog.ChangeType]string{binlog.Insert: "c", binlog.Update: "u", binlog.Delete: "d"}[change.Type]
+	snapshot := "false"
+	if isSnapshot(change) {
+		op, snapshot = "r", "true"
+	}
+	return map[string]interface{}{
+		"before": before,
+		"after":  after,
+		"source": map[string]interface{}{
+			"version":   "dbkit",
+			"connector": "mysql",
+			"ts_ms":     change.Timestamp.UnixMilli(),
+			"snapshot":  snapshot,
+			"db":        change.Table.Schema,
+			"table":     change.Table.Name,
+			"gtid":      change.GTID,
+			"file":      change.Position.Name,
+			"pos":       change.Position.Pos,
+			"row":       row,
+		},
+		"op":    op,
+		"ts_ms": now.UnixMilli(),
+	}
+}
@@ -93,8 +93,8 @@ func DumpFullMySQLTableToMongoDB(db *sql.DB, conf *conf.Config, mongoClient *mon
 				conf.MongoDB.Primary,
 				options)
 			if err != nil {
-				return nil, err
 				log.Error().Err(err).Msgf("Failed to dump table %s.%s", mapping.Database, table.Table)
+				return nil, err
 			}
 		}
 	}
@@ -168,7 +168,12 @@ func dumpSingleTableDataBatchToMongo(tx *sql.Tx, mongoClient *mongo.Client, dbNa
 			case nil:
 				value = nil // 直接存 `null`
 			case []byte:
-				value = string(v) // 确保 `BinData` 变成 `string`
+				// 二进制字段保存为 BinData, 其余字段转为 string
+				if isBinaryColumn(options, dbName+"."+tableName, colName) {
+					value = v
+				} else {
+					value = string(v)
+				}
 			case time.Time:
 				value = v.Format("2006-01-02 15:04:05") // 统一转换为字符串格式
 			case sql.NullString:
@@ -186,6 +191,7 @@ func dumpSingleTableDataBatchToMongo(tx *sql.Tx, mongoClient *mongo.Client, dbNa
 			default:
 				value = fmt.Sprintf("%v", v) // 确保转换为可读格式
 			}
+			value = maskColumn(options, dbName, tableName, colName, value)
 
 			pkNames := options.MysqlSync.PrimaryKeyColumnNames[dbName+"."+tableName]
 			if Contains(pkNames, colName) && len(pkNames) == 1 && primary == "true" {
@@ -310,6 +316,8 @@ func processRowsEventMongoDB(mongoClient *mongo.Client, event *replication.Binlo
 
 	eventDB := string(rowsEvent.Table.Schema)
 	eventTable := string(rowsEvent.Table.Table)
+	decodeRowsCharset(rowsEvent, options)
+	maskRowsEvent(rowsEvent, options)
 
 	// 根据事件类型进行处理
 	switch event.Header.EventType {
@@ -360,7 +368,7 @@ func handleInsertEventMongo(client *mongo.Client, syncConf *conf.Config, e *repl
 								var value interface{}
 								switch v := row[i].(type) {
 								case []byte:
-									value = string(v) // 转换成字符串，避免存入 BinData
+									value = v // 字符串已按字符集解码, 剩下的 []byte 都是二进制字段, 存为 BinData
 								case time.Time:
 									value = v.Format("2006-01-02 15:04:05") // 如果你不想存 ISODate，可以改为字符串
 								default:
@@ -475,7 +483,7 @@ func handleUpdateEventMongo(client *mongo.Client, syncConf *conf.Config, e *repl
 								var value interface{}
 								switch v := before[i].(type) {
 								case []byte:
-									value = string(v)
+									value = v
 								case time.Time:
 									value = v // 保持时间类型
 								case int64, int32, int:
@@ -501,7 +509,7 @@ func handleUpdateEventMongo(client *mongo.Client, syncConf *conf.Config, e *repl
 								var value interface{}
 								switch v := after[i].(type) {
 								case []byte:
-									value = string(v)
+									value = v
 								case time.Time:
 									value = v.Format("2006-01-02 15:04:05")
 								default:
@@ -577,7 +585,7 @@ func handleDeleteEventMongo(client *mongo.Client, syncConf *conf.Config, e *repl
 								var value interface{}
 								switch v := row[i].(type) {
 								case []byte:
-									value = string(v) // 转换成字符串，避免存入 BinData
+									value = v // 字符串已按字符集解码, 剩下的 []byte 都是二进制字段, 存为 BinData
 								case time.Time:
 									value = v.Format("2006-01-02 15:04:05") // 如果你不想存 ISODate，可以改为字符串
 								default:
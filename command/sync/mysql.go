@@ -5,6 +5,7 @@ import (
 	"errors"
 	"example.com/m/v2/conf"
 	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
 	"fmt"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/rs/zerolog/log"
@@ -94,7 +95,7 @@ func CheckBinlogPosOK(pos string, db *sql.DB) (error, *mysql.Position) {
 }
 
 func FlushColumnNames(options *model.DaemonOptions, db *sql.DB, syncConf *conf.Config) error {
-	query := "SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION;"
+	query := "SELECT COLUMN_NAME,DATA_TYPE,COLUMN_TYPE,IFNULL(CHARACTER_SET_NAME,'') FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION;"
 	for _, m := range syncConf.Mapping {
 		for _, table := range m.Tables {
 			rows, err := db.Query(query, m.Database, table.Table)
@@ -104,13 +105,26 @@ func FlushColumnNames(options *model.DaemonOptions, db *sql.DB, syncConf *conf.C
 			}
 			defer rows.Close()
 
+			// 重新加载时先清空, 避免 DDL 后重复追加字段
+			dbTable := m.Database + "." + table.Table
+			options.MysqlSync.TableColumnMap[dbTable] = nil
+			options.MysqlSync.TableColumnTypes[dbTable] = nil
+			options.MysqlSync.TableColumnCharsets[dbTable] = nil
+			options.MysqlSync.TableColumnMembers[dbTable] = nil
 			for rows.Next() {
-				var columnName string
-				if err := rows.Scan(&columnName); err != nil {
+				var columnName, dataType, columnType, charset string
+				if err := rows.Scan(&columnName, &dataType, &columnType, &charset); err != nil {
 					log.Error().Err(err).Msg(fmt.Sprintf("flush table column infomation failed"))
 					return err
 				}
-				options.MysqlSync.TableColumnMap[m.Database+"."+table.Table] = append(options.MysqlSync.TableColumnMap[m.Database+"."+table.Table], columnName)
+				options.MysqlSync.TableColumnMap[dbTable] = append(options.MysqlSync.TableColumnMap[dbTable], columnName)
+				options.MysqlSync.TableColumnTypes[dbTable] = append(options.MysqlSync.TableColumnTypes[dbTable], dataType)
+				options.MysqlSync.TableColumnCharsets[dbTable] = append(options.MysqlSync.TableColumnCharsets[dbTable], charset)
+				var members []string
+				if dataType == "enum" || dataType == "set" {
+					members = binlog.ParseEnumMembers(columnType)
+				}
+				options.MysqlSync.TableColumnMembers[dbTable] = append(options.MysqlSync.TableColumnMembers[dbTable], members)
 			}
 		}
 
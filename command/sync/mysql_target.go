@@ -0,0 +1,219 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/rs/zerolog/log"
+)
+
+// mysqlMaxPlaceholders 是一条语句中占位符的上限
+const mysqlMaxPlaceholders = 65535
+
+// mysqlOp 是一个待执行的目标端操作, upsert 的 values 为所有同步字段的值, delete 的 values 为主键的值
+type mysqlOp struct {
+	table   string // 带库名的目标表, 已加反引号
+	columns []string
+	pk      []string
+	delete  bool
+	values  []interface{}
+}
+
+// mysqlTarget 把变更按主键幂等地写入另一个 MySQL: insert/update 使用 INSERT ... ON DUPLICATE KEY UPDATE, delete 按主键删除.
+// 缓存的操作在 Flush 时按顺序在一个事务中执行, 连续的同类操作合并为一条语句
+type mysqlTarget struct {
+	db       *sql.DB
+	config   conf.MySQLTargetConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	ops      []mysqlOp
+}
+
+func newMySQLTarget(syncConf *conf.Config, options *model.DaemonOptions) (*mysqlTarget, error) {
+	config := syncConf.Target.MySQL
+	if config.IP == "" || config.Port == 0 || config.User == "" {
+		return nil, fmt.Errorf("目标 MySQL 配置信息不完整")
+	}
+	// 按主键写入, 同步的字段必须包含主键
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			pkNames := options.MysqlSync.PrimaryKeyColumnNames[mapping.Database+"."+table.Table]
+			if len(pkNames) == 0 {
+				return nil, fmt.Errorf("table %s.%s has no primary key, can not sync to mysql", mapping.Database, table.Table)
+			}
+			for _, pk := range pkNames {
+				if len(table.Columns) > 0 && !containsFold(table.Columns, pk) {
+					return nil, fmt.Errorf("columns of %s.%s must include primary key %s", mapping.Database, table.Table, pk)
+				}
+			}
+		}
+	}
+
+	charset := config.Charset
+	if charset == "" {
+		charset = "utf8mb4"
+	}
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/?charset=%s&maxAllowedPacket=16777216", config.User, config.Password, config.IP, config.Port, charset)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(options.Ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to target mysql %s:%d failed: %v", config.IP, config.Port, err)
+	}
+	return &mysqlTarget{db: db, config: config, syncConf: syncConf, options: options}, nil
+}
+
+// tableName 返回目标表: target_name 可以是 table 或 db.table, 没有库名时使用目标配置的 database, 默认与源库同名
+func (t *mysqlTarget) tableName(dbName, tableName string, mapping *conf.TableMapping) string {
+	if mapping != nil && mapping.TargetName != "" {
+		tableName = mapping.TargetName
+		if db, table, ok := strings.Cut(tableName, "."); ok {
+			return quoteName(db) + "." + quoteName(table)
+		}
+	}
+	if t.config.Database != "" {
+		dbName = t.config.Database
+	}
+	return quoteName(dbName) + "." + quoteName(tableName)
+}
+
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (t *mysqlTarget) Write(ctx context.Context, change *binlog.Change) error {
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	table := t.tableName(change.Table.Schema, change.Table.Name, mapping)
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+
+	// 同步的字段和主键在行数据中的位置
+	var columns []string
+	var indexes []int
+	for i, col := range change.Table.Columns {
+		if mapping != nil && len(mapping.Columns) > 0 && !containsFold(mapping.Columns, col.Name) {
+			continue
+		}
+		columns = append(columns, col.Name)
+		indexes = append(indexes, i)
+	}
+	pkIndexes := make([]int, len(pkNames))
+	for i, pk := range pkNames {
+		if pkIndexes[i] = change.Table.ColumnIndex(pk); pkIndexes[i] < 0 {
+			return fmt.Errorf("primary key %s not found in %s.%s", pk, change.Table.Schema, change.Table.Name)
+		}
+	}
+	pick := func(row []interface{}, indexes []int) []interface{} {
+		values := make([]interface{}, len(indexes))
+		for i, idx := range indexes {
+			if idx < len(row) {
+				values[i] = row[idx]
+			}
+		}
+		return values
+	}
+
+	for _, row := range change.Rows {
+		switch change.Type {
+		case binlog.Insert:
+			t.ops = append(t.ops, mysqlOp{table: table, columns: columns, values: pick(row.After, indexes)})
+		case binlog.Update:
+			// 主键被修改时先删除旧记录
+			oldKey, newKey := pick(row.Before, pkIndexes), pick(row.After, pkIndexes)
+			if fmt.Sprint(oldKey) != fmt.Sprint(newKey) {
+				t.ops = append(t.ops, mysqlOp{table: table, pk: pkNames, delete: true, values: oldKey})
+			}
+			t.ops = append(t.ops, mysqlOp{table: table, columns: columns, values: pick(row.After, indexes)})
+		case binlog.Delete:
+			t.ops = append(t.ops, mysqlOp{table: table, pk: pkNames, delete: true, values: pick(row.Before, pkIndexes)})
+		}
+	}
+	if len(t.ops) >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush 在一个事务中按顺序执行缓存的操作
+func (t *mysqlTarget) Flush(ctx context.Context) error {
+	if len(t.ops) == 0 {
+		return nil
+	}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(t.ops); {
+		end := start + 1
+		limit := mysqlMaxPlaceholders / len(t.ops[start].values)
+		for end < len(t.ops) && end-start < limit && sameMySQLStatement(t.ops[start], t.ops[end]) {
+			end++
+		}
+		query, args := mysqlStatement(t.ops[start:end])
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			log.Error().Err(err).Msgf("execute on target mysql failed: %s", query)
+			return err
+		}
+		start = end
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	t.ops = t.ops[:0]
+	return nil
+}
+
+func sameMySQLStatement(a, b mysqlOp) bool {
+	if a.table != b.table || a.delete != b.delete {
+		return false
+	}
+	if a.delete {
+		return strings.Join(a.pk, ",") == strings.Join(b.pk, ",")
+	}
+	return strings.Join(a.columns, ",") == strings.Join(b.columns, ",")
+}
+
+// mysqlStatement 把同一个表的同类操作合并为一条语句
+func mysqlStatement(ops []mysqlOp) (string, []interface{}) {
+	var args []interface{}
+	first := ops[0]
+	if first.delete {
+		pk := make([]string, len(first.pk))
+		for i, name := range first.pk {
+			pk[i] = quoteName(name)
+		}
+		tuple := "(" + strings.TrimSuffix(strings.Repeat("?,", len(pk)), ",") + ")"
+		tuples := make([]string, len(ops))
+		for i, op := range ops {
+			tuples[i] = tuple
+			args = append(args, op.values...)
+		}
+		return fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s)", first.table, strings.Join(pk, ","), strings.Join(tuples, ",")), args
+	}
+
+	columns := make([]string, len(first.columns))
+	updates := make([]string, len(first.columns))
+	for i, name := range first.columns {
+		columns[i] = quoteName(name)
+		updates[i] = fmt.Sprintf("%s=VALUES(%s)", columns[i], columns[i])
+	}
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	tuples := make([]string, len(ops))
+	for i, op := range ops {
+		tuples[i] = tuple
+		args = append(args, op.values...)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE %s",
+		first.table, strings.Join(columns, ","), strings.Join(tuples, ","), strings.Join(updates, ",")), args
+}
+
+func (t *mysqlTarget) Close() error {
+	return t.db.Close()
+}
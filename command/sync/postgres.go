@@ -0,0 +1,405 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+// postgresMaxPlaceholders 是一条语句中参数的上限
+const postgresMaxPlaceholders = 65535
+
+var mysqlNumericTypeRegex = regexp.MustCompile(`^\w+\((\d+)(?:,(\d+))?\)`)
+
+// postgresTable 是一个已创建的目标表, 只同步建表时存在的字段
+type postgresTable struct {
+	name    string            // 带 schema 的表名, 已加引号
+	columns []string          // 目标表的字段, 与源表字段同名
+	types   map[string]string // 字段名到 PostgreSQL 类型
+	pk      []string
+}
+
+// postgresOp 是一个待执行的增量操作, upsert 的 values 与 columns 对应, delete 的 values 为主键的值
+type postgresOp struct {
+	table  *postgresTable
+	delete bool
+	key    string // 主键值, 同一条 INSERT ... ON CONFLICT 不能包含相同的主键
+	values []interface{}
+}
+
+// postgresTarget 同步到 PostgreSQL: 启动时按 MySQL 字段定义建表, 全量用 COPY, 增量用 INSERT ... ON CONFLICT 和按主键 DELETE
+type postgresTarget struct {
+	db       *sql.DB
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	tables   map[string]*postgresTable // 源表 db.table 到目标表
+	copyRows map[*postgresTable][][]interface{}
+	ops      []postgresOp
+	pending  int
+}
+
+func newPostgresTarget(source *sql.DB, syncConf *conf.Config, options *model.DaemonOptions) (*postgresTarget, error) {
+	config := syncConf.Target.Postgres
+	if config.Host == "" || config.User == "" || config.Database == "" {
+		return nil, fmt.Errorf("目标 PostgreSQL 配置信息不完整")
+	}
+	if config.Port == 0 {
+		config.Port = 5432
+	}
+	if config.SSLMode == "" {
+		config.SSLMode = "disable"
+	}
+	if config.Schema == "" {
+		config.Schema = "public"
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.User, config.Password),
+		Host:     fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Path:     "/" + config.Database,
+		RawQuery: "sslmode=" + url.QueryEscape(config.SSLMode),
+	}
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(options.Ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to postgres %s:%d failed: %v", config.Host, config.Port, err)
+	}
+
+	t := &postgresTarget{db: db, syncConf: syncConf, options: options, tables: make(map[string]*postgresTable), copyRows: make(map[*postgresTable][][]interface{})}
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			target, err := t.createTable(source, config.Schema, mapping.Database, table)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			t.tables[mapping.Database+"."+table.Table] = target
+		}
+	}
+	return t, nil
+}
+
+// createTable 按 MySQL 字段定义创建目标表, 表已存在时不修改. 目标表名为 target_name(支持 schema.table), 默认与源表同名
+func (t *postgresTarget) createTable(source *sql.DB, schema, dbName string, mapping conf.TableMapping) (*postgresTable, error) {
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[dbName+"."+mapping.Table]
+	if len(pkNames) == 0 {
+		return nil, fmt.Errorf("table %s.%s has no primary key, can not sync to postgres", dbName, mapping.Table)
+	}
+	name := mapping.Table
+	if mapping.TargetName != "" {
+		name = mapping.TargetName
+	}
+	if s, n, ok := strings.Cut(name, "."); ok {
+		schema, name = s, n
+	}
+	table := &postgresTable{name: pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name), types: make(map[string]string), pk: pkNames}
+
+	rows, err := source.Query("SELECT COLUMN_NAME,DATA_TYPE,COLUMN_TYPE,IS_NULLABLE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", dbName, mapping.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var defs []string
+	for rows.Next() {
+		var column, dataType, columnType, nullable string
+		if err := rows.Scan(&column, &dataType, &columnType, &nullable); err != nil {
+			return nil, err
+		}
+		if len(mapping.Columns) > 0 && !containsFold(mapping.Columns, column) && !containsFold(pkNames, column) {
+			continue
+		}
+		pgType := postgresType(dataType, columnType)
+		table.columns = append(table.columns, column)
+		table.types[column] = pgType
+		def := pq.QuoteIdentifier(column) + " " + pgType
+		if nullable == "NO" {
+			def += " NOT NULL"
+		}
+		defs = append(defs, def)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("no column information of %s.%s", dbName, mapping.Table)
+	}
+	defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", quotePostgresNames(pkNames)))
+
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n  %s\n)", table.name, strings.Join(defs, ",\n  "))
+	if _, err := t.db.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(schema))); err != nil {
+		return nil, err
+	}
+	if _, err := t.db.Exec(ddl); err != nil {
+		return nil, fmt.Errorf("create postgres table %s failed: %v", table.name, err)
+	}
+	log.Info().Msgf("postgres table %s is ready for %s.%s", table.name, dbName, mapping.Table)
+	return table, nil
+}
+
+// postgresType 把 MySQL 字段类型转为 PostgreSQL 类型:
+// TINYINT(1)->boolean, 无符号整数使用更大的类型, BIGINT UNSIGNED 和 BIT(64)->numeric(20), DATETIME/TIMESTAMP->timestamp,
+// JSON->jsonb, ENUM/SET->text, 二进制->bytea
+func postgresType(dataType, columnType string) string {
+	unsigned := strings.Contains(columnType, "unsigned")
+	switch dataType {
+	case "tinyint":
+		if strings.HasPrefix(columnType, "tinyint(1)") {
+			return "boolean"
+		}
+		return "smallint"
+	case "smallint":
+		if unsigned {
+			return "integer"
+		}
+		return "smallint"
+	case "mediumint":
+		return "integer"
+	case "int", "integer":
+		if unsigned {
+			return "bigint"
+		}
+		return "integer"
+	case "bigint":
+		if unsigned {
+			return "numeric(20)"
+		}
+		return "bigint"
+	case "decimal":
+		if m := mysqlNumericTypeRegex.FindStringSubmatch(columnType); m != nil {
+			if m[2] != "" {
+				return fmt.Sprintf("numeric(%s,%s)", m[1], m[2])
+			}
+			return fmt.Sprintf("numeric(%s)", m[1])
+		}
+		return "numeric"
+	case "float":
+		return "real"
+	case "double":
+		return "double precision"
+	case "bit":
+		// BIT 同步为无符号整数, BIT(64) 超出 bigint 的范围
+		if m := mysqlNumericTypeRegex.FindStringSubmatch(columnType); m != nil && m[1] == "64" {
+			return "numeric(20)"
+		}
+		return "bigint"
+	case "year":
+		return "smallint"
+	case "date":
+		return "date"
+	case "datetime", "timestamp":
+		return "timestamp"
+	case "time":
+		return "interval"
+	case "char", "varchar":
+		if m := mysqlNumericTypeRegex.FindStringSubmatch(columnType); m != nil {
+			return fmt.Sprintf("varchar(%s)", m[1])
+		}
+		return "text"
+	case "json":
+		return "jsonb"
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob",
+		"geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection":
+		return "bytea"
+	}
+	// text 类型、enum、set 等
+	return "text"
+}
+
+// postgresValue 把 binlog 或全量查询的值转为目标字段类型可以接受的值, BIT/ENUM/SET 已由 normalizeChange 转为整数和成员名
+func postgresValue(value interface{}, pgType string) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		// MySQL 的零值日期在 PostgreSQL 中无效
+		if (pgType == "date" || pgType == "timestamp") && strings.HasPrefix(v, "0000-00-00") {
+			return nil
+		}
+		if pgType == "boolean" {
+			return v != "0" && v != ""
+		}
+		return v
+	case []byte:
+		if pgType == "bytea" {
+			return v
+		}
+		return string(v)
+	case uint64:
+		// database/sql 不支持大于 int64 的无符号整数
+		return fmt.Sprint(v)
+	case int8, int16, int32, int64, int:
+		if pgType == "boolean" {
+			return fmt.Sprint(v) != "0"
+		}
+		return v
+	}
+	return value
+}
+
+func quotePostgresNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	return strings.Join(quoted, ",")
+}
+
+func (t *postgresTarget) Write(ctx context.Context, change *binlog.Change) error {
+	table := t.tables[change.Table.Schema+"."+change.Table.Name]
+	if table == nil {
+		return nil
+	}
+	// 按目标表的字段取值, 源表 DDL 新增的字段不同步
+	pick := func(row []interface{}, columns []string) []interface{} {
+		values := make([]interface{}, len(columns))
+		for i, col := range columns {
+			if idx := change.Table.ColumnIndex(col); idx >= 0 && idx < len(row) {
+				values[i] = postgresValue(row[idx], table.types[col])
+			}
+		}
+		return values
+	}
+
+	for _, row := range change.Rows {
+		switch {
+		case isSnapshot(change):
+			t.copyRows[table] = append(t.copyRows[table], pick(row.After, table.columns))
+		case change.Type == binlog.Insert:
+			t.ops = append(t.ops, postgresOp{table: table, key: fmt.Sprint(pick(row.After, table.pk)), values: pick(row.After, table.columns)})
+		case change.Type == binlog.Update:
+			// 主键被修改时先删除旧记录
+			oldKey, newKey := pick(row.Before, table.pk), pick(row.After, table.pk)
+			if fmt.Sprint(oldKey) != fmt.Sprint(newKey) {
+				t.ops = append(t.ops, postgresOp{table: table, delete: true, values: oldKey})
+			}
+			t.ops = append(t.ops, postgresOp{table: table, key: fmt.Sprint(newKey), values: pick(row.After, table.columns)})
+		case change.Type == binlog.Delete:
+			t.ops = append(t.ops, postgresOp{table: table, delete: true, values: pick(row.Before, table.pk)})
+		}
+		t.pending++
+	}
+	if t.pending >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush 在一个事务中写入全量的 COPY 数据和增量操作
+func (t *postgresTarget) Flush(ctx context.Context) error {
+	if t.pending == 0 {
+		return nil
+	}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for table, rows := range t.copyRows {
+		if err := copyPostgresRows(ctx, tx, table, rows); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("copy into postgres table %s failed: %v", table.name, err)
+		}
+	}
+	for start := 0; start < len(t.ops); {
+		end := start + 1
+		limit := postgresMaxPlaceholders / len(t.ops[start].values)
+		keys := map[string]bool{t.ops[start].key: true}
+		for end < len(t.ops) && end-start < limit && t.ops[end].table == t.ops[start].table && t.ops[end].delete == t.ops[start].delete {
+			if !t.ops[end].delete && keys[t.ops[end].key] {
+				break
+			}
+			keys[t.ops[end].key] = true
+			end++
+		}
+		query, args := postgresStatement(t.ops[start:end])
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			log.Error().Err(err).Msgf("execute on postgres failed: %s", query)
+			return err
+		}
+		start = end
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	t.copyRows = make(map[*postgresTable][][]interface{})
+	t.ops = t.ops[:0]
+	t.pending = 0
+	return nil
+}
+
+// copyPostgresRows 先 COPY 到临时表再合并到目标表, 重新执行全量同步时不会因为主键冲突失败
+func copyPostgresRows(ctx context.Context, tx *sql.Tx, table *postgresTable, rows [][]interface{}) error {
+	const tmp = "dbkit_copy"
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s) ON COMMIT DROP", tmp, table.name)); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(tmp, table.columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	columns := quotePostgresNames(table.columns)
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) DO UPDATE SET %s",
+		table.name, columns, columns, tmp, quotePostgresNames(table.pk), postgresExcluded(table.columns))
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DROP TABLE "+tmp)
+	return err
+}
+
+func postgresExcluded(columns []string) string {
+	sets := make([]string, len(columns))
+	for i, col := range columns {
+		sets[i] = fmt.Sprintf("%s=EXCLUDED.%s", pq.QuoteIdentifier(col), pq.QuoteIdentifier(col))
+	}
+	return strings.Join(sets, ",")
+}
+
+// postgresStatement 把同一个表的同类操作合并为一条语句
+func postgresStatement(ops []postgresOp) (string, []interface{}) {
+	table := ops[0].table
+	var args []interface{}
+	tuples := make([]string, len(ops))
+	for i, op := range ops {
+		placeholders := make([]string, len(op.values))
+		for j := range op.values {
+			placeholders[j] = fmt.Sprintf("$%d", len(args)+j+1)
+		}
+		tuples[i] = "(" + strings.Join(placeholders, ",") + ")"
+		args = append(args, op.values...)
+	}
+	if ops[0].delete {
+		return fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s)", table.name, quotePostgresNames(table.pk), strings.Join(tuples, ",")), args
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON CONFLICT (%s) DO UPDATE SET %s",
+		table.name, quotePostgresNames(table.columns), strings.Join(tuples, ","), quotePostgresNames(table.pk), postgresExcluded(table.columns)), args
+}
+
+func (t *postgresTarget) Close() error {
+	return t.db.Close()
+}
@@ -0,0 +1,18 @@
+package sync
+
+import "testing"
+
+func TestPostgresBitEnumValue(t *testing.T) {
+	for columnType, expect := range map[string]string{"bit(1)": "bigint", "bit(63)": "bigint", "bit(64)": "numeric(20)"} {
+		if pgType := postgresType("bit", columnType); pgType != expect {
+			t.Errorf("postgresType(%s) = %s, expect %s", columnType, pgType, expect)
+		}
+	}
+	// BIT 和 ENUM/SET 经 normalizeChange 后为整数和成员名
+	if v := postgresValue(uint64(1<<63), "numeric(20)"); v != "9223372036854775808" {
+		t.Errorf("bit(64) value is %#v", v)
+	}
+	if v := postgresValue("small", "text"); v != "small" {
+		t.Errorf("enum value is %#v", v)
+	}
+}
@@ -1,585 +1,400 @@
 package sync
 
 import (
-	"database/sql"
-	"example.com/m/v2/conf"
-	"example.com/m/v2/model"
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/go-mysql-org/go-mysql/mysql"
-	"github.com/go-mysql-org/go-mysql/replication"
-	"github.com/go-redis/redis/v8"
-	"github.com/rs/zerolog/log"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
 )
 
-var PrimaryKeyIndex []int
+const (
+	RedisFormatHash   = "hash"
+	RedisFormatJSON   = "json"
+	RedisFormatReJSON = "rejson"
+
+	redisDefaultKey = "{table}:{pk}"
+)
+
+var redisKeyPlaceholderRegex = regexp.MustCompile(`\{([^{}]+)\}`)
 
 // 初始化 Redis 客户端
 func initRedis(config *conf.Config) (redis.UniversalClient, string, error) {
-	switch config.Redis.Mode {
+	return newRedisClient(config.Redis, nil)
+}
+
+// newRedisClient 按实例配置创建客户端, db 不为 nil 时覆盖实例配置的 db
+func newRedisClient(config conf.RedisConfig, db *int) (redis.UniversalClient, string, error) {
+	switch config.Mode {
 	case "standalone":
-		return redis.NewClient(&redis.Options{
-			Addr:     config.Redis.Standalone.Addr,
-			Password: config.Redis.Standalone.Password,
-			DB:       config.Redis.Standalone.DB,
-		}), config.Redis.Mode + " " + config.Redis.Standalone.Addr, nil
+		opt := &redis.Options{
+			Addr:     config.Standalone.Addr,
+			Password: config.Standalone.Password,
+			DB:       config.Standalone.DB,
+		}
+		if db != nil {
+			opt.DB = *db
+		}
+		return redis.NewClient(opt), fmt.Sprintf("%s %s/%d", config.Mode, opt.Addr, opt.DB), nil
 	case "sentinel":
-		return redis.NewFailoverClient(&redis.FailoverOptions{
-			MasterName:    config.Redis.Sentinel.MasterName,
-			SentinelAddrs: config.Redis.Sentinel.Addrs,
-			Password:      config.Redis.Sentinel.Password,
-			DB:            config.Redis.Sentinel.DB,
-		}), config.Redis.Mode + " " + strings.Join(config.Redis.Sentinel.Addrs, ";"), nil
+		opt := &redis.FailoverOptions{
+			MasterName:    config.Sentinel.MasterName,
+			SentinelAddrs: config.Sentinel.Addrs,
+			Password:      config.Sentinel.Password,
+			DB:            config.Sentinel.DB,
+		}
+		if db != nil {
+			opt.DB = *db
+		}
+		return redis.NewFailoverClient(opt), fmt.Sprintf("%s %s/%d", config.Mode, strings.Join(opt.SentinelAddrs, ";"), opt.DB), nil
 	case "cluster":
+		if db != nil && *db != 0 {
+			return nil, "", fmt.Errorf("redis cluster 不支持选择 db %d", *db)
+		}
 		return redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:    config.Redis.Cluster.Addrs,
-			Password: config.Redis.Cluster.Password,
-		}), config.Redis.Mode + " " + strings.Join(config.Redis.Cluster.Addrs, ";"), nil
+			Addrs:    config.Cluster.Addrs,
+			Password: config.Cluster.Password,
+		}), config.Mode + " " + strings.Join(config.Cluster.Addrs, ";"), nil
 	default:
-		return nil, "", fmt.Errorf("不支持的 Redis 模式: %s", config.Redis.Mode)
+		return nil, "", fmt.Errorf("不支持的 Redis 模式: %s", config.Mode)
 	}
 }
 
-// 全量同步到redis
-func DumpFullMySQLTableToRedis(db *sql.DB, conf *conf.Config, rdb *redis.UniversalClient,
-	options *model.DaemonOptions, concurrencyLimit int) (*mysql.Position, error) {
-	if concurrencyLimit <= 0 {
-		concurrencyLimit = 3 // 默认并行导出表的数量
-	}
-
-	var (
-		binlogPos mysql.Position
-		err       error
-	)
+// redisTable 是一个表在 Redis 中的 key 模板、过期时间、写入的实例和值的格式
+type redisTable struct {
+	client     string   // clients 中的名称
+	key        string   // key 模板
+	columns    []string // key 模板中引用的字段
+	ttl        time.Duration
+	ttlColumn  string
+	format     string
+	nestedJSON bool
+}
 
-	// 开启一致性视图
-	tx, err := db.BeginTx(options.Ctx, nil)
-	if err != nil {
-		return &binlogPos, fmt.Errorf("failed to start transaction: %v", err)
-	}
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback()
-			panic(p)
-		} else if err != nil {
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-		}
-	}()
+// redisTarget 把每行数据按表的格式写入一个 hash、JSON 字符串或 RedisJSON 文档, key 按表的 key 模板生成, 带 keyPrefix 前缀.
+// update 修改了 key 时删除旧 key, delete 删除 key. 命令按实例缓存在 pipeline 中, Flush 时执行; redis_write_mode 为 single 时每个变更立即执行
+type redisTarget struct {
+	config   conf.RedisConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	clients  map[string]redis.UniversalClient
+	pipes    map[string]redis.Pipeliner
+	tables   map[string]*redisTable // db.table
+	pending  int
+}
 
-	// 获取当前的 binlog 位点
-	row := tx.QueryRow("SHOW MASTER STATUS")
-	var discard1, discard2, discard3 interface{}
-	err = row.Scan(&binlogPos.Name, &binlogPos.Pos, &discard1, &discard2, &discard3)
-	if err != nil {
-		return &binlogPos, fmt.Errorf("failed to get binlog position: %v", err)
+func newRedisTarget(syncConf *conf.Config, options *model.DaemonOptions) (*redisTarget, error) {
+	t := &redisTarget{
+		config:   syncConf.Redis,
+		syncConf: syncConf,
+		options:  options,
+		clients:  make(map[string]redis.UniversalClient),
+		pipes:    make(map[string]redis.Pipeliner),
+		tables:   make(map[string]*redisTable),
 	}
-
-	// 使用 Goroutines 并行导出多个表的数据
-	var wg sync.WaitGroup
-
-	// 遍历配置，处理每个表的数据
-	for _, mapping := range conf.Mapping {
+	for _, mapping := range syncConf.Mapping {
 		for _, table := range mapping.Tables {
-			if options.MysqlSync.WriteMode == "batch" {
-				err = dumpSingleTableDataBatchToRedis(tx, *rdb, mapping.Database, table.Table, options.MysqlSync.PrimaryKeyColumnNames[mapping.Database+"."+table.Table], table.Columns, options, options.MysqlSync.WriteBatchSize)
-			} else {
-				err = dumpSingleTableDataToRdis(tx, *rdb, mapping.Database, table.Table, options.MysqlSync.PrimaryKeyColumnNames[mapping.Database+"."+table.Table], table.Columns, options, concurrencyLimit)
-			}
+			dbTable := mapping.Database + "." + table.Table
+			rt, err := t.initTable(mapping.Database, table)
 			if err != nil {
-				log.Error().Err(err).Msgf("Failed to dump table %s.%s", mapping.Database, table.Table)
+				t.Close()
+				return nil, fmt.Errorf("redis configure of %s error: %v", dbTable, err)
 			}
+			t.tables[dbTable] = rt
 		}
 	}
-
-	// 等待所有 Goroutines 完成
-	wg.Wait()
-
-	// 提交事务
-	err = tx.Commit()
-	if err != nil {
-		return &binlogPos, fmt.Errorf("failed to commit transaction: %v", err)
-	}
-
-	// 返回 binlog 位点
-	return &binlogPos, nil
+	return t, nil
 }
 
-func dumpSingleTableDataToRdis(tx *sql.Tx, rdb redis.UniversalClient, schema string, table string,
-	PKColNames []string, columns []string, options *model.DaemonOptions, conLimit int) error {
-	columnList := strings.Join(columns, ",")
-	query := fmt.Sprintf("SELECT %s FROM %s.%s;", columnList, schema, table)
-
-	rows, err := tx.Query(query)
-	if err != nil {
-		return fmt.Errorf("failed to query table %s.%s: %v", schema, table, err)
+func (t *redisTarget) initTable(dbName string, mapping conf.TableMapping) (*redisTable, error) {
+	tableConf := conf.RedisTableConfig{}
+	if mapping.Redis != nil {
+		tableConf = *mapping.Redis
 	}
-	defer rows.Close()
-
-	dbColumns, err := rows.Columns()
-	if err != nil {
-		return fmt.Errorf("failed to get column names for %s.%s: %v", schema, table, err)
+	rt := &redisTable{
+		key:        tableConf.Key,
+		ttl:        time.Duration(tableConf.TTL) * time.Second,
+		ttlColumn:  tableConf.TTLColumn,
+		format:     tableConf.Format,
+		nestedJSON: tableConf.NestedJSON,
 	}
-	if len(dbColumns) != len(columns) {
-		return fmt.Errorf("mismatch in requested and retrieved columns for %s.%s", schema, table)
+	if rt.key == "" {
+		rt.key = redisDefaultKey
 	}
-
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, conLimit)
-
-	for rows.Next() {
-		// 存储当前行数据
-		values := make([]sql.RawBytes, len(columns))
-		scanArgs := make([]interface{}, len(columns))
-		for i := range values {
-			scanArgs[i] = &values[i]
-		}
-
-		// 读取数据并创建独立拷贝
-		if err := rows.Scan(scanArgs...); err != nil {
-			return fmt.Errorf("failed to scan rows for %s.%s: %v", schema, table, err)
-		}
-
-		rowData := make(map[string]string)
-		for i, col := range columns {
-			rowData[col] = string(values[i])
-		}
-
-		wg.Add(1)
-		sem <- struct{}{}
-		go func(rowData map[string]string) {
-			defer wg.Done()
-			defer func() { <-sem }()
-
-			redisKey := generateRedisKey(table, scanArgs, columns, PKColNames)
-
-			if err := rdb.HMSet(options.Ctx, redisKey, rowData).Err(); err != nil {
-				log.Error().Err(err).Msgf("Failed to write to Redis: key=%s", redisKey)
+	switch rt.format {
+	case "":
+		rt.format = RedisFormatHash
+	case RedisFormatHash, RedisFormatJSON, RedisFormatReJSON:
+	default:
+		return nil, fmt.Errorf("unsupported redis format: %s", rt.format)
+	}
+	// key 模板和过期时间引用的字段必须存在
+	columns := t.options.MysqlSync.TableColumnMap[dbName+"."+mapping.Table]
+	for _, m := range redisKeyPlaceholderRegex.FindAllStringSubmatch(rt.key, -1) {
+		switch m[1] {
+		case "db", "table", "pk":
+		default:
+			if !containsFold(columns, m[1]) {
+				return nil, fmt.Errorf("column %s in key %s not found", m[1], rt.key)
 			}
-		}(rowData)
+			rt.columns = append(rt.columns, m[1])
+		}
 	}
-
-	// 等待所有 Goroutine 完成
-	wg.Wait()
-
-	if err = rows.Err(); err != nil {
-		return fmt.Errorf("rows iteration error for %s.%s: %v", schema, table, err)
+	if rt.ttlColumn != "" && !containsFold(columns, rt.ttlColumn) {
+		return nil, fmt.Errorf("ttl column %s not found", rt.ttlColumn)
 	}
 
-	return nil
-}
-
-func dumpSingleTableDataBatchToRedis(tx *sql.Tx, rdb redis.UniversalClient, schema string, table string,
-	PKColNames []string, columns []string, options *model.DaemonOptions, batchSize int) error {
-	columnList := strings.Join(columns, ",")
-	query := fmt.Sprintf("SELECT %s FROM %s.%s;", columnList, schema, table)
-
-	// 执行查询
-	rows, err := tx.Query(query)
-	if err != nil {
-		return fmt.Errorf("failed to query table %s.%s: %v", schema, table, err)
-	}
-	defer rows.Close()
-
-	// 获取列名
-	dbColumns, err := rows.Columns()
-	if err != nil {
-		return fmt.Errorf("failed to get column names for %s.%s: %v", schema, table, err)
+	// 相同实例和 db 的表共用一个客户端
+	instance := t.config
+	if tableConf.Instance != "" {
+		var ok bool
+		if instance, ok = t.config.Instances[tableConf.Instance]; !ok {
+			return nil, fmt.Errorf("redis instance %s is not configured", tableConf.Instance)
+		}
 	}
-	if len(dbColumns) != len(columns) {
-		return fmt.Errorf("mismatch in requested and retrieved columns for %s.%s", schema, table)
+	rt.client = tableConf.Instance
+	if tableConf.DB != nil {
+		rt.client += "/" + strconv.Itoa(*tableConf.DB)
 	}
-
-	// 缓存批量写入的键值对
-	batch := make(map[string]map[string]interface{})
-
-	// 定义批量写入逻辑
-	writeBatch := func() error {
-		if len(batch) == 0 {
-			return nil
+	if _, ok := t.clients[rt.client]; !ok {
+		client, addrInfo, err := newRedisClient(instance, tableConf.DB)
+		if err != nil {
+			return nil, err
 		}
-
-		pipe := rdb.Pipeline() // 创建 Pipeline
-		for key, fields := range batch {
-			pipe.HMSet(options.Ctx, key, fields)
+		if err := client.Ping(t.options.Ctx).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("connect to redis %s failed: %v", addrInfo, err)
 		}
-
-		if _, err := pipe.Exec(options.Ctx); err != nil {
-			log.Error().Err(err).Msg("Failed to execute batch Redis writes")
-			return err
-		}
-
-		//每个批量间间隔50毫秒
-		time.Sleep(50 * time.Millisecond)
-		log.Debug().Msgf("Successfully wrote %d keys to Redis", len(batch))
-		batch = make(map[string]map[string]interface{}) // 清空缓存
-		return nil
+		log.Info().Msgf("connect to redis %s success", addrInfo)
+		t.clients[rt.client] = client
 	}
+	return rt, nil
+}
 
-	for rows.Next() {
-		// 存储当前行数据
-		values := make([]sql.RawBytes, len(columns))
-		scanArgs := make([]interface{}, len(columns))
-		for i := range values {
-			scanArgs[i] = &values[i]
+// redisKey 按 key 模板生成行的 key, {pk} 为主键值用 : 连接
+func (t *redisTarget) redisKey(rt *redisTable, table *binlog.Table, values []interface{}) string {
+	key := redisKeyPlaceholderRegex.ReplaceAllStringFunc(rt.key, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case "db":
+			return table.Schema
+		case "table":
+			return table.Name
+		case "pk":
+			pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[table.Schema+"."+table.Name]
+			parts := make([]string, len(pkNames))
+			for i, pk := range pkNames {
+				parts[i] = redisKeyValue(table, values, pk)
+			}
+			return strings.Join(parts, ":")
 		}
+		return redisKeyValue(table, values, name)
+	})
+	return t.config.KeyPrefix + key
+}
 
-		// 读取数据并创建独立拷贝
-		if err := rows.Scan(scanArgs...); err != nil {
-			return fmt.Errorf("failed to scan rows for %s.%s: %v", schema, table, err)
-		}
+func redisKeyValue(table *binlog.Table, values []interface{}, column string) string {
+	i := table.ColumnIndex(column)
+	if i < 0 || i >= len(values) || values[i] == nil {
+		return ""
+	}
+	switch v := values[i].(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", values[i])
+}
 
-		// 将数据添加到批量缓存中
-		rowData := make(map[string]interface{})
-		for i, col := range columns {
-			rowData[col] = string(values[i])
+// redisExpireAt 把过期时间字段的值转为时间, 字段为 NULL 或零值时返回 false
+func redisExpireAt(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case []byte:
+		return redisExpireAt(string(v))
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(n, 0), n > 0
 		}
-
-		redisKey := generateRedisKey(table, scanArgs, columns, PKColNames)
-		batch[redisKey] = rowData
-
-		// 如果达到批量大小，写入 Redis
-		if len(batch) >= batchSize {
-			if err := writeBatch(); err != nil {
-				return err
+		for _, layout := range []string{"2006-01-02 15:04:05.999999", "2006-01-02"} {
+			if at, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return at, true
 			}
 		}
+	case int64, int32, int16, int8, int, uint64, uint32, uint16, uint8, uint:
+		n, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		return time.Unix(n, 0), n > 0
 	}
-
-	// 写入剩余未达到批量大小的数据
-	if err := writeBatch(); err != nil {
-		return err
-	}
-
-	if err = rows.Err(); err != nil {
-		return fmt.Errorf("rows iteration error for %s.%s: %v", schema, table, err)
-	}
-
-	return nil
+	return time.Time{}, false
 }
 
-// 增量同步主逻辑
-func syncBinlogToRedis(syncer *replication.BinlogSyncer, redisClient *redis.UniversalClient, position *mysql.Position,
-	syncConf *conf.Config, options *model.DaemonOptions, db *sql.DB) error {
-	streamer, err := syncer.StartSync(*position)
-	if err != nil {
-		log.Error().Err(err).Msg("启动 Binlog 同步失败")
-		return err
+func (t *redisTarget) Write(ctx context.Context, change *binlog.Change) error {
+	rt := t.tables[change.Table.Schema+"."+change.Table.Name]
+	if rt == nil {
+		return nil
+	}
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	pipe := t.pipes[rt.client]
+	if pipe == nil {
+		pipe = t.clients[rt.client].Pipeline()
+		t.pipes[rt.client] = pipe
 	}
-	log.Info().Msg("increase sync begin running...")
-
-	var i int64
-	t := time.Duration(options.MysqlSync.WriteTimeInterval) * time.Second
-	timer := time.NewTimer(t)
-	defer timer.Stop() // 确保退出时停止计时器
 
-	for {
-		select {
-		// 定时器触发刷新位点
-		case <-timer.C:
-			err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%d", position.Name, position.Pos))
-			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("定时器触发时保存 Binlog 位点失败: %s", position.String()))
-				return err
+	for _, row := range change.Rows {
+		if change.Type == binlog.Delete {
+			pipe.Del(ctx, t.redisKey(rt, change.Table, row.Before))
+			t.pending++
+			continue
+		}
+		key := t.redisKey(rt, change.Table, row.After)
+		if change.Type == binlog.Update {
+			if oldKey := t.redisKey(rt, change.Table, row.Before); oldKey != key {
+				pipe.Del(ctx, oldKey)
+				t.pending++
 			}
-			log.Debug().Msg(fmt.Sprintf("定时器触发保存 Binlog 位点成功: %s", position.String()))
-			// 重置计时器
-			timer.Reset(t)
-
-		// 处理 Binlog 事件
-		default:
-			ev, err := streamer.GetEvent(options.Ctx)
-			if err != nil {
-				log.Error().Err(err).Msg("读取 Binlog 事件失败")
-				return err
+		}
+		fields := redisDocument(rt, change.Table, mapping, row.After)
+		if len(fields) == 0 {
+			continue
+		}
+		if rt.format == RedisFormatHash {
+			values := make(map[string]interface{}, len(fields))
+			for name, value := range fields {
+				values[name] = redisHashValue(value)
 			}
-			position.Pos = ev.Header.LogPos
-
-			// 每达到事件阈值刷新位点
-			if i%options.MysqlSync.WriteEventInterval == 0 {
-				err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%d", position.Name, position.Pos))
-				if err != nil {
-					log.Error().Err(err).Msg(fmt.Sprintf("事件触发时保存 Binlog 位点失败: %s", position.String()))
-					return err
-				}
-				log.Debug().Msg(fmt.Sprintf("事件触发保存 Binlog 位点成功: %s", position.String()))
-				// 重置计时器
-				timer.Reset(t)
+			pipe.HSet(ctx, key, values)
+		} else {
+			data, err := json.Marshal(fields)
+			if err != nil {
+				return fmt.Errorf("encode %s failed: %v", key, err)
 			}
-			i++
-
-			switch e := ev.Event.(type) {
-			case *replication.RowsEvent:
-				for _, mapping := range syncConf.Mapping {
-					for _, table := range mapping.Tables {
-						if string(e.Table.Schema) == mapping.Database && string(e.Table.Table) == table.Table {
-							processRowsEvent(redisClient, ev, syncConf, options)
-						}
-					}
-				}
-			case *replication.RotateEvent:
-				position.Name = string(e.NextLogName)
-				position.Pos = uint32(e.Position)
-				log.Debug().Msg(fmt.Sprintf("切换到 Binlog 文件: %s, 位点: %d", position.Name, position.Pos))
-
-			case *replication.QueryEvent:
-				// 检测表的 DDL 变更并刷新列名
-				sqlStr := strings.ReplaceAll(strings.ToUpper(string(e.Query)), "`", "")
-				ddlRegex := regexp.MustCompile(`(?i)^\s*ALTER\s+TABLE\s+(?:\w+\.)?(users)\s+ADD\s+COLUMN`)
-				match := ddlRegex.FindStringSubmatch(sqlStr)
-				if len(match) > 0 {
-					err = FlushColumnNames(options, db, syncConf)
-					if err != nil {
-						log.Error().Err(err).Msg("刷新表列名失败")
-						return err
-					}
-				}
-
-			default:
-				// 处理其他类型事件
+			if rt.format == RedisFormatJSON {
+				pipe.Set(ctx, key, data, 0)
+			} else {
+				pipe.Do(ctx, "JSON.SET", key, ".", data)
 			}
 		}
-	}
-}
-
-// 处理行事件
-func processRowsEvent(redisClient *redis.UniversalClient, event *replication.BinlogEvent, syncConf *conf.Config, options *model.DaemonOptions) {
-	// 确保事件是 RowsEvent 类型
-	rowsEvent, ok := event.Event.(*replication.RowsEvent)
-	if !ok {
-		log.Warn().Msgf("未处理的事件类型: %v", event.Header.EventType)
-		return
+		t.pending++
+		t.expire(ctx, pipe, rt, change.Table, key, row.After)
 	}
 
-	eventDB := string(rowsEvent.Table.Schema)
-	eventTable := string(rowsEvent.Table.Table)
-
-	// 根据事件类型进行处理
-	switch event.Header.EventType {
-	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
-		_ = handleInsertEvent(*redisClient, syncConf, rowsEvent, options)
-	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
-		_ = handleUpdateEvent(*redisClient, syncConf, rowsEvent, options)
-	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
-		_ = handleDeleteEvent(*redisClient, syncConf, rowsEvent, options)
-	default:
-		log.Debug().Msgf("未处理的事件类型: %s.%s - EventType: %v", eventDB, eventTable, event.Header.EventType)
+	if t.pending >= t.options.MysqlSync.WriteBatchSize || t.options.MysqlSync.WriteMode == "single" {
+		return t.Flush(ctx)
 	}
+	return nil
 }
 
-func handleInsertEvent(client redis.UniversalClient, syncConf *conf.Config, e *replication.RowsEvent, options *model.DaemonOptions) error {
-	var redisKey string
-	// 遍历配置的映射关系
-	for _, confMap := range syncConf.Mapping {
-		if confMap.Database == string(e.Table.Schema) {
-			for _, table := range confMap.Tables {
-				if table.Table == string(e.Table.Table) {
-					//data := make(map[string]interface{})
-					eventDB := string(e.Table.Schema)
-					eventTable := string(e.Table.Table)
-					columns := options.MysqlSync.TableColumnMap[eventDB+"."+eventTable]
-					rowsBatch := make(map[string]map[string]interface{}) // 批量缓存
-
-					for _, row := range e.Rows {
-						redisKey = generateRedisKey(
-							table.Table,
-							row,
-							table.Columns,
-							options.MysqlSync.PrimaryKeyColumnNames[confMap.Database+"."+table.Table],
-						)
-						//log.Info().Msg(fmt.Sprintf("redisKey:%s", redisKey))
-
-						// 构造当前行的数据
-						data := make(map[string]interface{})
-						for i, col := range columns {
-							if i <= len(row)-1 { // 避免因为数据表加了字段，导致从元数据获得的列大于 binlog 中的列
-								for _, selectColumn := range table.Columns {
-									if strings.ToLower(col) == strings.ToLower(selectColumn) {
-										data[col] = row[i]
-									}
-								}
-							}
-						}
-
-						// 添加到批量缓存
-						rowsBatch[redisKey] = data
-
-						// 如果达到批量大小，写入 Redis
-						if len(rowsBatch) >= options.MysqlSync.WriteBatchSize {
-							if err := writeBatchToRedis(client, rowsBatch, options); err != nil {
-								log.Error().Err(err).Msg("Failed to write batch to Redis")
-							}
-							rowsBatch = make(map[string]map[string]interface{}) // 清空缓存
-						}
-					}
-
-					// 写入剩余数据
-					if len(rowsBatch) > 0 {
-						if err := writeBatchToRedis(client, rowsBatch, options); err != nil {
-							log.Error().Err(err).Msg("Failed to write final batch to Redis")
-						}
-					}
-
-				}
-			}
+// redisDocument 把同步的字段转为统一类型的值, 全量和增量同步的结果相同: 整数为 int64/uint64, FLOAT/DOUBLE 为浮点数,
+// DECIMAL 为 json.Number, BIT 为整数, ENUM/SET 为成员字符串, 时间为去掉末尾 0 的字符串, 二进制为 []byte(JSON 中为 base64),
+// JSON 字段开启 nestedJson 时为嵌套的 JSON, NULL 为 nil
+func redisDocument(rt *redisTable, table *binlog.Table, mapping *conf.TableMapping, values []interface{}) map[string]interface{} {
+	doc := rowDocument(table, mapping, values)
+	for _, col := range table.Columns {
+		value, ok := doc[col.Name]
+		if !ok || value == nil {
+			continue
 		}
+		doc[col.Name] = redisColumnValue(rt, col, value)
 	}
-
-	return nil
+	return doc
 }
 
-func handleUpdateEvent(client redis.UniversalClient, syncConf *conf.Config, e *replication.RowsEvent, options *model.DaemonOptions) error {
-	var redisKey string
-	// 遍历配置的映射关系
-	for _, confMap := range syncConf.Mapping {
-		if confMap.Database == string(e.Table.Schema) {
-			for _, table := range confMap.Tables {
-				if table.Table == string(e.Table.Table) {
-					//data := make(map[string]interface{})
-					eventDB := string(e.Table.Schema)
-					eventTable := string(e.Table.Table)
-					columns := options.MysqlSync.TableColumnMap[eventDB+"."+eventTable]
-					/*
-						for i := 0; i < len(e.Rows); i += 2 {
-							_ = e.Rows[i]
-							after := e.Rows[i+1]
-							// 生成 Redis Key
-							redisKey = generateRedisKey(table.Table, after, table.Columns, options.MysqlSync.PrimaryKeyColumnNames[confMap.Database+"."+table.Table])
-							for i, col := range columns {
-								for _, selectColumn := range table.Columns {
-									if strings.ToLower(col) == strings.ToLower(selectColumn) {
-										data[col] = after[i]
-									}
-								}
-							}
-							// 写入 Redis
-							if err := client.HMSet(options.Ctx, redisKey, data).Err(); err != nil {
-								log.Error().Err(err).Msg(fmt.Sprintf("Failed to write to Redis: key=%s", redisKey))
-							}
-
-							// 打印调试信息
-							log.Debug().Str("key", redisKey).Interface("data", data).Msg("Debugging Redis HSet update")
-						}
-					*/
-
-					rowsBatch := make(map[string]map[string]interface{}) // 批量缓存
-
-					for i := 0; i < len(e.Rows); i += 2 {
-						_ = e.Rows[i]
-						after := e.Rows[i+1]
-						redisKey = generateRedisKey(
-							table.Table,
-							after,
-							table.Columns,
-							options.MysqlSync.PrimaryKeyColumnNames[confMap.Database+"."+table.Table],
-						)
-						//log.Info().Msg(fmt.Sprintf("redisKey:%s", redisKey))
-
-						// 构造当前行的数据
-						data := make(map[string]interface{})
-						for i, col := range columns {
-							if i <= len(after)-1 { // 避免因为数据表加了字段，导致从元数据获得的列大于 binlog 中的列
-								for _, selectColumn := range table.Columns {
-									if strings.ToLower(col) == strings.ToLower(selectColumn) {
-										data[col] = after[i]
-									}
-								}
-							}
-						}
-
-						// 添加到批量缓存
-						rowsBatch[redisKey] = data
-
-						// 如果达到批量大小，写入 Redis
-						if len(rowsBatch) >= options.MysqlSync.WriteBatchSize {
-							if err := writeBatchToRedis(client, rowsBatch, options); err != nil {
-								log.Error().Err(err).Msg("Failed to write batch to Redis")
-							}
-							rowsBatch = make(map[string]map[string]interface{}) // 清空缓存
-						}
-					}
-
-					// 写入剩余数据
-					if len(rowsBatch) > 0 {
-						if err := writeBatchToRedis(client, rowsBatch, options); err != nil {
-							log.Error().Err(err).Msg("Failed to write final batch to Redis")
-						}
-					}
-				}
-			}
+func redisColumnValue(rt *redisTable, col binlog.Column, value interface{}) interface{} {
+	switch col.Type {
+	case "decimal":
+		if s := redisString(value); s != "" {
+			return json.Number(s)
+		}
+	case "datetime", "timestamp", "time":
+		// 全量同步的小数秒固定为 6 位, binlog 中按字段精度输出, 统一去掉末尾的 0
+		if s := redisString(value); strings.Contains(s, ".") {
+			return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		}
+	case "json":
+		s := redisString(value)
+		if rt.nestedJSON && json.Valid([]byte(s)) {
+			return json.RawMessage(s)
 		}
+		return s
 	}
-
-	return nil
+	return value
 }
 
-func handleDeleteEvent(client redis.UniversalClient, syncConf *conf.Config, e *replication.RowsEvent, options *model.DaemonOptions) error {
-	var redisKeys []string
-	// 遍历配置的映射关系
-	for _, confMap := range syncConf.Mapping {
-		if confMap.Database == string(e.Table.Schema) {
-			for _, table := range confMap.Tables {
-				if table.Table == string(e.Table.Table) {
-					for _, row := range e.Rows {
-						redisKey := generateRedisKey(table.Table, row, table.Columns, options.MysqlSync.PrimaryKeyColumnNames[confMap.Database+"."+table.Table])
-						redisKeys = append(redisKeys, redisKey)
-					}
-					re := client.Del(options.Ctx, redisKeys...)
-
-					// 打印调试信息
-					log.Info().Msg(fmt.Sprintf("batch delete result:%s", re.String()))
-				}
-			}
-		}
+func redisString(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
 	}
-
-	return nil
+	return fmt.Sprint(value)
 }
 
-// 构建rediskey
-func generateRedisKey(table string, row []interface{}, columns []string, primaryKeyColumnNames []string) string {
-	var keyParts []string
-	keyParts = append(keyParts, table)
-	//log.Info().Msg(fmt.Sprintf("row data: %v, columns: %v, pk name:%v", row, columns, primaryKeyColumnNames))
+// redisHashValue 把字段值转为 hash 中的字符串, NULL 为空串
+func redisHashValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		return string(v)
+	case json.RawMessage:
+		return string(v)
+	}
+	return value
+}
 
-	// 使用主键列名找到对应的值，并构建 Redis 键
-	for _, pk := range primaryKeyColumnNames {
-		for i, col := range columns {
-			//log.Info().Msg(fmt.Sprintf("debug: col-%v pk-%v", col, pk))
-			if strings.ToLower(col) == strings.ToLower(pk) {
-				value := row[i]
-				switch v := value.(type) {
-				case []byte:
-					keyParts = append(keyParts, value.(string))
-				case *sql.RawBytes:
-					keyParts = append(keyParts, string(*v))
-				case string:
-					keyParts = append(keyParts, v)
-				default:
-					keyParts = append(keyParts, fmt.Sprintf("%v", v))
-				}
+// expire 设置 key 的过期时间: 过期时间字段不为 NULL 时使用 EXPIREAT, 否则使用固定的 ttl; 只配置了过期时间字段且为 NULL 时取消过期
+func (t *redisTarget) expire(ctx context.Context, pipe redis.Pipeliner, rt *redisTable, table *binlog.Table, key string, values []interface{}) {
+	if rt.ttlColumn != "" {
+		if i := table.ColumnIndex(rt.ttlColumn); i >= 0 && i < len(values) {
+			if at, ok := redisExpireAt(values[i]); ok {
+				pipe.ExpireAt(ctx, key, at)
+				t.pending++
+				return
 			}
 		}
 	}
-	return strings.Join(keyParts, ":")
+	switch {
+	case rt.ttl > 0:
+		pipe.Expire(ctx, key, rt.ttl)
+		t.pending++
+	case rt.ttlColumn != "":
+		pipe.Persist(ctx, key)
+		t.pending++
+	}
 }
 
-func writeBatchToRedis(client redis.UniversalClient, batch map[string]map[string]interface{}, options *model.DaemonOptions) error {
-	pipe := client.Pipeline()
-	for key, fields := range batch {
-		pipe.HMSet(options.Ctx, key, fields)
+// Flush 执行每个实例缓存的命令
+func (t *redisTarget) Flush(ctx context.Context) error {
+	if t.pending == 0 {
+		return nil
 	}
-
-	_, err := pipe.Exec(options.Ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to execute batch Redis writes")
-		return err
+	for name, pipe := range t.pipes {
+		if pipe.Len() == 0 {
+			continue
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("write redis %s failed: %v", name, err)
+		}
 	}
+	log.Debug().Msgf("Successfully executed %d redis commands", t.pending)
+	t.pending = 0
+	return nil
+}
 
-	log.Debug().Msgf("Successfully wrote %d keys to Redis", len(batch))
+func (t *redisTarget) Close() error {
+	for _, client := range t.clients {
+		client.Close()
+	}
 	return nil
 }
@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-redis/redis/v8"
+)
+
+const redisDefaultStreamKey = "{db}:{table}:changes"
+
+// redisStreamTarget 把每行变更用 XADD 追加到表对应的 stream, 消费者可以用消费组可靠地处理变更.
+// 字段为 op/database/table/pk/before/after/file/pos/gtid/ts, before/after 为 JSON, 全量同步的行带 snapshot=true
+type redisStreamTarget struct {
+	client   redis.UniversalClient
+	config   conf.RedisStreamConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	entries  []*redis.XAddArgs
+}
+
+func newRedisStreamTarget(client redis.UniversalClient, syncConf *conf.Config, options *model.DaemonOptions) *redisStreamTarget {
+	config := syncConf.Redis.Stream
+	if config.Key == "" {
+		config.Key = redisDefaultStreamKey
+	}
+	return &redisStreamTarget{client: client, config: config, syncConf: syncConf, options: options}
+}
+
+// streamKey 返回表对应的 stream: key 模板中的 {db} {table} 替换为库名表名, 不带时所有表写入同一个 stream
+func (t *redisStreamTarget) streamKey(dbName, tableName string) string {
+	return strings.NewReplacer("{db}", dbName, "{table}", tableName).Replace(t.config.Key)
+}
+
+func (t *redisStreamTarget) Write(ctx context.Context, change *binlog.Change) error {
+	stream := t.streamKey(change.Table.Schema, change.Table.Name)
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+
+	for _, row := range change.Rows {
+		values := map[string]interface{}{
+			"op":       string(change.Type),
+			"database": change.Table.Schema,
+			"table":    change.Table.Name,
+			"pk":       rowKey(change.Table, pkNames, row.Image()),
+			"file":     change.Position.Name,
+			"pos":      strconv.FormatUint(uint64(change.Position.Pos), 10),
+			"gtid":     change.GTID,
+			"ts":       strconv.FormatInt(change.Timestamp.Unix(), 10),
+		}
+		if isSnapshot(change) {
+			values["snapshot"] = "true"
+		}
+		for field, image := range map[string][]interface{}{"before": row.Before, "after": row.After} {
+			if image == nil {
+				continue
+			}
+			data, err := json.Marshal(rowDocument(change.Table, mapping, image))
+			if err != nil {
+				return fmt.Errorf("encode %s of %s.%s failed: %v", field, change.Table.Schema, change.Table.Name, err)
+			}
+			values[field] = string(data)
+		}
+		t.entries = append(t.entries, &redis.XAddArgs{
+			Stream: stream,
+			MaxLen: t.config.MaxLen,
+			Approx: t.config.MaxLen > 0 && !t.config.ExactTrim,
+			Values: values,
+		})
+	}
+	if len(t.entries) >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush 用 pipeline 按顺序执行缓存的 XADD
+func (t *redisStreamTarget) Flush(ctx context.Context) error {
+	if len(t.entries) == 0 {
+		return nil
+	}
+	pipe := t.client.Pipeline()
+	for _, args := range t.entries {
+		pipe.XAdd(ctx, args)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis xadd failed: %v", err)
+	}
+	t.entries = t.entries[:0]
+	return nil
+}
+
+// Close 不关闭 client, client 由调用方关闭
+func (t *redisStreamTarget) Close() error {
+	return nil
+}
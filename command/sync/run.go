@@ -3,6 +3,7 @@ package sync
 import (
 	"errors"
 	"example.com/m/v2/command/binlogsql"
+	"example.com/m/v2/common"
 	"example.com/m/v2/conf"
 	"example.com/m/v2/model"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"github.com/go-mysql-org/go-mysql/replication"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/rs/zerolog/log"
+	"strings"
 )
 
 func Run(options *model.DaemonOptions, _args []string) error {
@@ -20,6 +22,9 @@ func Run(options *model.DaemonOptions, _args []string) error {
 
 	options.MysqlSync.PrimaryKeyColumnNames = make(map[string][]string)
 	options.MysqlSync.TableColumnMap = make(map[string][]string)
+	options.MysqlSync.TableColumnTypes = make(map[string][]string)
+	options.MysqlSync.TableColumnCharsets = make(map[string][]string)
+	options.MysqlSync.TableColumnMembers = make(map[string][][]string)
 
 	// 检查配置文件是否存在，优先加载文件配置
 	if options.MysqlSync.ConfigFile != "" {
@@ -71,6 +76,20 @@ func Run(options *model.DaemonOptions, _args []string) error {
 		}
 	}
 
+	// 字段脱敏规则, 主键用于定位目标端记录, 不做脱敏
+	options.MysqlSync.Masker, err = common.NewMasker(SyncConfig.Mask)
+	if err != nil {
+		return fmt.Errorf("mask configure error: %v", err)
+	}
+	for dbTable, pkNames := range options.MysqlSync.PrimaryKeyColumnNames {
+		dbName, tableName, _ := strings.Cut(dbTable, ".")
+		for _, pk := range pkNames {
+			if options.MysqlSync.Masker.Enabled(dbName, tableName, pk) {
+				log.Warn().Msgf("mask rule matches primary key %s.%s, primary key is not masked", dbTable, pk)
+			}
+		}
+	}
+
 	// 检查数据源同步模式
 	var position *mysql.Position
 	switch SyncConfig.Source.Mode {
@@ -94,34 +113,22 @@ func Run(options *model.DaemonOptions, _args []string) error {
 	//目标端处理
 	switch SyncConfig.Target.Type {
 	case "redis":
-		// 初始化目标客户端（Redis）
-		redisClient, addrInfo, err := initRedis(SyncConfig)
-		if err != nil {
-			log.Error().Err(err).Msg("init redis client error")
-			return err
-		}
-		defer redisClient.Close()
-
-		if SyncConfig.Source.Mode == "full" {
-			log.Info().Msg(fmt.Sprintf("开始全量同步 MySQL 数据到 Redis %s", addrInfo))
-			//全量同步
-			position, err = DumpFullMySQLTableToRedis(db, SyncConfig, &redisClient, options, 3)
-			if err != nil {
-				log.Error().Err(err).Msg("全量同步失败")
-				return err
-			}
-			log.Info().Msg("全量同步成功")
-			err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%s", position.Name, position.Pos))
+		if SyncConfig.Redis.Stream.Enabled {
+			redisClient, addrInfo, err := initRedis(SyncConfig)
 			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("save binlog to %s failed: %s", options.MysqlSync.ConfigFile, position.String()))
+				log.Error().Err(err).Msg("init redis client error")
 				return err
 			}
-			log.Error().Err(err).Msg(fmt.Sprintf("save binlog to %s success: %s", options.MysqlSync.ConfigFile, position.String()))
+			defer redisClient.Close()
+			log.Info().Msg(fmt.Sprintf("同步变更事件到 Redis Streams %s", addrInfo))
+			return syncToTarget(db, syncer, position, SyncConfig, options, newRedisStreamTarget(redisClient, SyncConfig, options))
 		}
-
-		// 开始增量同步
-		log.Info().Msg(fmt.Sprintf("增量同步到Redis %s, pos %s:%d", addrInfo, position.Name, position.Pos))
-		return syncBinlogToRedis(syncer, &redisClient, position, SyncConfig, options, db)
+		target, err := newRedisTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init redis client error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
 
 	case "mongodb":
 		// 初始化目标客户端（mongodb）
@@ -147,7 +154,7 @@ func Run(options *model.DaemonOptions, _args []string) error {
 				return err
 			}
 			log.Info().Msg("全量同步成功")
-			err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%s", position.Name, position.Pos))
+			err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%d", position.Name, position.Pos))
 			if err != nil {
 				log.Error().Err(err).Msg(fmt.Sprintf("save binlog to %s failed: %s", options.MysqlSync.ConfigFile, position.String()))
 				return err
@@ -160,9 +167,54 @@ func Run(options *model.DaemonOptions, _args []string) error {
 		return syncBinlogToMongoDB(syncer, mongoClient, position, SyncConfig, options, db)
 
 	case "elasticsearch":
-		return nil
+		target, err := newESTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init elasticsearch client error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
 	case "kafka":
-		return nil
+		target, err := newKafkaTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init kafka writer error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
+	case "mysql":
+		target, err := newMySQLTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init target mysql connection error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
+	case "postgres":
+		target, err := newPostgresTarget(db, SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init postgres target error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
+	case "clickhouse":
+		target, err := newClickHouseTarget(db, SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init clickhouse target error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
+	case "file":
+		target, err := newFileTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init file target error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
+	case "webhook":
+		target, err := newWebhookTarget(SyncConfig, options)
+		if err != nil {
+			log.Error().Err(err).Msg("init webhook target error")
+			return err
+		}
+		return syncToTarget(db, syncer, position, SyncConfig, options, target)
 	default:
 		return nil
 	}
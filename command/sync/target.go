@@ -0,0 +1,452 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/common"
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+// syncTarget 是基于 pkg/binlog 行变更的目标端, 全量和增量同步的数据都通过 Write 写入.
+// Write 可以只缓存变更, Flush 返回 nil 表示之前写入的变更都已被目标端确认, 之后才保存 binlog 位点
+type syncTarget interface {
+	Write(ctx context.Context, change *binlog.Change) error
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// intervalTarget 由需要大批量写入的目标端可选实现, 增量同步按返回的间隔而不是 rewrite_event_interval 触发 Flush,
+// 目标端在 Write 中按批量大小自行 Flush
+type intervalTarget interface {
+	FlushInterval() time.Duration
+}
+
+// isSnapshot 判断变更是否来自全量同步, 全量同步的行没有原始 binlog 事件
+func isSnapshot(change *binlog.Change) bool {
+	return change.Event == nil
+}
+
+// syncToTarget 按配置的同步模式先全量再增量同步到目标端
+func syncToTarget(db *sql.DB, syncer *replication.BinlogSyncer, position *mysql.Position, syncConf *conf.Config, options *model.DaemonOptions, target syncTarget) error {
+	defer target.Close()
+
+	if syncConf.Source.Mode == "full" {
+		log.Info().Msg(fmt.Sprintf("开始全量同步 MySQL 数据到 %s", syncConf.Target.Type))
+		var err error
+		position, err = dumpTablesToTarget(db, syncConf, options, target)
+		if err != nil {
+			log.Error().Err(err).Msg("全量同步失败")
+			return err
+		}
+		log.Info().Msg("全量同步成功")
+		if err = conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%d", position.Name, position.Pos)); err != nil {
+			log.Error().Err(err).Msg(fmt.Sprintf("save binlog to %s failed: %s", options.MysqlSync.ConfigFile, position.String()))
+			return err
+		}
+		log.Info().Msg(fmt.Sprintf("save binlog to %s success: %s", options.MysqlSync.ConfigFile, position.String()))
+	}
+
+	log.Info().Msg(fmt.Sprintf("增量同步到 %s, pos %s:%d", syncConf.Target.Type, position.Name, position.Pos))
+	return syncBinlogToTarget(syncer, target, position, syncConf, options, db)
+}
+
+// dumpTablesToTarget 在一致性视图中导出所有映射的表, 每 write_batch_size 行 Flush 一次, 返回导出开始时的 binlog 位点
+func dumpTablesToTarget(db *sql.DB, syncConf *conf.Config, options *model.DaemonOptions, target syncTarget) (*mysql.Position, error) {
+	var binlogPos mysql.Position
+
+	// 开启一致性视图
+	tx, err := db.BeginTx(options.Ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// 获取当前的 binlog 位点
+	row := tx.QueryRow("SHOW MASTER STATUS")
+	var discard1, discard2, discard3 interface{}
+	if err = row.Scan(&binlogPos.Name, &binlogPos.Pos, &discard1, &discard2, &discard3); err != nil {
+		return nil, fmt.Errorf("failed to get binlog position: %v", err)
+	}
+
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			if err = dumpTableToTarget(tx, mapping.Database, table.Table, binlogPos, options, target); err != nil {
+				log.Error().Err(err).Msgf("Failed to dump table %s.%s", mapping.Database, table.Table)
+				return nil, err
+			}
+		}
+	}
+	if err = target.Flush(options.Ctx); err != nil {
+		return nil, err
+	}
+	return &binlogPos, tx.Commit()
+}
+
+func dumpTableToTarget(tx *sql.Tx, dbName, tableName string, pos mysql.Position, options *model.DaemonOptions, target syncTarget) error {
+	table, err := syncSchema{options}.table(dbName, tableName)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		names[i] = "`" + col.Name + "`"
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM `%s`.`%s`", strings.Join(names, ", "), dbName, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to query table %s.%s: %v", dbName, tableName, err)
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		values := make([]interface{}, len(table.Columns))
+		scanArgs := make([]interface{}, len(values))
+		for i := range values {
+			scanArgs[i] = &values[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return fmt.Errorf("failed to scan rows for %s.%s: %v", dbName, tableName, err)
+		}
+		for i, col := range table.Columns {
+			values[i] = dumpValue(values[i], col.Type, col.Charset)
+		}
+		change := &binlog.Change{Type: binlog.Insert, Table: table, Rows: []binlog.Row{{After: values}}, Position: pos, Timestamp: time.Now()}
+		normalizeChange(change, options)
+		maskChange(change, options)
+		if err := target.Write(options.Ctx, change); err != nil {
+			return err
+		}
+		if count++; options.MysqlSync.WriteBatchSize > 0 && count%options.MysqlSync.WriteBatchSize == 0 {
+			if err := target.Flush(options.Ctx); err != nil {
+				return err
+			}
+			log.Debug().Msgf("%s.%s dumped %d rows", dbName, tableName, count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows iteration error for %s.%s: %v", dbName, tableName, err)
+	}
+	log.Info().Msgf("%s.%s dumped %d rows", dbName, tableName, count)
+	return nil
+}
+
+// dumpValue 把全量查询到的值转为与 binlog 解析结果一致的类型: 整数为 int64/uint64, 浮点数为 float64,
+// 时间为字符串, 二进制字段为 []byte, 其余为字符串
+func dumpValue(value interface{}, dataType, charset string) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		if dataType == "date" {
+			return v.Format("2006-01-02")
+		}
+		if v.Nanosecond() != 0 {
+			return v.Format("2006-01-02 15:04:05.000000")
+		}
+		return v.Format("2006-01-02 15:04:05")
+	case []byte:
+		if common.IsBinaryColumn(dataType, charset) {
+			return append([]byte(nil), v...)
+		}
+		s := string(v)
+		switch dataType {
+		case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n
+			}
+			if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return n
+			}
+		case "float", "double":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+		return s
+	}
+	return value
+}
+
+// normalizeChange 统一全量和增量同步中表示不同的字段: 全量查询得到 ENUM/SET 的成员字符串和 BIT 的原始字节,
+// binlog 中是序号, 位图和 int64. 统一后 BIT 为 uint64, ENUM 为成员, SET 为逗号连接的成员
+func normalizeChange(change *binlog.Change, options *model.DaemonOptions) {
+	members := options.MysqlSync.TableColumnMembers[change.Table.Schema+"."+change.Table.Name]
+	normalize := func(values []interface{}) {
+		for i, col := range change.Table.Columns {
+			if i >= len(values) {
+				break
+			}
+			if values[i] == nil {
+				continue
+			}
+			var m []string
+			if i < len(members) {
+				m = members[i]
+			}
+			values[i] = normalizeValue(values[i], col.Type, m)
+		}
+	}
+	for _, row := range change.Rows {
+		normalize(row.Before)
+		normalize(row.After)
+	}
+}
+
+func normalizeValue(value interface{}, dataType string, members []string) interface{} {
+	switch dataType {
+	case "bit":
+		switch v := value.(type) {
+		case []byte:
+			var buf [8]byte
+			copy(buf[8-min(len(v), 8):], v[max(len(v)-8, 0):])
+			return binary.BigEndian.Uint64(buf[:])
+		case int64:
+			return uint64(v)
+		}
+	case "enum", "set":
+		return binlog.Column{Type: dataType, Members: members}.MemberValue(value)
+	}
+	return value
+}
+
+// syncBinlogToTarget 增量同步, 在事务结束的位置记录位点, 目标端 Flush 成功后才保存到配置文件
+func syncBinlogToTarget(syncer *replication.BinlogSyncer, target syncTarget, position *mysql.Position, syncConf *conf.Config, options *model.DaemonOptions, db *sql.DB) error {
+	streamer, err := syncer.StartSync(*position)
+	if err != nil {
+		log.Error().Err(err).Msg("启动 Binlog 同步失败")
+		return err
+	}
+	log.Info().Msg("increase sync begin running...")
+
+	ctx := options.Ctx
+	decoder := binlog.NewDecoder(syncSchema{options}, mappingFilter(syncConf))
+	committed := *position // 最后一个结束的事务之后的位点
+	saved := committed
+	var events int64
+
+	flush := func(ctx context.Context) error {
+		if err := target.Flush(ctx); err != nil {
+			log.Error().Err(err).Msg("目标端写入失败")
+			return err
+		}
+		events = 0
+		if committed == saved {
+			return nil
+		}
+		if err := conf.UpdateBinlogPos(options.MysqlSync.ConfigFile, fmt.Sprintf("%s:%d", committed.Name, committed.Pos)); err != nil {
+			log.Error().Err(err).Msg(fmt.Sprintf("保存 Binlog 位点失败: %s", committed.String()))
+			return err
+		}
+		saved = committed
+		log.Debug().Msg(fmt.Sprintf("保存 Binlog 位点成功: %s", committed.String()))
+		return nil
+	}
+
+	interval := time.Duration(options.MysqlSync.WriteTimeInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	eventFlush := true
+	if it, ok := target.(intervalTarget); ok {
+		interval, eventFlush = it.FlushInterval(), false
+	}
+	deadline := time.Now().Add(interval)
+	for {
+		evCtx, cancel := context.WithDeadline(ctx, deadline)
+		ev, err := streamer.GetEvent(evCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				// 收到退出信号, 保存已确认的位点后退出
+				flushCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				return flush(flushCtx)
+			}
+			if err == context.DeadlineExceeded {
+				// 定时刷新位点
+				if err := flush(ctx); err != nil {
+					return err
+				}
+				deadline = time.Now().Add(interval)
+				continue
+			}
+			log.Error().Err(err).Msg("读取 Binlog 事件失败")
+			return err
+		}
+
+		switch e := ev.Event.(type) {
+		case *replication.RotateEvent:
+			position.Name = string(e.NextLogName)
+			position.Pos = uint32(e.Position)
+			log.Debug().Msg(fmt.Sprintf("切换到 Binlog 文件: %s, 位点: %d", position.Name, position.Pos))
+		case *replication.XIDEvent:
+			committed = mysql.Position{Name: position.Name, Pos: ev.Header.LogPos}
+		case *replication.QueryEvent:
+			// 非事务引擎的 COMMIT 和 DDL 也是事务结束
+			query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+			if query == "COMMIT" || binlog.IsDDL(query) {
+				committed = mysql.Position{Name: position.Name, Pos: ev.Header.LogPos}
+			}
+		}
+
+		change, err := decoder.Decode(ev, position.Name)
+		if err != nil {
+			log.Error().Err(err).Msg("解析 Binlog 事件失败")
+			return err
+		}
+		if change != nil {
+			if change.Type == binlog.DDL {
+				// 映射的表结构变化, 重新加载字段
+				if err := FlushColumnNames(options, db, syncConf); err != nil {
+					log.Error().Err(err).Msg("刷新表列名失败")
+					return err
+				}
+			} else {
+				normalizeChange(change, options)
+				maskChange(change, options)
+				if err := target.Write(ctx, change); err != nil {
+					log.Error().Err(err).Msg("目标端写入失败")
+					return err
+				}
+			}
+		}
+
+		// 每达到事件阈值刷新位点
+		if events++; eventFlush && events >= options.MysqlSync.WriteEventInterval {
+			if err := flush(ctx); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(interval)
+		}
+	}
+}
+
+// syncSchema 使用 FlushColumnNames 加载的字段信息作为 binlog 行数据的表结构
+type syncSchema struct {
+	options *model.DaemonOptions
+}
+
+func (s syncSchema) TableColumns(schema, table string) ([]binlog.Column, error) {
+	dbTable := schema + "." + table
+	names := s.options.MysqlSync.TableColumnMap[dbTable]
+	types := s.options.MysqlSync.TableColumnTypes[dbTable]
+	charsets := s.options.MysqlSync.TableColumnCharsets[dbTable]
+	members := s.options.MysqlSync.TableColumnMembers[dbTable]
+	columns := make([]binlog.Column, len(names))
+	for i, name := range names {
+		columns[i] = binlog.Column{Name: name, Type: types[i], Charset: charsets[i]}
+		if i < len(members) {
+			columns[i].Members = members[i]
+		}
+	}
+	return columns, nil
+}
+
+func (s syncSchema) table(schema, table string) (*binlog.Table, error) {
+	columns, _ := s.TableColumns(schema, table)
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no column information of %s.%s", schema, table)
+	}
+	return &binlog.Table{Schema: schema, Name: table, Columns: columns}, nil
+}
+
+// mappingFilter 只返回配置文件 mapping 中的表的变更
+func mappingFilter(syncConf *conf.Config) binlog.Filter {
+	return func(c *binlog.Change) bool {
+		if c.Type == binlog.DDL && c.Table.Name == "" {
+			for _, mapping := range syncConf.Mapping {
+				if mapping.Database == c.Table.Schema {
+					return true
+				}
+			}
+			return false
+		}
+		return findTableMapping(syncConf, c.Table.Schema, c.Table.Name) != nil
+	}
+}
+
+// findTableMapping 返回表的映射配置, 不在配置中时返回 nil
+func findTableMapping(syncConf *conf.Config, dbName, tableName string) *conf.TableMapping {
+	for _, mapping := range syncConf.Mapping {
+		if mapping.Database != dbName {
+			continue
+		}
+		for i := range mapping.Tables {
+			if mapping.Tables[i].Table == tableName {
+				return &mapping.Tables[i]
+			}
+		}
+	}
+	return nil
+}
+
+// maskChange 对行变更脱敏, 主键字段保持原值
+func maskChange(change *binlog.Change, options *model.DaemonOptions) {
+	if options.MysqlSync.Masker == nil {
+		return
+	}
+	mask := func(values []interface{}) {
+		for i, value := range values {
+			if i >= len(change.Table.Columns) {
+				break
+			}
+			values[i] = maskColumn(options, change.Table.Schema, change.Table.Name, change.Table.Columns[i].Name, value)
+		}
+	}
+	for _, row := range change.Rows {
+		mask(row.Before)
+		mask(row.After)
+	}
+}
+
+// rowDocument 按映射配置的字段把一行数据转为字段名到值的映射, 没有配置字段时包含所有字段
+func rowDocument(table *binlog.Table, mapping *conf.TableMapping, values []interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(values))
+	for i, col := range table.Columns {
+		if i >= len(values) {
+			break
+		}
+		if mapping != nil && len(mapping.Columns) > 0 && !containsFold(mapping.Columns, col.Name) {
+			continue
+		}
+		doc[col.Name] = values[i]
+	}
+	return doc
+}
+
+// rowKey 返回行的主键值, 多个主键字段用 : 连接, 二进制值使用十六进制. 表没有主键时返回空串
+func rowKey(table *binlog.Table, pkNames []string, values []interface{}) string {
+	var parts []string
+	for _, pk := range pkNames {
+		i := table.ColumnIndex(pk)
+		if i < 0 || i >= len(values) {
+			return ""
+		}
+		switch v := values[i].(type) {
+		case []byte:
+			parts = append(parts, hex.EncodeToString(v))
+		default:
+			parts = append(parts, fmt.Sprintf("%v", v))
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+func containsFold(slice []string, element string) bool {
+	for _, item := range slice {
+		if strings.EqualFold(item, element) {
+			return true
+		}
+	}
+	return false
+}
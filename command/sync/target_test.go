@@ -0,0 +1,36 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+)
+
+// 全量同步和 binlog 中 BIT/ENUM/SET 的值不同, 统一后应相同
+func TestNormalizeChange(t *testing.T) {
+	table := &binlog.Table{Schema: "db", Name: "t", Columns: []binlog.Column{
+		{Name: "flags", Type: "bit"}, {Name: "size", Type: "enum"}, {Name: "tags", Type: "set"}, {Name: "name", Type: "varchar"},
+	}}
+	options := &model.DaemonOptions{MysqlSync: &model.SyncOption{TableColumnMembers: map[string][][]string{
+		"db.t": {nil, {"small", "large"}, {"a", "b", "c"}, nil},
+	}}}
+	expect := []interface{}{uint64(5), "large", "a,c", "x"}
+
+	dump := &binlog.Change{Type: binlog.Insert, Table: table, Rows: []binlog.Row{{After: []interface{}{[]byte{0x00, 0x05}, "large", "a,c", "x"}}}}
+	normalizeChange(dump, options)
+	if !reflect.DeepEqual(dump.Rows[0].After, expect) {
+		t.Errorf("dump row normalized to %#v, expect %#v", dump.Rows[0].After, expect)
+	}
+
+	row := []interface{}{int64(5), int64(2), int64(5), "x"}
+	change := &binlog.Change{Type: binlog.Update, Table: table, Rows: []binlog.Row{{Before: []interface{}{int64(0), int64(0), int64(0), nil}, After: row}}}
+	normalizeChange(change, options)
+	if !reflect.DeepEqual(change.Rows[0].After, expect) {
+		t.Errorf("binlog row normalized to %#v, expect %#v", change.Rows[0].After, expect)
+	}
+	if before := change.Rows[0].Before; !reflect.DeepEqual(before, []interface{}{uint64(0), "", "", nil}) {
+		t.Errorf("empty values normalized to %#v", before)
+	}
+}
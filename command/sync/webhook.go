@@ -0,0 +1,225 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/v2/conf"
+	"example.com/m/v2/model"
+	"example.com/m/v2/pkg/binlog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookDefaultTimeout  = 5000
+	webhookDefaultMaxRetry = 5
+
+	webhookSignatureHeader = "X-Dbkit-Signature"
+	webhookTimestampHeader = "X-Dbkit-Timestamp"
+)
+
+// webhookTarget 把行变更批量 POST 到表对应的 URL, 请求体为 {"events": [...]}, 事件格式与 kafka plain 格式相同.
+// 每个 URL 的请求按顺序发送, 上一个请求返回 2xx 后才发送下一个, 同一主键的变更按顺序送达; 不同 URL 并发发送
+type webhookTarget struct {
+	client   *http.Client
+	config   conf.WebhookConfig
+	syncConf *conf.Config
+	options  *model.DaemonOptions
+	urls     []string                     // 按首次写入顺序排列的 URL
+	events   map[string][]json.RawMessage // URL 到待发送的事件
+	pending  int
+}
+
+func newWebhookTarget(syncConf *conf.Config, options *model.DaemonOptions) (*webhookTarget, error) {
+	config := syncConf.Target.Webhook
+	// 每个表都需要一个 URL
+	for _, mapping := range syncConf.Mapping {
+		for _, table := range mapping.Tables {
+			if table.TargetName == "" && config.URL == "" {
+				return nil, fmt.Errorf("webhook url of %s.%s is not configured", mapping.Database, table.Table)
+			}
+		}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = webhookDefaultTimeout
+	}
+	if config.MaxRetry <= 0 {
+		config.MaxRetry = webhookDefaultMaxRetry
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = options.MysqlSync.WriteBatchSize
+	}
+	// write_batch_size 也可能为 0, 每个请求至少发送一个事件, 否则 Flush 会一直发送空请求
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond}
+	return &webhookTarget{client: client, config: config, syncConf: syncConf, options: options, events: make(map[string][]json.RawMessage)}, nil
+}
+
+// url 返回表对应的 URL: target_name, 或者 url, url 中的 {db} {table} 替换为库名表名
+func (t *webhookTarget) url(dbName, tableName string) string {
+	if mapping := findTableMapping(t.syncConf, dbName, tableName); mapping != nil && mapping.TargetName != "" {
+		return mapping.TargetName
+	}
+	return strings.NewReplacer("{db}", dbName, "{table}", tableName).Replace(t.config.URL)
+}
+
+func (t *webhookTarget) Write(ctx context.Context, change *binlog.Change) error {
+	url := t.url(change.Table.Schema, change.Table.Name)
+	mapping := findTableMapping(t.syncConf, change.Table.Schema, change.Table.Name)
+	pkNames := t.options.MysqlSync.PrimaryKeyColumnNames[change.Table.Schema+"."+change.Table.Name]
+
+	for _, row := range change.Rows {
+		var before, after map[string]interface{}
+		if row.Before != nil {
+			before = rowDocument(change.Table, mapping, row.Before)
+		}
+		if row.After != nil {
+			after = rowDocument(change.Table, mapping, row.After)
+		}
+		data, err := json.Marshal(plainMessage(change, pkNames, before, after))
+		if err != nil {
+			return fmt.Errorf("encode webhook event of %s.%s failed: %v", change.Table.Schema, change.Table.Name, err)
+		}
+		if _, ok := t.events[url]; !ok {
+			t.urls = append(t.urls, url)
+		}
+		t.events[url] = append(t.events[url], data)
+		t.pending++
+	}
+	if t.pending >= t.options.MysqlSync.WriteBatchSize {
+		return t.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush 并发地向每个 URL 按顺序发送缓存的事件, 全部返回 2xx 后才返回 nil
+func (t *webhookTarget) Flush(ctx context.Context) error {
+	if t.pending == 0 {
+		return nil
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(t.urls))
+	sent := make([]int, len(t.urls))
+	for i, url := range t.urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			events := t.events[url]
+			for sent[i] < len(events) {
+				end := sent[i] + t.config.BatchSize
+				if end > len(events) {
+					end = len(events)
+				}
+				if errs[i] = t.send(ctx, url, events[sent[i]:end]); errs[i] != nil {
+					return
+				}
+				sent[i] = end
+			}
+		}(i, url)
+	}
+	wg.Wait()
+
+	// 已送达的事件不再重发
+	var urls []string
+	var err error
+	for i, url := range t.urls {
+		t.pending -= sent[i]
+		if rest := t.events[url][sent[i]:]; len(rest) > 0 {
+			t.events[url] = rest
+			urls = append(urls, url)
+		} else {
+			delete(t.events, url)
+		}
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+	}
+	t.urls = urls
+	return err
+}
+
+// send 发送一批事件, 连接失败、超时、408、429 和 5xx 按指数退避重试
+func (t *webhookTarget) send(ctx context.Context, url string, events []json.RawMessage) error {
+	body, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := t.post(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= t.config.MaxRetry {
+			return fmt.Errorf("webhook %s failed after %d retries: %v", url, attempt, err)
+		}
+		backoff := time.Duration(500<<uint(attempt)) * time.Millisecond
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+		log.Warn().Err(err).Msgf("webhook %s failed, retry after %s", url, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// post 发送一次请求, 返回错误是否可以重试
+func (t *webhookTarget) post(ctx context.Context, url string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if t.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(t.config.Secret, timestamp, body))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook %s: %s %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, err
+}
+
+// webhookSignature 计算请求签名: HMAC-SHA256(secret, timestamp + "." + body) 的十六进制
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (t *webhookTarget) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
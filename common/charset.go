@@ -0,0 +1,94 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/tidb/pkg/parser/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// MySQL 字符集到 Go 解码器的映射, utf8/utf8mb4/ascii 不需要转码
+var charsetDecoders = map[string]encoding.Encoding{
+	"latin1":  charmap.Windows1252, // MySQL 的 latin1 实际上是 cp1252
+	"latin2":  charmap.ISO8859_2,
+	"cp1250":  charmap.Windows1250,
+	"cp1251":  charmap.Windows1251,
+	"cp1256":  charmap.Windows1256,
+	"cp1257":  charmap.Windows1257,
+	"greek":   charmap.ISO8859_7,
+	"hebrew":  charmap.ISO8859_8,
+	"latin5":  charmap.ISO8859_9,
+	"latin7":  charmap.ISO8859_13,
+	"koi8r":   charmap.KOI8R,
+	"koi8u":   charmap.KOI8U,
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK, // gb2312 是 EUC-CN 编码, GBK 是它的超集
+	"gb18030": simplifiedchinese.GB18030,
+	"big5":    traditionalchinese.Big5,
+	"sjis":    japanese.ShiftJIS,
+	"cp932":   japanese.ShiftJIS,
+	"ujis":    japanese.EUCJP,
+	"eucjpms": japanese.EUCJP,
+	"euckr":   korean.EUCKR,
+}
+
+// CharsetByCollationID 根据 TableMap 元数据中的 collation id 返回字符集名称, 未知时返回空串
+func CharsetByCollationID(id uint64) string {
+	collation, err := charset.GetCollationByID(int(id))
+	if err != nil || collation == nil {
+		return ""
+	}
+	return collation.CharsetName
+}
+
+// IsBinaryColumn 判断列是否为二进制类型, 这类列的值需要原样保留为字节
+func IsBinaryColumn(dataType string, columnCharset string) bool {
+	switch strings.ToLower(dataType) {
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "bit", "geometry":
+		return true
+	}
+	return strings.ToLower(columnCharset) == "binary"
+}
+
+// DecodeCharset 把指定字符集的原始字节转为 UTF-8 字符串
+func DecodeCharset(b []byte, columnCharset string) (string, error) {
+	dec, ok := charsetDecoders[strings.ToLower(columnCharset)]
+	if !ok {
+		// utf8/utf8mb4/ascii 以及未知字符集按原样输出
+		return string(b), nil
+	}
+	out, err := dec.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b), fmt.Errorf("decode %s value failed: %v", columnCharset, err)
+	}
+	return string(out), nil
+}
+
+// DecodeColumnValue 按列的类型和字符集转换 binlog 中的列值:
+// 字符串列转为 UTF-8 的 string, 二进制列统一返回 []byte, 其他类型原样返回
+func DecodeColumnValue(value interface{}, dataType string, columnCharset string) (interface{}, error) {
+	var raw []byte
+	switch v := value.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return value, nil
+	}
+
+	// 没有任何列信息时无法判断是否二进制, 保持原值
+	if dataType == "" && columnCharset == "" {
+		return value, nil
+	}
+	if IsBinaryColumn(dataType, columnCharset) {
+		return raw, nil
+	}
+	return DecodeCharset(raw, columnCharset)
+}
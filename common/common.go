@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/hex"
 	"fmt"
 	"strings"
 )
@@ -9,6 +10,9 @@ func FormatValue(s interface{}) (string, string) {
 	switch s.(type) {
 	case string:
 		return "string", strings.ReplaceAll(strings.ReplaceAll(fmt.Sprintf("%v", s), "'", `\'`), `"`, `\"`)
+	case []byte:
+		// 二进制列输出为十六进制, 避免原始字节破坏 SQL 文本
+		return "binary", hex.EncodeToString(s.([]byte))
 	case int32, int, int64, int16, int8:
 		return "int", strings.ReplaceAll(strings.ReplaceAll(fmt.Sprintf("%v", s), "'", `\'`), `"`, `\"`)
 	default:
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	MaskRedact = "redact" // 整列替换为 ***
+	MaskHash   = "hash"   // 加盐 sha256, 相同的值得到相同的结果, 可用于关联
+	MaskKeep   = "keep"   // 保留前 KeepFirst 个和后 KeepLast 个字符, 其余替换为 *
+	MaskFake   = "fake"   // 保留格式的伪造值: 数字换成数字, 字母换成同大小写的字母, 其余字符不变
+
+	maskRedacted = "***"
+)
+
+// MaskRule 脱敏规则, Column 为 db.table.column, 支持通配符, 例如 *.user*.phone
+type MaskRule struct {
+	Column    string `yaml:"column"`
+	Method    string `yaml:"method"`
+	KeepFirst int    `yaml:"keep_first,omitempty"`
+	KeepLast  int    `yaml:"keep_last,omitempty"`
+}
+
+// MaskConfig 脱敏配置, Salt 用于 hash 和 fake, 不同环境使用不同的盐避免结果被撞库还原
+type MaskConfig struct {
+	Salt  string     `yaml:"salt,omitempty"`
+	Rules []MaskRule `yaml:"rules,omitempty"`
+}
+
+// Masker 按规则对字段值脱敏, 并发安全
+type Masker struct {
+	salt  string
+	rules []MaskRule
+	cache sync.Map // db.table.column -> *MaskRule, 没有匹配的规则时为 nil
+}
+
+// ParseMaskRules 解析命令行的脱敏规则, 多个规则以逗号分隔,
+// 格式为 db.table.column:method[:keep_first[:keep_last]], 例如 db1.user.phone:keep:3:4,db1.user.email:fake
+func ParseMaskRules(spec string) ([]MaskRule, error) {
+	var rules []MaskRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid mask rule: %s, should be db.table.column:method[:keep_first[:keep_last]]", item)
+		}
+		rule := MaskRule{Column: parts[0], Method: parts[1]}
+		var err error
+		if len(parts) > 2 {
+			if rule.KeepFirst, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid mask rule: %s, keep_first should be a number", item)
+			}
+		}
+		if len(parts) > 3 {
+			if rule.KeepLast, err = strconv.Atoi(parts[3]); err != nil {
+				return nil, fmt.Errorf("invalid mask rule: %s, keep_last should be a number", item)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NewMasker 检查规则并创建 Masker, 没有规则时返回 nil, nil 的 Masker 不做任何处理
+func NewMasker(config MaskConfig) (*Masker, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+	m := &Masker{salt: config.Salt}
+	for _, rule := range config.Rules {
+		rule.Column = strings.ToLower(strings.TrimSpace(rule.Column))
+		if strings.Count(rule.Column, ".") != 2 {
+			return nil, fmt.Errorf("invalid mask column: %s, should be db.table.column", rule.Column)
+		}
+		if _, err := path.Match(rule.Column, ""); err != nil {
+			return nil, fmt.Errorf("invalid mask column: %s: %v", rule.Column, err)
+		}
+		switch rule.Method {
+		case MaskRedact, MaskHash, MaskFake:
+		case MaskKeep:
+			if rule.KeepFirst < 0 || rule.KeepLast < 0 {
+				return nil, fmt.Errorf("invalid mask rule of %s: keep_first and keep_last should not be negative", rule.Column)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported mask method of %s: %s, should be redact, hash, keep or fake", rule.Column, rule.Method)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// rule 返回字段匹配的第一条规则
+func (m *Masker) rule(db, table, column string) *MaskRule {
+	key := strings.ToLower(db + "." + table + "." + column)
+	if r, ok := m.cache.Load(key); ok {
+		return r.(*MaskRule)
+	}
+	var matched *MaskRule
+	for i := range m.rules {
+		if ok, _ := path.Match(m.rules[i].Column, key); ok {
+			matched = &m.rules[i]
+			break
+		}
+	}
+	m.cache.Store(key, matched)
+	return matched
+}
+
+// Enabled 判断字段是否需要脱敏
+func (m *Masker) Enabled(db, table, column string) bool {
+	return m != nil && m.rule(db, table, column) != nil
+}
+
+// Mask 对字段值脱敏, 没有匹配的规则或值为 NULL、空串时原样返回, 脱敏后的值都是字符串
+func (m *Masker) Mask(db, table, column string, value interface{}) interface{} {
+	if m == nil || value == nil || value == "" {
+		return value
+	}
+	rule := m.rule(db, table, column)
+	if rule == nil {
+		return value
+	}
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+
+	switch rule.Method {
+	case MaskRedact:
+		return maskRedacted
+	case MaskHash:
+		sum := sha256.Sum256([]byte(m.salt + s))
+		return hex.EncodeToString(sum[:])
+	case MaskKeep:
+		return maskKeep(s, rule.KeepFirst, rule.KeepLast)
+	case MaskFake:
+		return m.fake(s)
+	}
+	return value
+}
+
+// maskKeep 按字符(非字节)保留首尾, 字符数不超过保留长度时全部替换, 避免短值原样泄露
+func maskKeep(s string, first, last int) string {
+	runes := []rune(s)
+	if len(runes) <= first+last {
+		return strings.Repeat("*", len(runes))
+	}
+	for i := first; i < len(runes)-last; i++ {
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+// fake 生成与原值格式相同的伪造值, 以盐和原值的哈希为随机源, 相同的值总是得到相同的结果
+func (m *Masker) fake(s string) string {
+	seed := sha256.Sum256([]byte(m.salt + s))
+	stream := seed[:]
+	next := func() uint32 {
+		if len(stream) < 4 {
+			seed = sha256.Sum256(seed[:])
+			stream = seed[:]
+		}
+		n := binary.BigEndian.Uint32(stream)
+		stream = stream[4:]
+		return n
+	}
+
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case r >= '0' && r <= '9':
+			runes[i] = rune('0' + next()%10)
+		case r >= 'a' && r <= 'z':
+			runes[i] = rune('a' + next()%26)
+		case r >= 'A' && r <= 'Z':
+			runes[i] = rune('A' + next()%26)
+		case unicode.IsLetter(r):
+			// 中文等其他文字统一替换, 不保留原字符
+			runes[i] = '*'
+		}
+	}
+	return string(runes)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"example.com/m/v2/common"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
 )
@@ -25,6 +26,27 @@ type RedisConfig struct {
 		Addrs    []string `yaml:"addrs"`
 		Password string   `yaml:"password"`
 	} `yaml:"cluster"`
+	Stream    RedisStreamConfig      `yaml:"stream"`
+	KeyPrefix string                 `yaml:"keyPrefix,omitempty"` // 所有 key 的前缀
+	Instances map[string]RedisConfig `yaml:"instances,omitempty"` // 其他 Redis 实例, 表的 redis.instance 按名称选择
+}
+
+// RedisTableConfig 是同步到 Redis 时表的配置
+type RedisTableConfig struct {
+	Key        string `yaml:"key,omitempty"`        // key 模板, 支持 {db} {table} {pk} 和 {字段名}, 默认 {table}:{pk}
+	TTL        int    `yaml:"ttl,omitempty"`        // 过期时间(秒), 0 为不过期
+	TTLColumn  string `yaml:"ttlColumn,omitempty"`  // 过期时间字段(DATETIME/TIMESTAMP 或 Unix 时间戳), 优先于 ttl
+	Instance   string `yaml:"instance,omitempty"`   // 写入 instances 中的实例, 默认为 redis 配置的实例
+	DB         *int   `yaml:"db,omitempty"`         // 写入的 DB, 默认为实例配置的 db, cluster 模式不支持
+	Format     string `yaml:"format,omitempty"`     // 值的格式: hash(默认, HSET), json(SET JSON 字符串), rejson(RedisJSON JSON.SET)
+	NestedJSON bool   `yaml:"nestedJson,omitempty"` // json/rejson 格式中 MySQL JSON 字段作为嵌套的 JSON 而不是字符串
+}
+
+type RedisStreamConfig struct {
+	Enabled   bool   `yaml:"enabled"`             // 开启后变更事件用 XADD 写入 stream, 不再同步到 hash
+	Key       string `yaml:"key,omitempty"`       // stream 名, 支持 {db} {table}, 默认 {db}:{table}:changes
+	MaxLen    int64  `yaml:"maxLen,omitempty"`    // XADD 的 MAXLEN, 0 为不裁剪
+	ExactTrim bool   `yaml:"exactTrim,omitempty"` // 精确裁剪(MAXLEN N), 默认近似裁剪(MAXLEN ~ N)
 }
 
 type MongoDBConfig struct {
@@ -43,15 +65,18 @@ type ElasticsearchConfig struct {
 	Hosts    []string `yaml:"hosts"`
 	Username string   `yaml:"username"`
 	Password string   `yaml:"password"`
-	Index    string   `yaml:"index"`
+	Index    string   `yaml:"index"` // 索引名模板, 支持 {db} {table}, 默认 {db}_{table}; 表配置了 target_name 时使用 target_name
 	Version  int      `yaml:"version"`
 	Timeout  int      `yaml:"timeout"`
+	Refresh  string   `yaml:"refresh,omitempty"`  // bulk 请求的 refresh 参数: false(默认), true, wait_for
+	MaxRetry int      `yaml:"maxRetry,omitempty"` // 429/5xx 时的最大重试次数, 默认 5
 }
 
 type KafkaConfig struct {
 	Brokers []string `yaml:"brokers"`
-	Topic   string   `yaml:"topic"`
+	Topic   string   `yaml:"topic"` // topic 名, 支持 {db} {table} 按表分 topic; 表配置了 target_name 时使用 target_name
 	GroupId string   `yaml:"groupId"`
+	Format  string   `yaml:"format,omitempty"` // 消息格式: plain(默认), canal, debezium
 	SASL    struct {
 		Enabled   bool   `yaml:"enabled"`
 		Mechanism string `yaml:"mechanism"`
@@ -64,13 +89,63 @@ type KafkaConfig struct {
 	} `yaml:"tls"`
 }
 
-type MappingConfig struct {
+type MySQLTargetConfig struct {
+	IP       string `yaml:"ip"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database,omitempty"` // 目标库, 默认与源库同名
+	Charset  string `yaml:"charset,omitempty"`
+}
+
+type PostgresConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
 	Database string `yaml:"database"`
-	Tables   []struct {
-		Table      string   `yaml:"table"`
-		TargetName string   `yaml:"target_name"`
-		Columns    []string `yaml:"columns"`
-	} `yaml:"tables"`
+	Schema   string `yaml:"schema,omitempty"`  // 目标 schema, 默认 public
+	SSLMode  string `yaml:"sslmode,omitempty"` // 默认 disable
+}
+
+type ClickHouseConfig struct {
+	URL           string `yaml:"url"` // HTTP 接口地址, 如 http://127.0.0.1:8123
+	User          string `yaml:"user"`
+	Password      string `yaml:"password"`
+	Database      string `yaml:"database,omitempty"`       // 目标库, 默认与源库同名
+	BatchSize     int    `yaml:"batch_size,omitempty"`     // 每批写入的最大行数, 默认 100000
+	BatchBytes    int    `yaml:"batch_bytes,omitempty"`    // 每批写入的最大字节数, 默认 64MB
+	FlushInterval int    `yaml:"flush_interval,omitempty"` // 增量同步的写入间隔(秒), 默认 10
+	Timeout       int    `yaml:"timeout,omitempty"`        // 请求超时(毫秒), 默认不超时
+}
+
+type FileConfig struct {
+	Dir            string `yaml:"dir"`
+	Format         string `yaml:"format,omitempty"`          // 文件格式: ndjson(默认), csv
+	Gzip           bool   `yaml:"gzip,omitempty"`            // 是否 gzip 压缩
+	MaxSize        int    `yaml:"max_size,omitempty"`        // 单个文件的最大大小(MB), 默认 128
+	RotateInterval int    `yaml:"rotate_interval,omitempty"` // 切分文件的时间间隔(秒), 默认 3600
+}
+
+type WebhookConfig struct {
+	URL       string            `yaml:"url"`                  // 默认 URL, 支持 {db} {table}; 表配置了 target_name 时使用 target_name
+	Secret    string            `yaml:"secret,omitempty"`     // HMAC-SHA256 签名密钥, 为空时不签名
+	Headers   map[string]string `yaml:"headers,omitempty"`    // 附加的请求头
+	Timeout   int               `yaml:"timeout,omitempty"`    // 请求超时(毫秒), 默认 5000
+	MaxRetry  int               `yaml:"maxRetry,omitempty"`   // 最大重试次数, 默认 5
+	BatchSize int               `yaml:"batch_size,omitempty"` // 每个请求的最大事件数, 默认 write_batch_size, 至少为 1
+}
+
+type TableMapping struct {
+	Table      string            `yaml:"table"`
+	TargetName string            `yaml:"target_name"` // 目标端的名称, mysql 目标支持 db.table 格式
+	Columns    []string          `yaml:"columns"`
+	Redis      *RedisTableConfig `yaml:"redis,omitempty"` // 同步到 Redis 时的 key、过期时间、实例和值的格式
+}
+
+type MappingConfig struct {
+	Database string         `yaml:"database"`
+	Tables   []TableMapping `yaml:"tables"`
 }
 
 type Source struct {
@@ -90,12 +165,18 @@ type Target struct {
 	MongoDB       MongoDBConfig       `yaml:"mongodb"`
 	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
 	Kafka         KafkaConfig         `yaml:"kafka"`
+	MySQL         MySQLTargetConfig   `yaml:"mysql"`
+	Postgres      PostgresConfig      `yaml:"postgres"`
+	ClickHouse    ClickHouseConfig    `yaml:"clickhouse"`
+	File          FileConfig          `yaml:"file"`
+	Webhook       WebhookConfig       `yaml:"webhook"`
 }
 
 type Config struct {
 	Source  `yaml:"source"`
 	Target  `yaml:"target"`
-	Mapping []MappingConfig `yaml:"mapping"`
+	Mapping []MappingConfig   `yaml:"mapping"`
+	Mask    common.MaskConfig `yaml:"mask,omitempty"`
 }
 
 func ReadConf(conFile string) (*Config, error) {
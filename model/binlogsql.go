@@ -1,24 +1,43 @@
 package model
 
 type BinlogSql struct {
-	IP         string // mysql IP
-	Port       int    // mysql port
-	User       string // mysql user
-	PassWord   string // mysql password
-	DBName     string // mysql database name
-	TableName  string // mysql table name
-	ServerID   int    //server id
-	Mode       string // operation type
-	CharSet    string
-	StartFile  string
-	StopFile   string
-	StartPose  int
-	StopPose   int
-	StartTime  string
-	StopTime   string
-	OutFile    string
-	StopNever  string
-	DDL        string
-	RotateFlag string
-	BinlogDir  string
+	IP             string // mysql IP
+	Port           int    // mysql port
+	User           string // mysql user
+	PassWord       string // mysql password
+	DBName         string // mysql database name
+	TableName      string // mysql table name
+	ServerID       int    //server id
+	Mode           string // operation type
+	CharSet        string
+	StartFile      string
+	StopFile       string
+	StartPose      int
+	StopPose       int
+	StartTime      string
+	StopTime       string
+	OutFile        string
+	StopNever      string
+	DDL            string
+	RotateFlag     string
+	BinlogDir      string
+	Format         string // output format: sql, binlog-base64
+	GTIDSet        string // only parse transactions in the gtid set
+	OutputDir      string // extract mode output binlog directory
+	Tables         string // decommission mode: db.table patterns separated by comma
+	ReportFormat   string // report format, decommission mode: csv, json; capacity mode: table, json
+	Retention      string // capacity mode: target retention, e.g. 7d, 72h
+	Workers        int    // number of binlog files parsed concurrently in offline mode
+	OutputCompress string // output compress: none, gzip, zstd
+	OutputSplit    string // split output file by size (e.g. 512M) or by binlog file
+	Force          bool   // overwrite the existing output file
+	Heartbeat      int    // master heartbeat period in seconds, 0 to disable
+	Checkpoint     string // file to save the last processed position of streaming
+	ResumeBy       string // reconnect by: pos, gtid
+	MaxRetry       int    // max reconnect retries of streaming, 0 means unlimited
+	StopGTID       string // stop after the transaction of the gtid is committed
+	Mask           string // column mask rules: db.table.column:method[:keep_first[:keep_last]], separated by comma
+	MaskSalt       string // salt of mask method hash and fake
+	Where          string // row filter condition, e.g. user_id=1001 and status in (3,4)
+	WhereImage     string // row image checked by Where of update: any, before, after
 }
@@ -1,11 +1,17 @@
 package model
 
+import "example.com/m/v2/common"
+
 type SyncOption struct {
 	ConfigFile            string
 	WriteEventInterval    int64
 	WriteTimeInterval     int64
 	PrimaryKeyColumnNames map[string][]string
-	TableColumnMap        map[string][]string //保存从MySQL information_schema中查询到的表字段名
+	TableColumnMap        map[string][]string   //保存从MySQL information_schema中查询到的表字段名
+	TableColumnTypes      map[string][]string   //与TableColumnMap一一对应的字段类型
+	TableColumnCharsets   map[string][]string   //与TableColumnMap一一对应的字段字符集,非字符串字段为空
+	TableColumnMembers    map[string][][]string //与TableColumnMap一一对应的ENUM/SET字段成员,其他字段为nil
 	WriteMode             string
 	WriteBatchSize        int
+	Masker                *common.Masker //配置文件 mask 中的字段脱敏规则, nil 表示不脱敏
 }
@@ -0,0 +1,112 @@
+// Package binlog 把 MySQL binlog 事件解码为带表结构的行变更, 可以从在线的主库或本地 binlog 文件读取.
+//
+// 基本用法:
+//
+//	decoder := binlog.NewDecoder(binlog.NewDBSchema(db), binlog.TableFilter("db1", "user"))
+//	reader := binlog.NewFileReader("/data/mysql/binlog", []string{"mysql-bin.000001"}, decoder)
+//	defer reader.Close()
+//	err := reader.Run(ctx, func(c *binlog.Change) error {
+//		fmt.Println(c.Type, c.Table.Schema, c.Table.Name, c.Position, c.GTID)
+//		return nil
+//	})
+package binlog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// ChangeType 变更类型
+type ChangeType string
+
+const (
+	Insert ChangeType = "insert"
+	Update ChangeType = "update"
+	Delete ChangeType = "delete"
+	DDL    ChangeType = "ddl"
+)
+
+// Column 是表的一个字段
+type Column struct {
+	Name    string   // 列名
+	Type    string   // 数据类型, 表结构只能从 binlog 元数据得到时只有 enum/set, 其他为空
+	Charset string   // 字符集, 非字符串列为空
+	Members []string // ENUM/SET 的成员, 其他类型为空
+}
+
+// MemberValue 把行数据中 ENUM 的序号和 SET 的位图转换为成员名, 其他类型的值原样返回.
+// ENUM 序号 0 是写入非法值时的空串, SET 的多个成员用逗号连接
+func (c Column) MemberValue(value interface{}) interface{} {
+	n, ok := value.(int64)
+	if !ok {
+		return value
+	}
+	switch c.Type {
+	case "enum":
+		if n >= 1 && int(n) <= len(c.Members) {
+			return c.Members[n-1]
+		}
+		return ""
+	case "set":
+		var set []string
+		for i, member := range c.Members {
+			if n&(1<<uint(i)) != 0 {
+				set = append(set, member)
+			}
+		}
+		return strings.Join(set, ",")
+	}
+	return value
+}
+
+// Table 是变更所属的表
+type Table struct {
+	Schema  string
+	Name    string
+	Columns []Column
+}
+
+// ColumnIndex 返回字段的序号, 不区分大小写, 不存在时返回 -1
+func (t *Table) ColumnIndex(name string) int {
+	for i, col := range t.Columns {
+		if strings.EqualFold(col.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Row 是一行变更, insert 只有 After, delete 只有 Before, update 两者都有.
+// 值的类型与 go-mysql 解析结果一致, 字符串字段已按字段字符集转为 UTF-8, 二进制字段为 []byte
+type Row struct {
+	Before []interface{}
+	After  []interface{}
+}
+
+// Image 返回行的数据, 优先使用后镜像, 即 insert/update 为变更后的值, delete 为删除前的值
+func (r Row) Image() []interface{} {
+	if r.After != nil {
+		return r.After
+	}
+	return r.Before
+}
+
+// Change 是一个行事件或 DDL 解码后的变更
+type Change struct {
+	Type      ChangeType
+	Table     *Table
+	Rows      []Row  // 行变更, DDL 为空
+	Query     string // DDL 语句
+	Position  mysql.Position
+	GTID      string // 所在事务的 GTID, 未开启 GTID 时为空
+	Timestamp time.Time
+	Event     *replication.BinlogEvent // 原始事件
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("%s %s.%s %d rows at %s:%d", c.Type, c.Table.Schema, c.Table.Name, len(c.Rows), c.Position.Name, c.Position.Pos)
+}
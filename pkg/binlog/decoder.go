@@ -0,0 +1,183 @@
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"example.com/m/v2/common"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ddlRegex      = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|RENAME|TRUNCATE)\s+`)
+	ddlTableRegex = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|RENAME|TRUNCATE)\s+(TABLE\s+)?(?P<db>\w+)\.(?P<table>\w+)`)
+	// 语句格式的 DML, 表名可以带库名和反引号
+	dmlTableRegex = regexp.MustCompile("(?i)^\\s*(?:(?:INSERT|REPLACE)(?:\\s+(?:LOW_PRIORITY|DELAYED|HIGH_PRIORITY|IGNORE))*(?:\\s+INTO)?" +
+		"|UPDATE(?:\\s+(?:LOW_PRIORITY|IGNORE))*|DELETE(?:\\s+(?:LOW_PRIORITY|QUICK|IGNORE))*\\s+FROM)" +
+		"\\s+(?:`?(?P<db>\\w+)`?\\.)?`?(?P<table>\\w+)`?")
+)
+
+func IsDDL(query string) bool {
+	return ddlRegex.MatchString(query)
+}
+
+// ParseDDL 返回 DDL 语句中带库名的表, 例如 ALTER TABLE db.table ..., 表名不带库名时返回空串
+func ParseDDL(query string) (string, string) {
+	match := ddlTableRegex.FindStringSubmatch(query)
+	if len(match) == 0 {
+		return "", ""
+	}
+
+	paramsMap := make(map[string]string)
+	for i, name := range ddlTableRegex.SubexpNames() {
+		if i != 0 && name != "" {
+			paramsMap[name] = match[i]
+		}
+	}
+	return paramsMap["db"], paramsMap["table"]
+}
+
+// ParseDML 返回语句格式的 INSERT/REPLACE/UPDATE/DELETE 语句中的库名和表名, 表名不带库名时库名为空串, 不是 DML 时 ok 为 false
+func ParseDML(query string) (db string, table string, ok bool) {
+	match := dmlTableRegex.FindStringSubmatch(query)
+	if len(match) == 0 {
+		return "", "", false
+	}
+	return match[dmlTableRegex.SubexpIndex("db")], match[dmlTableRegex.SubexpIndex("table")], true
+}
+
+// Decoder 把 binlog 事件解码为 Change, 记录事务的 GTID. 一个 Decoder 只能处理一个有序的事件流, 不能并发使用
+type Decoder struct {
+	schema  SchemaProvider
+	filters []Filter
+	gtid    string
+}
+
+// NewDecoder 创建解码器, schema 为 nil 时使用 TableMap 元数据中的列名; 变更需要通过所有 filters 才返回
+func NewDecoder(schema SchemaProvider, filters ...Filter) *Decoder {
+	return &Decoder{schema: schema, filters: filters}
+}
+
+// AddFilter 添加过滤条件
+func (d *Decoder) AddFilter(filters ...Filter) {
+	d.filters = append(d.filters, filters...)
+}
+
+// GTID 返回当前事务的 GTID
+func (d *Decoder) GTID() string {
+	return d.gtid
+}
+
+// Decode 解码一个事件, fileName 为事件所在的 binlog 文件. 不是行事件或 DDL、或者被过滤时返回 nil
+func (d *Decoder) Decode(ev *replication.BinlogEvent, fileName string) (*Change, error) {
+	switch e := ev.Event.(type) {
+	case *replication.GTIDEvent:
+		d.gtid = ""
+		if next, err := e.GTIDNext(); err == nil {
+			d.gtid = next.String()
+		}
+		return nil, nil
+	case *replication.QueryEvent:
+		query := string(e.Query)
+		if !IsDDL(query) {
+			return nil, nil
+		}
+		dbName, tableName := ParseDDL(query)
+		if dbName == "" {
+			dbName = string(e.Schema)
+		}
+		if inv, ok := d.schema.(schemaInvalidator); ok {
+			inv.Invalidate(dbName, tableName)
+		}
+		return d.filter(&Change{
+			Type:  DDL,
+			Table: &Table{Schema: dbName, Name: tableName},
+			Query: query,
+		}, ev, fileName)
+	case *replication.RowsEvent:
+		var changeType ChangeType
+		switch ev.Header.EventType {
+		case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+			changeType = Insert
+		case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+			changeType = Update
+		case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+			changeType = Delete
+		default:
+			return nil, fmt.Errorf("unsupported event type: %v", ev.Header.EventType)
+		}
+		table, err := d.table(e.Table)
+		if err != nil {
+			return nil, err
+		}
+		change := &Change{Type: changeType, Table: table}
+		decodeRows(table, e.Rows)
+		switch changeType {
+		case Insert:
+			for _, row := range e.Rows {
+				change.Rows = append(change.Rows, Row{After: row})
+			}
+		case Delete:
+			for _, row := range e.Rows {
+				change.Rows = append(change.Rows, Row{Before: row})
+			}
+		case Update:
+			for i := 0; i+1 < len(e.Rows); i += 2 {
+				change.Rows = append(change.Rows, Row{Before: e.Rows[i], After: e.Rows[i+1]})
+			}
+		}
+		return d.filter(change, ev, fileName)
+	}
+	return nil, nil
+}
+
+func (d *Decoder) filter(change *Change, ev *replication.BinlogEvent, fileName string) (*Change, error) {
+	change.Position = mysql.Position{Name: fileName, Pos: ev.Header.LogPos}
+	change.GTID = d.gtid
+	change.Timestamp = time.Unix(int64(ev.Header.Timestamp), 0)
+	change.Event = ev
+	for _, f := range d.filters {
+		if !f(change) {
+			return nil, nil
+		}
+	}
+	return change, nil
+}
+
+// table 返回行事件的表结构, 字符集缺失时用 TableMap 元数据补齐
+func (d *Decoder) table(tableMap *replication.TableMapEvent) (*Table, error) {
+	table := &Table{Schema: string(tableMap.Schema), Name: string(tableMap.Table)}
+	if d.schema != nil {
+		columns, err := d.schema.TableColumns(table.Schema, table.Name)
+		if err != nil {
+			return nil, err
+		}
+		// 缓存中的字段定义是共享的, 复制后再修改
+		table.Columns = append([]Column(nil), columns...)
+	}
+	if len(table.Columns) == 0 {
+		table.Columns = tableMapColumns(tableMap)
+	}
+	fillColumnCharset(table.Columns, tableMap)
+	return table, nil
+}
+
+// decodeRows 按列字符集把行数据中的字符串转为 UTF-8, 二进制列保持为 []byte
+func decodeRows(table *Table, rows [][]interface{}) {
+	for _, row := range rows {
+		for i, value := range row {
+			if i >= len(table.Columns) {
+				break
+			}
+			column := table.Columns[i]
+			decoded, err := common.DecodeColumnValue(value, column.Type, column.Charset)
+			if err != nil {
+				log.Warn().Err(err).Msgf("%s.%s column %s charset decode failed", table.Schema, table.Name, column.Name)
+			}
+			row[i] = decoded
+		}
+	}
+}
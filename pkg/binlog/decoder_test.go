@@ -0,0 +1,193 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+type testSchema struct {
+	columns     map[string][]Column
+	invalidated []string
+}
+
+func (s *testSchema) TableColumns(schema, table string) ([]Column, error) {
+	return s.columns[schema+"."+table], nil
+}
+
+func (s *testSchema) Invalidate(schema, table string) {
+	s.invalidated = append(s.invalidated, schema+"."+table)
+}
+
+func newTestSchema() *testSchema {
+	return &testSchema{columns: map[string][]Column{
+		"db.t": {{Name: "id", Type: "int"}, {Name: "name", Type: "varchar", Charset: "latin1"}, {Name: "data", Type: "blob"}},
+	}}
+}
+
+func rowsEvent(eventType replication.EventType, schema, table string, logPos uint32, rows ...[]interface{}) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: eventType, LogPos: logPos, Timestamp: 1700000000},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{Schema: []byte(schema), Table: []byte(table), ColumnCount: 3},
+			Rows:  rows,
+		},
+	}
+}
+
+func TestDecodeRows(t *testing.T) {
+	decoder := NewDecoder(newTestSchema())
+
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	gtid := &replication.BinlogEvent{Header: &replication.EventHeader{EventType: replication.GTID_EVENT}, Event: &replication.GTIDEvent{SID: sid, GNO: 7}}
+	if change, err := decoder.Decode(gtid, "mysql-bin.000001"); change != nil || err != nil {
+		t.Fatalf("gtid event decoded to %v, %v", change, err)
+	}
+
+	// latin1 字段转为 UTF-8, 二进制字段保持 []byte
+	insert := rowsEvent(replication.WRITE_ROWS_EVENTv2, "db", "t", 200, []interface{}{int32(1), []byte{'c', 0xe9}, []byte{0xff}})
+	change, err := decoder.Decode(insert, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != Insert || change.Table.Schema != "db" || change.Table.Name != "t" || len(change.Rows) != 1 {
+		t.Fatalf("unexpected insert change %s", change)
+	}
+	if expect := []interface{}{int32(1), "cé", []byte{0xff}}; !reflect.DeepEqual(change.Rows[0].After, expect) || change.Rows[0].Before != nil {
+		t.Errorf("insert row is %#v, expect %#v", change.Rows[0], expect)
+	}
+	if change.Position.Name != "mysql-bin.000001" || change.Position.Pos != 200 || change.Event != insert {
+		t.Errorf("position is %v", change.Position)
+	}
+	if change.GTID != "3e11fa47-71ca-11e1-9e33-c80aa9429562:7" || decoder.GTID() != change.GTID {
+		t.Errorf("gtid is %s", change.GTID)
+	}
+	if change.Timestamp.Unix() != 1700000000 {
+		t.Errorf("timestamp is %v", change.Timestamp)
+	}
+
+	// update 的行两两成对
+	update := rowsEvent(replication.UPDATE_ROWS_EVENTv2, "db", "t", 300,
+		[]interface{}{int32(1), "a", nil}, []interface{}{int32(1), "b", nil},
+		[]interface{}{int32(2), "c", nil}, []interface{}{int32(2), "d", nil})
+	change, err = decoder.Decode(update, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != Update || len(change.Rows) != 2 || change.Rows[1].Before[1] != "c" || change.Rows[1].After[1] != "d" {
+		t.Errorf("unexpected update change %#v", change.Rows)
+	}
+
+	remove := rowsEvent(replication.DELETE_ROWS_EVENTv2, "db", "t", 400, []interface{}{int32(1), "b", nil})
+	change, err = decoder.Decode(remove, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != Delete || change.Rows[0].After != nil || change.Rows[0].Before[0] != int32(1) {
+		t.Errorf("unexpected delete change %#v", change.Rows)
+	}
+}
+
+// 没有表结构时使用 @1, @2... 作为列名
+func TestDecodeWithoutSchema(t *testing.T) {
+	change, err := NewDecoder(newTestSchema()).Decode(rowsEvent(replication.WRITE_ROWS_EVENTv2, "db", "other", 100, []interface{}{1, 2, 3}), "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(change.Table.Columns) != 3 || change.Table.Columns[2].Name != "@3" || change.Table.ColumnIndex("@2") != 1 {
+		t.Errorf("columns are %v", change.Table.Columns)
+	}
+}
+
+func TestDecodeQuery(t *testing.T) {
+	schema := newTestSchema()
+	decoder := NewDecoder(schema)
+	query := func(db, sql string) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT, LogPos: 500},
+			Event:  &replication.QueryEvent{Schema: []byte(db), Query: []byte(sql)},
+		}
+	}
+
+	for _, sql := range []string{"BEGIN", "INSERT INTO t VALUES (1)", "COMMIT"} {
+		if change, err := decoder.Decode(query("db", sql), "mysql-bin.000001"); change != nil || err != nil {
+			t.Errorf("%s decoded to %v, %v", sql, change, err)
+		}
+	}
+
+	change, err := decoder.Decode(query("other", "ALTER TABLE db.t ADD COLUMN c int"), "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != DDL || change.Table.Schema != "db" || change.Table.Name != "t" || change.Query != "ALTER TABLE db.t ADD COLUMN c int" {
+		t.Errorf("unexpected ddl change %s", change)
+	}
+	// 表名不带库名时使用当前库, 清除整个库的表结构
+	change, err = decoder.Decode(query("db", "TRUNCATE TABLE t"), "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Table.Schema != "db" || change.Table.Name != "" {
+		t.Errorf("unexpected ddl change %s", change)
+	}
+	if expect := []string{"db.t", "db."}; !reflect.DeepEqual(schema.invalidated, expect) {
+		t.Errorf("invalidated %v, expect %v", schema.invalidated, expect)
+	}
+}
+
+func TestDecodeFilter(t *testing.T) {
+	decoder := NewDecoder(newTestSchema(), TypeFilter(Insert))
+	decoder.AddFilter(TableFilter("DB", "t*"))
+
+	if change, _ := decoder.Decode(rowsEvent(replication.WRITE_ROWS_EVENTv2, "db", "t", 100, []interface{}{1, "a", nil}), "mysql-bin.000001"); change == nil {
+		t.Error("insert of db.t should pass the filters")
+	}
+	if change, _ := decoder.Decode(rowsEvent(replication.DELETE_ROWS_EVENTv2, "db", "t", 100, []interface{}{1, "a", nil}), "mysql-bin.000001"); change != nil {
+		t.Error("delete should be filtered by type")
+	}
+	if change, _ := decoder.Decode(rowsEvent(replication.WRITE_ROWS_EVENTv2, "db", "user", 100, []interface{}{1, 2, 3}), "mysql-bin.000001"); change != nil {
+		t.Error("insert of db.user should be filtered by table")
+	}
+}
+
+func TestParseDDLAndDML(t *testing.T) {
+	if !IsDDL("  alter table t add c int") || IsDDL("INSERT INTO t VALUES (1)") {
+		t.Error("IsDDL mismatch")
+	}
+	if db, table := ParseDDL("CREATE TABLE db1.t1 (id int)"); db != "db1" || table != "t1" {
+		t.Errorf("ParseDDL returns %s.%s", db, table)
+	}
+	for query, expect := range map[string][2]string{
+		"INSERT INTO t1 VALUES (1)":                  {"", "t1"},
+		"insert ignore into `db`.`t2`(a) values (1)": {"db", "t2"},
+		"REPLACE t3 SET a=1":                         {"", "t3"},
+		"UPDATE LOW_PRIORITY db.t4 SET a=1":          {"db", "t4"},
+		"DELETE QUICK FROM t5 WHERE id=1":            {"", "t5"},
+	} {
+		db, table, ok := ParseDML(query)
+		if !ok || db != expect[0] || table != expect[1] {
+			t.Errorf("ParseDML(%s) returns %s.%s %v", query, db, table, ok)
+		}
+	}
+	if _, _, ok := ParseDML("SAVEPOINT sp1"); ok {
+		t.Error("SAVEPOINT is not DML")
+	}
+}
+
+func TestParseEnumMembers(t *testing.T) {
+	tests := []struct {
+		columnType string
+		expect     []string
+	}{
+		{"enum('new','paid')", []string{"new", "paid"}},
+		{"set('a,b','it''s')", []string{"a,b", "it's"}},
+		{"int(11)", nil},
+		{"varchar", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseEnumMembers(tt.columnType); !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("ParseEnumMembers(%s) = %q, expect %q", tt.columnType, got, tt.expect)
+		}
+	}
+}
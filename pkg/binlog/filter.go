@@ -0,0 +1,67 @@
+package binlog
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// Filter 判断变更是否需要返回, 可以自定义, 例如按行数据过滤时修改 Change.Rows 并在没有行时返回 false
+type Filter func(c *Change) bool
+
+// TableFilter 按库名和表名过滤, 空串表示不限制, 支持通配符, 不区分大小写.
+// DDL 语句中的表名不带库名时只按库名过滤
+func TableFilter(schema, table string) Filter {
+	schema, table = strings.ToLower(schema), strings.ToLower(table)
+	match := func(pattern, name string) bool {
+		if pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(pattern, strings.ToLower(name))
+		return ok
+	}
+	return func(c *Change) bool {
+		if !match(schema, c.Table.Schema) {
+			return false
+		}
+		if c.Type == DDL && c.Table.Name == "" {
+			return true
+		}
+		return match(table, c.Table.Name)
+	}
+}
+
+// TypeFilter 只返回指定类型的变更
+func TypeFilter(types ...ChangeType) Filter {
+	return func(c *Change) bool {
+		for _, t := range types {
+			if c.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TimeFilter 按事件时间过滤, 零值表示不限制
+func TimeFilter(start, stop time.Time) Filter {
+	return func(c *Change) bool {
+		if !start.IsZero() && c.Timestamp.Before(start) {
+			return false
+		}
+		return stop.IsZero() || !c.Timestamp.After(stop)
+	}
+}
+
+// GTIDFilter 只返回 GTID 集合中的事务的变更
+func GTIDFilter(set mysql.GTIDSet) Filter {
+	return func(c *Change) bool {
+		if c.GTID == "" {
+			return false
+		}
+		gtid, err := mysql.ParseMysqlGTIDSet(c.GTID)
+		return err == nil && set.Contain(gtid)
+	}
+}
@@ -0,0 +1,75 @@
+package binlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+func TestTableFilter(t *testing.T) {
+	filter := TableFilter("db1", "user_*")
+	for _, c := range []struct {
+		change *Change
+		expect bool
+	}{
+		{&Change{Type: Insert, Table: &Table{Schema: "db1", Name: "user_1"}}, true},
+		{&Change{Type: Insert, Table: &Table{Schema: "DB1", Name: "USER_2"}}, true},
+		{&Change{Type: Insert, Table: &Table{Schema: "db1", Name: "order"}}, false},
+		{&Change{Type: Insert, Table: &Table{Schema: "db2", Name: "user_1"}}, false},
+		// DDL 的表名不带库名时只按库名过滤
+		{&Change{Type: DDL, Table: &Table{Schema: "db1"}}, true},
+		{&Change{Type: DDL, Table: &Table{Schema: "db2"}}, false},
+	} {
+		if got := filter(c.change); got != c.expect {
+			t.Errorf("TableFilter(%s.%s) = %v, expect %v", c.change.Table.Schema, c.change.Table.Name, got, c.expect)
+		}
+	}
+	if !TableFilter("", "")(&Change{Type: Update, Table: &Table{Schema: "any", Name: "any"}}) {
+		t.Error("empty pattern should match all tables")
+	}
+}
+
+func TestTypeFilter(t *testing.T) {
+	filter := TypeFilter(Update, Delete)
+	if filter(&Change{Type: Insert}) || !filter(&Change{Type: Update}) || !filter(&Change{Type: Delete}) {
+		t.Error("TypeFilter mismatch")
+	}
+}
+
+func TestTimeFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop := start.Add(time.Hour)
+	filter := TimeFilter(start, stop)
+	for ts, expect := range map[time.Time]bool{
+		start.Add(-time.Second): false,
+		start:                   true,
+		stop:                    true,
+		stop.Add(time.Second):   false,
+	} {
+		if got := filter(&Change{Timestamp: ts}); got != expect {
+			t.Errorf("TimeFilter(%v) = %v, expect %v", ts, got, expect)
+		}
+	}
+	if !TimeFilter(start, time.Time{})(&Change{Timestamp: stop.Add(time.Hour)}) {
+		t.Error("zero stop time should not limit")
+	}
+}
+
+func TestGTIDFilter(t *testing.T) {
+	set, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := GTIDFilter(set)
+	for gtid, expect := range map[string]bool{
+		"3e11fa47-71ca-11e1-9e33-c80aa9429562:50":  true,
+		"3e11fa47-71ca-11e1-9e33-c80aa9429562:101": false,
+		"4e11fa47-71ca-11e1-9e33-c80aa9429562:50":  false,
+		"": false,
+	} {
+		if got := filter(&Change{GTID: gtid}); got != expect {
+			t.Errorf("GTIDFilter(%q) = %v, expect %v", gtid, got, expect)
+		}
+	}
+}
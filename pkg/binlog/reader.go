@@ -0,0 +1,155 @@
+package binlog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+var errReaderClosed = errors.New("binlog reader closed")
+
+type eventItem struct {
+	ev   *replication.BinlogEvent
+	file string
+	err  error
+}
+
+// Reader 从本地 binlog 文件或主库读取事件, 用 Decoder 解码后按顺序返回变更
+type Reader struct {
+	decoder *Decoder
+	next    func(ctx context.Context) (*replication.BinlogEvent, string, error)
+	close   func()
+	once    sync.Once
+}
+
+// NewFileReader 按顺序读取 dir 目录中的 binlog 文件, 读完所有文件后 Next 返回 io.EOF. 只使用 NextEvent 时 decoder 可以为 nil
+func NewFileReader(dir string, files []string, decoder *Decoder) *Reader {
+	events := make(chan eventItem)
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		for _, fileName := range files {
+			parser := replication.NewBinlogParser()
+			parser.SetVerifyChecksum(true)
+			err := parser.ParseFile(filepath.Join(dir, fileName), 0, func(ev *replication.BinlogEvent) error {
+				select {
+				case events <- eventItem{ev: ev, file: fileName}:
+					return nil
+				case <-done:
+					return errReaderClosed
+				}
+			})
+			if err != nil {
+				select {
+				case events <- eventItem{err: err, file: fileName}:
+				case <-done:
+				}
+				return
+			}
+		}
+	}()
+
+	return &Reader{
+		decoder: decoder,
+		next: func(ctx context.Context) (*replication.BinlogEvent, string, error) {
+			select {
+			case item, ok := <-events:
+				if !ok {
+					return nil, "", io.EOF
+				}
+				return item.ev, item.file, item.err
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+		},
+		close: func() { close(done) },
+	}
+}
+
+// NewServerReader 通过复制协议从主库的 pos 位置开始读取, 持续等待新的事件直到 ctx 取消
+func NewServerReader(cfg replication.BinlogSyncerConfig, pos mysql.Position, decoder *Decoder) (*Reader, error) {
+	syncer := replication.NewBinlogSyncer(cfg)
+	streamer, err := syncer.StartSync(pos)
+	if err != nil {
+		syncer.Close()
+		return nil, err
+	}
+	return newStreamerReader(syncer, streamer, pos.Name, decoder), nil
+}
+
+// NewServerReaderGTID 通过复制协议读取 GTID 集合之后的事务
+func NewServerReaderGTID(cfg replication.BinlogSyncerConfig, executed mysql.GTIDSet, decoder *Decoder) (*Reader, error) {
+	syncer := replication.NewBinlogSyncer(cfg)
+	streamer, err := syncer.StartSyncGTID(executed)
+	if err != nil {
+		syncer.Close()
+		return nil, err
+	}
+	return newStreamerReader(syncer, streamer, "", decoder), nil
+}
+
+func newStreamerReader(syncer *replication.BinlogSyncer, streamer *replication.BinlogStreamer, fileName string, decoder *Decoder) *Reader {
+	return &Reader{
+		decoder: decoder,
+		next: func(ctx context.Context) (*replication.BinlogEvent, string, error) {
+			ev, err := streamer.GetEvent(ctx)
+			if err != nil {
+				return nil, fileName, err
+			}
+			// Rotate 事件之后的事件属于下一个文件
+			if e, ok := ev.Event.(*replication.RotateEvent); ok {
+				fileName = string(e.NextLogName)
+			}
+			return ev, fileName, nil
+		},
+		close: syncer.Close,
+	}
+}
+
+// NextEvent 返回下一个原始事件和所在的 binlog 文件, 不经过 Decoder
+func (r *Reader) NextEvent(ctx context.Context) (*replication.BinlogEvent, string, error) {
+	return r.next(ctx)
+}
+
+// Next 返回下一个变更, 本地文件读完时返回 io.EOF
+func (r *Reader) Next(ctx context.Context) (*Change, error) {
+	for {
+		ev, fileName, err := r.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		change, err := r.decoder.Decode(ev, fileName)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			return change, nil
+		}
+	}
+}
+
+// Run 对每个变更调用 fn, fn 返回错误时停止; 本地文件读完时返回 nil
+func (r *Reader) Run(ctx context.Context, fn func(c *Change) error) error {
+	for {
+		change, err := r.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+}
+
+// Close 停止读取并释放连接, 可以重复调用
+func (r *Reader) Close() {
+	r.once.Do(r.close)
+}
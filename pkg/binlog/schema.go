@@ -0,0 +1,145 @@
+package binlog
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"example.com/m/v2/common"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// SchemaProvider 提供表的字段定义, 字段顺序与 binlog 行数据一致
+type SchemaProvider interface {
+	TableColumns(schema, table string) ([]Column, error)
+}
+
+// schemaInvalidator 由 SchemaProvider 可选实现, Decoder 遇到 DDL 时通知表结构已变化
+type schemaInvalidator interface {
+	Invalidate(schema, table string)
+}
+
+// DBSchema 从 information_schema 查询表结构并缓存, 表结构以查询时的当前结构为准, 并发安全
+type DBSchema struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	cache map[string][]Column
+}
+
+func NewDBSchema(db *sql.DB) *DBSchema {
+	return &DBSchema{db: db, cache: make(map[string][]Column)}
+}
+
+func (s *DBSchema) TableColumns(schema, table string) ([]Column, error) {
+	if s.db == nil {
+		return nil, fmt.Errorf("database connection is not available")
+	}
+	key := strings.ToLower(schema + "." + table)
+	s.mu.Lock()
+	columns, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok {
+		return columns, nil
+	}
+
+	query := "SELECT COLUMN_NAME,DATA_TYPE,COLUMN_TYPE,IFNULL(CHARACTER_SET_NAME,'') FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION;"
+	rows, err := s.db.Query(query, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column Column
+		var columnType string
+		if err := rows.Scan(&column.Name, &column.Type, &columnType, &column.Charset); err != nil {
+			return nil, err
+		}
+		if column.Type == "enum" || column.Type == "set" {
+			column.Members = ParseEnumMembers(columnType)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[key] = columns
+	s.mu.Unlock()
+	return columns, nil
+}
+
+// Invalidate 清除表结构缓存, 下次使用时重新查询
+func (s *DBSchema) Invalidate(schema, table string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if table == "" {
+		s.cache = make(map[string][]Column)
+		return
+	}
+	delete(s.cache, strings.ToLower(schema+"."+table))
+}
+
+// ParseEnumMembers 解析 enum('a','b') 或 set(...) 中的成员, 成员中的单引号写为两个单引号
+func ParseEnumMembers(columnType string) []string {
+	start, end := strings.IndexByte(columnType, '('), strings.LastIndexByte(columnType, ')')
+	if start < 0 || end <= start {
+		return nil
+	}
+	var members []string
+	var member strings.Builder
+	quoted := false
+	list := columnType[start+1 : end]
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		switch {
+		case c == '\'' && quoted && i+1 < len(list) && list[i+1] == '\'':
+			member.WriteByte(c)
+			i++
+		case c == '\'':
+			if quoted {
+				members = append(members, member.String())
+				member.Reset()
+			}
+			quoted = !quoted
+		case quoted:
+			member.WriteByte(c)
+		}
+	}
+	return members
+}
+
+// tableMapColumns 在没有表结构时使用 TableMap 元数据中的列名和 ENUM/SET 成员(需要 binlog_row_metadata=FULL), 没有列名时使用 @1, @2...
+func tableMapColumns(table *replication.TableMapEvent) []Column {
+	names := table.ColumnNameString()
+	enums, sets := table.EnumStrValueMap(), table.SetStrValueMap()
+	columns := make([]Column, table.ColumnCount)
+	for i := range columns {
+		if i < len(names) && names[i] != "" {
+			columns[i].Name = names[i]
+		} else {
+			columns[i].Name = fmt.Sprintf("@%d", i+1)
+		}
+		if members, ok := enums[i]; ok {
+			columns[i].Type, columns[i].Members = "enum", members
+		} else if members, ok := sets[i]; ok {
+			columns[i].Type, columns[i].Members = "set", members
+		}
+	}
+	return columns
+}
+
+// fillColumnCharset 使用 TableMap 元数据补齐 information_schema 中查不到的字符集,
+// 需要 MySQL 8.0 以上的 binlog_row_metadata 支持
+func fillColumnCharset(columns []Column, table *replication.TableMapEvent) {
+	if table == nil {
+		return
+	}
+	for i, collationID := range table.CollationMap() {
+		if i >= len(columns) || columns[i].Charset != "" {
+			continue
+		}
+		columns[i].Charset = common.CharsetByCollationID(collationID)
+	}
+}